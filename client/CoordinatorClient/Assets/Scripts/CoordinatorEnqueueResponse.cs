@@ -0,0 +1,15 @@
+﻿using System;
+
+namespace Coordinator
+{
+    [Serializable]
+    public class CoordinatorEnqueueResponse
+    {
+        public string QueryToken;
+        public string SessionToken; // Sent with poll and dequeue
+        public long SessionExpires;
+        public string PartyID;
+        public string Region;
+        public string Mode;
+    }
+}
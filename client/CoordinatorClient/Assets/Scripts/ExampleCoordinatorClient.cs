@@ -6,6 +6,7 @@ namespace Coordinator
     public class ExampleCoordinatorClient : MonoBehaviour
     {
         public string Address = "127.0.0.1";
+        public string Platform = "steam";
         public int PollRate = 60;
         public ulong UserID = 0;
         public string AuthToken = "";
@@ -17,7 +18,7 @@ namespace Coordinator
 
         private IEnumerator Start()
         {
-            _api = new ExampleCoordinatorClientAPI(Address, PollRate);
+            _api = new ExampleCoordinatorClientAPI(Address, Platform, PollRate);
 
             IEnumerator startRoutine;
             if(_api.StartSearch(UserID, AuthToken, Region, OnConnectFailed, out startRoutine))
@@ -8,6 +8,7 @@ namespace Coordinator
     public class ExampleCoordinatorClientAPI : ICoordinatorClientAPI
     {
         private readonly string _address;
+        private readonly string _platform;
         private readonly float _pollRate;
         private readonly int _maxRetriesUntilFail;
         private readonly int _maxErrorsUntilCancel;
@@ -19,10 +20,12 @@ namespace Coordinator
         private bool _requestInProgress;
         private bool _searching;
         private string _queryToken;
+        private string _sessionToken;
 
-        public ExampleCoordinatorClientAPI(string address, int pollRate, int maxRetriesUntilFail = 3, int maxErrorsUntilCancel = 5)
+        public ExampleCoordinatorClientAPI(string address, string platform, int pollRate, int maxRetriesUntilFail = 3, int maxErrorsUntilCancel = 5)
         {
             _address = address;
+            _platform = platform;
             _pollRate = pollRate;
             _maxRetriesUntilFail = maxRetriesUntilFail;
             _maxErrorsUntilCancel = maxErrorsUntilCancel;
@@ -62,7 +65,7 @@ namespace Coordinator
 
             var uriBuilder = new UriBuilder(_enqueueURL)
             {
-                Query = string.Format("UserID={0}&AuthToken={1}&Region={2}", userID, authToken, region)
+                Query = string.Format("Platform={0}&UserID={1}&AuthToken={2}&Region={3}", Uri.EscapeDataString(_platform), userID, Uri.EscapeDataString(authToken), Uri.EscapeDataString(region))
             };
 
             int tries = 0;
@@ -83,7 +86,10 @@ namespace Coordinator
                     }
                     else
                     {
-                        _queryToken = request.downloadHandler.text;
+                        var response = JsonUtility.FromJson<CoordinatorEnqueueResponse>(request.downloadHandler.text);
+
+                        _queryToken = response.QueryToken;
+                        _sessionToken = response.SessionToken;
                         _searching = true;
 
                         break;
@@ -110,6 +116,8 @@ namespace Coordinator
 
             using (var request = UnityWebRequest.Get(requestURI))
             {
+                request.SetRequestHeader("Authorization", "Bearer " + _sessionToken);
+
                 yield return request.SendWebRequest();
 
                 if (request.isNetworkError)
@@ -123,6 +131,7 @@ namespace Coordinator
                 else if (request.responseCode == 200)
                 {
                     _queryToken = null;
+                    _sessionToken = null;
                 }
             }
 
@@ -144,6 +153,8 @@ namespace Coordinator
 
                 using (var request = UnityWebRequest.Get(requestURI))
                 {
+                    request.SetRequestHeader("Authorization", "Bearer " + _sessionToken);
+
                     yield return request.SendWebRequest();
 
                     if (request.isNetworkError)
@@ -5,31 +5,90 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/signer/v4"
-	"google.golang.org/appengine/log"
-	"google.golang.org/appengine/urlfetch"
 )
 
 const (
-	authCredentialRegion      = "eu-west-1"
-	authCredentialService     = "cf"
-	allocateAPIPath           = "https://api.multiplay.co.uk/cfp/v1/server/allocate"
-	deallocateAPIPath         = "https://api.multiplay.co.uk/cfp/v1/server/deallocate"
-	allocationsAPIPath        = "https://api.multiplay.co.uk/cfp/v1/server/allocations"
-	profileIDPath             = "clanforge-api-profile.key"
-	clanforgeAPIAccessKeyPath = "clanforge-api-access.key"
-	clanforgeAPISecretKeyPath = "clanforge-api-secret.key"
-	naRegionName              = "na"
-	naRegionIDPath            = "clanforge-api-region-na.key"
-	euRegionName              = "eu"
-	euRegionIDPath            = "clanforge-api-region-eu.key"
+	authCredentialRegion  = "eu-west-1"
+	authCredentialService = "cf"
+	allocateAPIPath       = "https://api.multiplay.co.uk/cfp/v1/server/allocate"
+	deallocateAPIPath     = "https://api.multiplay.co.uk/cfp/v1/server/deallocate"
+	allocationsAPIPath    = "https://api.multiplay.co.uk/cfp/v1/server/allocations"
 )
 
+const (
+	clanForgeMaxAttempts         = 3   // Per call, for idempotent calls
+	clanForgeRetryBaseDelayMS    = 250 // Doubled on each retry
+	clanForgeRetryMaxDelayMS     = 2000
+	clanForgeCircuitThreshold    = 5 // Consecutive failed requests opening the circuit
+	clanForgeCircuitOpenSeconds  = 60
+	clanForgeFailuresKey         = "ClanForge-Failures"
+	clanForgeCircuitKey          = "ClanForge-Circuit-Open"
+	clanForgeMetricsKey          = "ClanForge-Metric-"
+	clanForgeRequestsMetric      = "Requests"
+	clanForgeSuccessMetric       = "Success"
+	clanForgeRetriesMetric       = "Retries"
+	clanForgeLatencyMetric       = "LatencyMS"
+	clanForgeOperationAllocate   = "Allocate"
+	clanForgeOperationCheck      = "Allocations"
+	clanForgeOperationList       = "ProfileAllocations"
+	clanForgeOperationDeallocate = "Deallocate"
+)
+
+// Kinds of clanForgeError
+const (
+	clanForgeErrorAuth      = "auth"       // Credentials rejected, 401 or 403
+	clanForgeErrorRateLimit = "rate_limit" // 429
+	clanForgeErrorCapacity  = "capacity"   // Allocation refused, e.g. no servers available
+	clanForgeErrorServer    = "server"     // 5xx
+	clanForgeErrorRequest   = "request"    // Other 4xx, or a failed query
+	clanForgeErrorNetwork   = "network"    // No response
+)
+
+var clanForgeOperations = []string{clanForgeOperationAllocate, clanForgeOperationCheck, clanForgeOperationList, clanForgeOperationDeallocate}
+var clanForgeErrorKinds = []string{clanForgeErrorAuth, clanForgeErrorRateLimit, clanForgeErrorCapacity, clanForgeErrorServer, clanForgeErrorRequest, clanForgeErrorNetwork}
+
+// clanForgeError is a failed ClanForge call
+type clanForgeError struct {
+	Kind       string
+	StatusCode int // 0 without a response
+	Message    string
+	RetryAfter time.Duration // From a 429 response
+}
+
+func (e *clanForgeError) Error() string {
+	if e.StatusCode == 0 {
+		return fmt.Sprintf("clanforge %v error: %v", e.Kind, e.Message)
+	}
+
+	return fmt.Sprintf("clanforge %v error (status %v): %v", e.Kind, e.StatusCode, e.Message)
+}
+
+// retryable reports whether the call may succeed if repeated
+func (e *clanForgeError) retryable() bool {
+	return e.Kind == clanForgeErrorNetwork || e.Kind == clanForgeErrorServer || e.Kind == clanForgeErrorRateLimit || e.Kind == clanForgeErrorCapacity
+}
+
+// unavailable reports whether the error counts towards opening the circuit
+func (e *clanForgeError) unavailable() bool {
+	return e.Kind == clanForgeErrorNetwork || e.Kind == clanForgeErrorServer || e.Kind == clanForgeErrorRateLimit || e.Kind == clanForgeErrorAuth
+}
+
+// isPermanentProviderError reports whether a provider call failed in a way retrying will not fix
+func isPermanentProviderError(err error) bool {
+	cfErr, ok := err.(*clanForgeError)
+
+	return ok && !cfErr.retryable()
+}
+
 type allocateResponse struct {
 	Success    bool                 `json:"success"`
 	Messages   []string             `json:"messages"`
@@ -69,20 +128,10 @@ type allocationsResponseInfo struct {
 	Error     string `json:"error"`
 }
 
-var defaultProfileID = getStringFromFile(profileIDPath)
-var clanforgeAPIAccessKey = getStringFromFile(clanforgeAPIAccessKeyPath)
-var clanforgeAPISecretKey = getStringFromFile(clanforgeAPISecretKeyPath)
-var naRegionID = getStringFromFile(naRegionIDPath)
-var euRegionID = getStringFromFile(euRegionIDPath)
-
 func getRegionID(region string) string {
-	if region == naRegionName {
-		return naRegionID
-	} else if region == euRegionName {
-		return euRegionID
-	}
+	settings, _ := findRegion(region)
 
-	return ""
+	return settings.ClanForgeRegionID
 }
 
 func queryClanForgeAlloc(ctx context.Context, serverID, profileID, regionID string) (response allocateResponse, err error) {
@@ -100,17 +149,13 @@ func queryClanForgeAlloc(ctx context.Context, serverID, profileID, regionID stri
 
 	encodedQueryParams := queryParams.Encode()
 
-	responseCode, responseBody, err := queryClanForge(ctx, allocateAPIPath, encodedQueryParams)
+	responseBody, err := queryClanForge(ctx, clanForgeOperationAllocate, allocateAPIPath, encodedQueryParams, false)
 
 	if err != nil {
 		log.Errorf(ctx, "[Query-CF] ClanforgeRequest Failed, ERROR: %v", err)
 		return
 	}
 
-	if responseCode != 200 {
-		log.Errorf(ctx, "[Query-CF] ClanforgeRequest Failed, STATUS: %v", responseCode)
-	}
-
 	allocResponse := new(allocateResponse)
 	err = json.Unmarshal(responseBody, &allocResponse)
 
@@ -135,15 +180,42 @@ func queryClanForgeAllocations(ctx context.Context, serverID string) (response a
 
 	encodedQueryParams := queryParams.Encode()
 
-	responseCode, responseBody, err := queryClanForge(ctx, allocationsAPIPath, encodedQueryParams)
+	responseBody, err := queryClanForge(ctx, clanForgeOperationCheck, allocationsAPIPath, encodedQueryParams, true)
 
 	if err != nil {
 		log.Errorf(ctx, "[Query-CF] ClanforgeRequest Failed, ERROR: %v", err)
 		return
 	}
 
-	if responseCode != 200 {
-		log.Errorf(ctx, "[Query-CF] ClanforgeRequest Failed, STATUS: %v", responseCode)
+	allocsResponse := new(allocationsResponse)
+	err = json.Unmarshal(responseBody, &allocsResponse)
+
+	if err != nil {
+		return
+	}
+
+	response = *allocsResponse
+	return
+}
+
+func queryClanForgeProfileAllocations(ctx context.Context, profileID string) (response allocationsResponse, err error) {
+	url, err := url.Parse(allocationsAPIPath)
+
+	if err != nil {
+		return
+	}
+
+	queryParams := url.Query()
+
+	queryParams.Add("profileid", profileID)
+
+	encodedQueryParams := queryParams.Encode()
+
+	responseBody, err := queryClanForge(ctx, clanForgeOperationList, allocationsAPIPath, encodedQueryParams, true)
+
+	if err != nil {
+		log.Errorf(ctx, "[Query-CF] ClanforgeRequest Failed, ERROR: %v", err)
+		return
 	}
 
 	allocsResponse := new(allocationsResponse)
@@ -170,17 +242,13 @@ func queryClanForgeDealloc(ctx context.Context, serverID string) (response deall
 
 	encodedQueryParams := queryParams.Encode()
 
-	responseCode, responseBody, err := queryClanForge(ctx, deallocateAPIPath, encodedQueryParams)
+	responseBody, err := queryClanForge(ctx, clanForgeOperationDeallocate, deallocateAPIPath, encodedQueryParams, true)
 
 	if err != nil {
 		log.Errorf(ctx, "[Query-CF] ClanforgeRequest Failed, ERROR: %v", err)
 		return
 	}
 
-	if responseCode != 200 {
-		log.Errorf(ctx, "[Query-CF] ClanforgeRequest Failed, STATUS: %v", responseCode)
-	}
-
 	deallocResponse := new(deallocateResponse)
 	err = json.Unmarshal(responseBody, &deallocResponse)
 
@@ -192,8 +260,46 @@ func queryClanForgeDealloc(ctx context.Context, serverID string) (response deall
 	return
 }
 
-func queryClanForge(ctx context.Context, apiPath, queryParams string) (responseCode int, responseBody []byte, err error) {
-	client := urlfetch.Client(ctx)
+// queryClanForge makes a signed GET request, returning the body of a 200 response or a
+// clanForgeError. Idempotent calls are retried with exponential backoff on retryable errors.
+// Allocations fail fast while the circuit is open.
+func queryClanForge(ctx context.Context, operation, apiPath, queryParams string, idempotent bool) (responseBody []byte, err error) {
+	if !idempotent && clanForgeCircuitOpen(ctx) {
+		err = &clanForgeError{Kind: clanForgeErrorServer, Message: "circuit open, ClanForge is failing"}
+		return
+	}
+
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		responseBody, err = sendClanForgeRequest(ctx, apiPath, queryParams)
+		recordClanForgeRequest(ctx, operation, time.Now().Sub(start), err)
+
+		cfErr, ok := err.(*clanForgeError)
+
+		if err == nil || !ok || !idempotent || !cfErr.retryable() || attempt >= clanForgeMaxAttempts {
+			return
+		}
+
+		delay := time.Millisecond * time.Duration(clanForgeRetryBaseDelayMS<<uint(attempt-1))
+		if cfErr.RetryAfter > delay {
+			delay = cfErr.RetryAfter
+		}
+		if delay > time.Millisecond*clanForgeRetryMaxDelayMS {
+			delay = time.Millisecond * clanForgeRetryMaxDelayMS
+		}
+
+		// Up to 25% jitter so instances don't retry in step
+		delay += time.Duration(rand.Int63n(int64(delay)/4 + 1))
+
+		log.Warningf(ctx, "[Query-CF] %v failed (attempt %v), retrying in %v: %v", operation, attempt, delay, err)
+		incrementClanForgeMetric(ctx, operation, clanForgeRetriesMetric, 1)
+
+		time.Sleep(delay)
+	}
+}
+
+func sendClanForgeRequest(ctx context.Context, apiPath, queryParams string) (responseBody []byte, err error) {
+	client := httpClient(ctx)
 
 	fullURL := fmt.Sprintf("%v?%v", apiPath, queryParams)
 	req, err := http.NewRequest("GET", fullURL, nil)
@@ -202,27 +308,137 @@ func queryClanForge(ctx context.Context, apiPath, queryParams string) (responseC
 		return
 	}
 
-	credentials := credentials.NewStaticCredentials(clanforgeAPIAccessKey, clanforgeAPISecretKey, "")
+	credentials := credentials.NewStaticCredentials(config.ClanForge.AccessKey, config.ClanForge.SecretKey, "")
 	signer := v4.NewSigner(credentials)
 	_, err = signer.Sign(req, nil, authCredentialService, authCredentialRegion, time.Now())
 
+	if err != nil {
+		return
+	}
+
 	log.Infof(ctx, "[Query-CF] Sending Request: %v", fullURL)
 
 	resp, err := client.Do(req)
 
 	if err != nil {
+		err = &clanForgeError{Kind: clanForgeErrorNetwork, Message: err.Error()}
 		return
 	}
 
-	responseCode = resp.StatusCode
-
 	defer resp.Body.Close()
 
 	responseBody, err = ioutil.ReadAll(resp.Body)
 
+	if err != nil {
+		err = &clanForgeError{Kind: clanForgeErrorNetwork, StatusCode: resp.StatusCode, Message: err.Error()}
+		return
+	}
+
+	if resp.StatusCode == http.StatusOK {
+		return
+	}
+
+	cfErr := &clanForgeError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(responseBody))}
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		cfErr.Kind = clanForgeErrorAuth
+	case resp.StatusCode == http.StatusTooManyRequests:
+		cfErr.Kind = clanForgeErrorRateLimit
+
+		if seconds, parseErr := strconv.Atoi(resp.Header.Get("Retry-After")); parseErr == nil {
+			cfErr.RetryAfter = time.Second * time.Duration(seconds)
+		}
+	case resp.StatusCode >= 500:
+		cfErr.Kind = clanForgeErrorServer
+	default:
+		cfErr.Kind = clanForgeErrorRequest
+	}
+
+	return nil, cfErr
+}
+
+// clanForgeCircuitOpen reports whether ClanForge has failed too often recently to allocate from. The
+// circuit closes after clanForgeCircuitOpenSeconds, and reopens if the next request fails.
+func clanForgeCircuitOpen(ctx context.Context) bool {
+	_, err := cache.Get(ctx, clanForgeCircuitKey)
+
+	if err != nil && err != errCacheMiss {
+		log.Errorf(ctx, "[Query-CF] %v", err.Error())
+	}
+
+	return err == nil
+}
+
+// recordClanForgeRequest updates the metrics and the circuit breaker's count of consecutive failures
+func recordClanForgeRequest(ctx context.Context, operation string, latency time.Duration, err error) {
+	incrementClanForgeMetric(ctx, operation, clanForgeRequestsMetric, 1)
+	incrementClanForgeMetric(ctx, operation, clanForgeLatencyMetric, int64(latency/time.Millisecond))
+
+	cfErr, ok := err.(*clanForgeError)
+
+	if err == nil {
+		incrementClanForgeMetric(ctx, operation, clanForgeSuccessMetric, 1)
+	} else if ok {
+		incrementClanForgeMetric(ctx, operation, cfErr.Kind, 1)
+	}
+
+	if err == nil {
+		cacheErr := cache.Delete(ctx, clanForgeFailuresKey)
+		if cacheErr != nil {
+			log.Errorf(ctx, "[Query-CF] %v", cacheErr.Error())
+		}
+		return
+	}
+
+	if !ok || !cfErr.unavailable() {
+		return
+	}
+
+	failures, cacheErr := cache.Increment(ctx, clanForgeFailuresKey, 1, 0)
+
+	if cacheErr != nil {
+		log.Errorf(ctx, "[Query-CF] %v", cacheErr.Error())
+		return
+	}
+
+	if failures >= clanForgeCircuitThreshold {
+		log.Errorf(ctx, "[Query-CF] %v consecutive failures, pausing allocations for %v seconds", failures, clanForgeCircuitOpenSeconds)
+
+		cacheErr = cache.Set(ctx, clanForgeCircuitKey, []byte(cfErr.Kind), time.Second*clanForgeCircuitOpenSeconds)
+		if cacheErr != nil {
+			log.Errorf(ctx, "[Query-CF] %v", cacheErr.Error())
+		}
+	}
+}
+
+func incrementClanForgeMetric(ctx context.Context, operation, metric string, delta int64) {
+	_, err := cache.Increment(ctx, clanForgeMetricsKey+operation+"-"+metric, delta, 0)
+
+	if err != nil {
+		log.Errorf(ctx, "[Query-CF] %v", err.Error())
+	}
+}
+
+// takeClanForgeMetric reads and resets a metric, keeping increments made in between
+func takeClanForgeMetric(ctx context.Context, operation, metric string) (value uint64, err error) {
+	key := clanForgeMetricsKey + operation + "-" + metric
+
+	data, err := cache.Get(ctx, key)
+
+	if err == errCacheMiss {
+		return 0, nil
+	} else if err != nil {
+		return
+	}
+
+	value, err = strconv.ParseUint(string(data), 10, 64)
+
 	if err != nil {
 		return
 	}
 
+	_, err = cache.Increment(ctx, key, -int64(value), 0)
+
 	return
 }
@@ -2,20 +2,24 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"time"
+)
 
-	"google.golang.org/appengine/log"
-	"google.golang.org/appengine/urlfetch"
+const (
+	steamAPIURL        = "https://partner.steam-api.com/ISteamUserAuth/AuthenticateUserTicket/v1/"
+	steamPlayerBansURL = "https://partner.steam-api.com/ISteamUser/GetPlayerBans/v1/"
 )
 
 const (
-	steamAPIURL     = "https://partner.steam-api.com/ISteamUserAuth/AuthenticateUserTicket/v1/"
-	appIDPath       = "steam-appid.key"
-	steamAPIKeyPath = "steam-api.key"
+	steamAuthCacheKey      = "SteamAuth-"
+	steamAuthGenerationKey = "SteamAuth-Gen-"
 )
 
 type steamAuthMessage struct {
@@ -40,12 +44,22 @@ type steamAuthError struct {
 	ErrorDesc string `json:"errordesc"`
 }
 
-var appID = getStringFromFile(appIDPath)
-var steamAPIKey = getStringFromFile(steamAPIKeyPath)
+type steamPlayerBansMessage struct {
+	Players []steamPlayerBans `json:"players"`
+}
 
-func steamAuth(ctx context.Context, authToken string) (authenticated bool, steamID string, err error) {
+type steamPlayerBans struct {
+	SteamID          string `json:"SteamId"`
+	CommunityBanned  bool   `json:"CommunityBanned"`
+	VACBanned        bool   `json:"VACBanned"`
+	NumberOfVACBans  int    `json:"NumberOfVACBans"`
+	DaysSinceLastBan int    `json:"DaysSinceLastBan"`
+	NumberOfGameBans int    `json:"NumberOfGameBans"`
+	EconomyBan       string `json:"EconomyBan"`
+}
+
+func steamAuth(ctx context.Context, authToken string) (authenticated bool, params steamAuthParams, err error) {
 	authenticated = false
-	steamID = ""
 	err = nil
 
 	url, err := url.Parse(steamAPIURL)
@@ -56,13 +70,13 @@ func steamAuth(ctx context.Context, authToken string) (authenticated bool, steam
 
 	queryParams := url.Query()
 
-	queryParams.Add("key", steamAPIKey)
-	queryParams.Add("appid", appID)
+	queryParams.Add("key", config.Steam.APIKey)
+	queryParams.Add("appid", config.Steam.AppID)
 	queryParams.Add("ticket", authToken)
 
 	encodedQueryParams := queryParams.Encode()
 
-	client := urlfetch.Client(ctx)
+	client := httpClient(ctx)
 
 	fullURL := fmt.Sprintf("%v?%v", steamAPIURL, encodedQueryParams)
 	req, err := http.NewRequest("GET", fullURL, nil)
@@ -71,7 +85,7 @@ func steamAuth(ctx context.Context, authToken string) (authenticated bool, steam
 		return
 	}
 
-	log.Infof(ctx, "[STEAM-AUTH] Sending Request (%v)...", appID)
+	log.Infof(ctx, "[STEAM-AUTH] Sending Request (%v)...", config.Steam.AppID)
 
 	resp, err := client.Do(req)
 
@@ -107,9 +121,171 @@ func steamAuth(ctx context.Context, authToken string) (authenticated bool, steam
 		log.Errorf(ctx, "[STEAM-AUTH] ERR: %v", message.Response.Error.ErrorDesc)
 		authenticated = false
 	} else {
-		steamID = message.Response.Params.SteamID
+		params = message.Response.Params
 		authenticated = true
 	}
 
 	return
 }
+
+// getSteamPlayerBans looks up the VAC and game ban status of a Steam account
+func getSteamPlayerBans(ctx context.Context, steamID string) (bans steamPlayerBans, err error) {
+	queryParams := url.Values{}
+
+	queryParams.Add("key", config.Steam.APIKey)
+	queryParams.Add("steamids", steamID)
+
+	resp, err := httpClient(ctx).Get(fmt.Sprintf("%v?%v", steamPlayerBansURL, queryParams.Encode()))
+
+	if err != nil {
+		log.Errorf(ctx, "[STEAM-BANS] Request Failed to Execute.")
+		return
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		err = fmt.Errorf("player bans request failed: status %v", resp.StatusCode)
+		return
+	}
+
+	responseBody, err := ioutil.ReadAll(resp.Body)
+
+	if err != nil {
+		return
+	}
+
+	message := new(steamPlayerBansMessage)
+	err = json.Unmarshal(responseBody, &message)
+
+	if err != nil {
+		return
+	}
+
+	for _, player := range message.Players {
+		if player.SteamID == steamID {
+			bans = player
+			return
+		}
+	}
+
+	err = fmt.Errorf("no ban status returned for %v", steamID)
+	return
+}
+
+// steamAuthCacheEntry is a verified ticket's identity, valid while the ban generations of its
+// accounts are unchanged
+type steamAuthCacheEntry struct {
+	Identity    authIdentity
+	Generations []uint64
+}
+
+// getCachedSteamAuth returns the identity a ticket was recently verified as, unless a ban has since
+// been applied to the account or its owner
+func getCachedSteamAuth(ctx context.Context, authToken string) (identity authIdentity, cached bool) {
+	if config.Steam.AuthCacheSeconds == 0 {
+		return
+	}
+
+	data, err := cache.Get(ctx, steamAuthCacheKey+steamTicketHash(authToken))
+
+	if err == errCacheMiss {
+		return
+	} else if err != nil {
+		log.Errorf(ctx, "[STEAM-AUTH] %v", err.Error())
+		return
+	}
+
+	var entry steamAuthCacheEntry
+
+	err = json.Unmarshal(data, &entry)
+
+	if err != nil {
+		log.Errorf(ctx, "[STEAM-AUTH] %v", err.Error())
+		return
+	}
+
+	generations, err := steamAuthGenerations(ctx, entry.Identity)
+
+	if err != nil {
+		log.Errorf(ctx, "[STEAM-AUTH] %v", err.Error())
+		return
+	}
+
+	if len(generations) != len(entry.Generations) {
+		return
+	}
+
+	for i := range generations {
+		if generations[i] != entry.Generations[i] {
+			return
+		}
+	}
+
+	log.Debugf(ctx, "[STEAM-AUTH] Using cached result for %v", entry.Identity.UserID)
+
+	return entry.Identity, true
+}
+
+// cacheSteamAuth keeps a verified ticket's identity for steam.auth_cache_seconds. Tickets are
+// cached by hash so the cache never holds a usable ticket.
+func cacheSteamAuth(ctx context.Context, authToken string, identity authIdentity) {
+	if config.Steam.AuthCacheSeconds == 0 {
+		return
+	}
+
+	generations, err := steamAuthGenerations(ctx, identity)
+
+	if err != nil {
+		log.Errorf(ctx, "[STEAM-AUTH] %v", err.Error())
+		return
+	}
+
+	data, err := json.Marshal(steamAuthCacheEntry{Identity: identity, Generations: generations})
+
+	if err != nil {
+		log.Errorf(ctx, "[STEAM-AUTH] %v", err.Error())
+		return
+	}
+
+	err = cache.Set(ctx, steamAuthCacheKey+steamTicketHash(authToken), data, time.Second*time.Duration(config.Steam.AuthCacheSeconds))
+
+	if err != nil {
+		log.Errorf(ctx, "[STEAM-AUTH] %v", err.Error())
+	}
+}
+
+// invalidateSteamAuth drops the cached results of every ticket for the account, or borrowed from it
+func invalidateSteamAuth(ctx context.Context, steamID string) error {
+	_, err := cache.Increment(ctx, steamAuthGenerationKey+steamID, 1, uint64(time.Now().UnixNano()))
+
+	return err
+}
+
+// steamAuthGenerations reads the ban generation of the identity's account and owner. A generation
+// missing from the cache restarts at the current time, so eviction also invalidates results.
+func steamAuthGenerations(ctx context.Context, identity authIdentity) (generations []uint64, err error) {
+	steamIDs := []string{identity.UserID}
+	if identity.OwnerID != "" {
+		steamIDs = append(steamIDs, identity.OwnerID)
+	}
+
+	for _, steamID := range steamIDs {
+		var generation uint64
+		generation, err = cache.Increment(ctx, steamAuthGenerationKey+steamID, 0, uint64(time.Now().UnixNano()))
+
+		if err != nil {
+			return
+		}
+
+		generations = append(generations, generation)
+	}
+
+	return
+}
+
+func steamTicketHash(authToken string) string {
+	hash := sha256.Sum256([]byte(authToken))
+
+	return hex.EncodeToString(hash[:])
+}
@@ -3,28 +3,19 @@ package main
 import (
 	"context"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 
 	"cloud.google.com/go/storage"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/file"
-	"google.golang.org/appengine/log"
 )
 
 const (
 	maxDatastoreRecordsToDelete = 500
 )
 
-func getStringFromFile(path string) string {
-	file, err := ioutil.ReadFile(path)
-
-	if err != nil {
-		return ""
-	}
-
-	return string(file)
-}
-
 func storeCSV(ctx context.Context, fileName string, data []byte) (err error) {
 	err = storeFile(ctx, fileName, "text/csv", data)
 
@@ -34,6 +25,11 @@ func storeCSV(ctx context.Context, fileName string, data []byte) (err error) {
 func storeFile(ctx context.Context, fileName, contentType string, data []byte) (err error) {
 	var bucketName string
 
+	if standalone {
+		err = storeLocalFile(fileName, data)
+		return
+	}
+
 	if appengine.IsDevAppServer() {
 		return
 	}
@@ -71,6 +67,19 @@ func storeFile(ctx context.Context, fileName, contentType string, data []byte) (
 	return
 }
 
+func storeLocalFile(fileName string, data []byte) (err error) {
+	path := filepath.Join(config.Standalone.DataDir, filepath.FromSlash(fileName))
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return
+	}
+
+	err = ioutil.WriteFile(path, data, 0644)
+
+	return
+}
+
 func removeFromDatastore(ctx context.Context, keys []*datastore.Key) (err error) {
 	keyCount := len(keys)
 	remainingKeys := keyCount
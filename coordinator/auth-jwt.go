@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+)
+
+const (
+	jwtClockSkewSeconds = 60
+)
+
+// jwtAuthProvider verifies JWTs (e.g. OIDC ID tokens) against public keys loaded from a local JWKS
+// or PEM file. The sub claim is the user ID.
+type jwtAuthProvider struct {
+	platform string
+	issuer   string
+	audience string
+	keys     []jwtKey
+}
+
+type jwtKey struct {
+	ID  string // kid, empty for PEM keys
+	Key crypto.PublicKey
+}
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+type jwtClaims struct {
+	Issuer    string          `json:"iss"`
+	Subject   string          `json:"sub"`
+	Audience  json.RawMessage `json:"aud"` // A string or an array of strings
+	ExpiresAt float64         `json:"exp"`
+	NotBefore float64         `json:"nbf"`
+}
+
+type jwksFile struct {
+	Keys []jwk `json:"keys"`
+}
+
+type jwk struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid,omitempty"`
+	Use       string `json:"use,omitempty"`
+	Algorithm string `json:"alg,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+}
+
+func newJWTAuthProvider(settings jwtProviderConfig) (*jwtAuthProvider, error) {
+	data, err := ioutil.ReadFile(settings.KeysFile)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := parseJWTKeys(data)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", settings.KeysFile, err)
+	}
+
+	return &jwtAuthProvider{
+		platform: settings.Platform,
+		issuer:   settings.Issuer,
+		audience: settings.Audience,
+		keys:     keys,
+	}, nil
+}
+
+func (p *jwtAuthProvider) Authenticate(ctx context.Context, userID, token string) (identity authIdentity, err error) {
+	claims, err := p.verify(token)
+
+	if err != nil {
+		log.Errorf(ctx, "[JWT-AUTH] %v: %v", p.platform, err.Error())
+		err = errInvalidAuthToken
+		return
+	}
+
+	if userID != "" && userID != claims.Subject {
+		err = errInvalidUserID
+		return
+	}
+
+	identity.UserID = claims.Subject
+	return
+}
+
+// verify checks the token signature and its iss, aud, exp and nbf claims
+func (p *jwtAuthProvider) verify(token string) (claims jwtClaims, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		err = errors.New("malformed token")
+		return
+	}
+
+	var header jwtHeader
+	err = decodeJWTSegment(parts[0], &header)
+	if err != nil {
+		return
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return
+	}
+
+	verified := false
+
+	for _, key := range p.keys {
+		if header.KeyID != "" && key.ID != "" && header.KeyID != key.ID {
+			continue
+		}
+
+		if verifyJWTSignature(header.Algorithm, key.Key, []byte(parts[0]+"."+parts[1]), signature) {
+			verified = true
+			break
+		}
+	}
+
+	if !verified {
+		err = fmt.Errorf("signature not verified (alg %v, kid %v)", header.Algorithm, header.KeyID)
+		return
+	}
+
+	err = decodeJWTSegment(parts[1], &claims)
+	if err != nil {
+		return
+	}
+
+	now := float64(time.Now().Unix())
+
+	if claims.Issuer != p.issuer {
+		err = fmt.Errorf("unexpected issuer %v", claims.Issuer)
+	} else if !jwtAudienceContains(claims.Audience, p.audience) {
+		err = fmt.Errorf("unexpected audience %v", string(claims.Audience))
+	} else if claims.ExpiresAt == 0 || now > claims.ExpiresAt+jwtClockSkewSeconds {
+		err = errors.New("token expired")
+	} else if now < claims.NotBefore-jwtClockSkewSeconds {
+		err = errors.New("token not yet valid")
+	} else if claims.Subject == "" {
+		err = errors.New("token has no subject")
+	}
+
+	return
+}
+
+func decodeJWTSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+func jwtAudienceContains(raw json.RawMessage, audience string) bool {
+	var single string
+	if json.Unmarshal(raw, &single) == nil {
+		return single == audience
+	}
+
+	var multiple []string
+	if json.Unmarshal(raw, &multiple) == nil {
+		for _, aud := range multiple {
+			if aud == audience {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// verifyJWTSignature supports the RS and ES algorithm families, which must match the key type
+func verifyJWTSignature(algorithm string, key crypto.PublicKey, signed, signature []byte) bool {
+	var hash crypto.Hash
+
+	if len(algorithm) != 5 {
+		return false
+	}
+
+	switch algorithm[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return false
+	}
+
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(algorithm, "RS") {
+			return false
+		}
+
+		return rsa.VerifyPKCS1v15(k, hash, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+
+		if !strings.HasPrefix(algorithm, "ES") || len(signature) != 2*size {
+			return false
+		}
+
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+
+		return ecdsa.Verify(k, digest, r, s)
+	}
+
+	return false
+}
+
+// parseJWTKeys reads a JWKS document, or one or more PEM public keys or certificates
+func parseJWTKeys(data []byte) (keys []jwtKey, err error) {
+	data = bytes.TrimSpace(data)
+
+	if bytes.HasPrefix(data, []byte("{")) {
+		var jwks jwksFile
+
+		err = json.Unmarshal(data, &jwks)
+		if err != nil {
+			return
+		}
+
+		for _, k := range jwks.Keys {
+			// Other key types, e.g. OKP, are not supported and skipped
+			if (k.Use != "" && k.Use != "sig") || (k.KeyType != "RSA" && k.KeyType != "EC") {
+				continue
+			}
+
+			var key crypto.PublicKey
+			key, err = k.publicKey()
+			if err != nil {
+				return
+			}
+
+			keys = append(keys, jwtKey{ID: k.KeyID, Key: key})
+		}
+	} else {
+		for {
+			var block *pem.Block
+			block, data = pem.Decode(data)
+			if block == nil {
+				break
+			}
+
+			var key crypto.PublicKey
+
+			switch block.Type {
+			case "PUBLIC KEY":
+				key, err = x509.ParsePKIXPublicKey(block.Bytes)
+			case "RSA PUBLIC KEY":
+				key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+			case "CERTIFICATE":
+				var cert *x509.Certificate
+				cert, err = x509.ParseCertificate(block.Bytes)
+				if err == nil {
+					key = cert.PublicKey
+				}
+			default:
+				continue
+			}
+
+			if err != nil {
+				return
+			}
+
+			keys = append(keys, jwtKey{Key: key})
+		}
+	}
+
+	if len(keys) == 0 {
+		err = errors.New("no public keys found")
+	}
+
+	return
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.KeyType {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+
+		switch k.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("key %v: unsupported curve %v", k.KeyID, k.Curve)
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("key %v: point is not on curve %v", k.KeyID, k.Curve)
+		}
+
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("key %v: unsupported key type %v", k.KeyID, k.KeyType)
+}
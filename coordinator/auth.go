@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+)
+
+const (
+	steamPlatform = "steam"
+	testPlatform  = "test"
+)
+
+var (
+	errUnknownPlatform  = errors.New("unknown platform")
+	errInvalidAuthToken = errors.New("invalid auth token")
+	errInvalidUserID    = errors.New("user ID does not match auth token")
+)
+
+// authIdentity is the user an auth token was issued to
+type authIdentity struct {
+	Platform        string
+	UserID          string // As issued by the platform
+	OwnerID         string // Account that owns the game when borrowed through Steam Family Sharing
+	PublisherBanned bool
+	VACBanned       bool
+	GameBans        int // On a Family Sharing owner's account, see verifySteamTicket
+}
+
+// qualifiedID returns the user ID prefixed with its platform, unique across platforms
+func (id authIdentity) qualifiedID() string {
+	return id.Platform + ":" + id.UserID
+}
+
+// authProvider verifies client auth tokens for one platform. userID is the ID claimed by the client,
+// checked against the token where the platform allows it.
+type authProvider interface {
+	Authenticate(ctx context.Context, userID, token string) (authIdentity, error)
+}
+
+// Providers by platform name, created from the configuration at startup
+var authProviders = map[string]authProvider{}
+
+// newAuthProviders creates a provider for each platform enabled in the configuration
+func newAuthProviders() (map[string]authProvider, error) {
+	providers := make(map[string]authProvider)
+
+	if config.Steam.Enabled {
+		providers[steamPlatform] = steamAuthProvider{}
+	}
+
+	if len(config.Auth.TestTokens) > 0 {
+		providers[testPlatform] = newTestAuthProvider(config.Auth.TestTokens)
+	}
+
+	for _, settings := range config.Auth.JWT {
+		jwtProvider, err := newJWTAuthProvider(settings)
+		if err != nil {
+			return nil, fmt.Errorf("auth.jwt %v: %v", settings.Platform, err)
+		}
+
+		providers[settings.Platform] = jwtProvider
+	}
+
+	return providers, nil
+}
+
+// authenticateUser verifies token with the provider for platform, or the default platform if empty
+func authenticateUser(ctx context.Context, platform, userID, token string) (identity authIdentity, err error) {
+	if platform == "" {
+		platform = config.defaultPlatform()
+	}
+
+	platformProvider, ok := authProviders[platform]
+	if !ok {
+		err = errUnknownPlatform
+		return
+	}
+
+	identity, err = platformProvider.Authenticate(ctx, userID, token)
+	identity.Platform = platform
+
+	return
+}
+
+// steamAuthProvider verifies Steam session tickets with the Steam Web API
+type steamAuthProvider struct{}
+
+func (steamAuthProvider) Authenticate(ctx context.Context, userID, token string) (identity authIdentity, err error) {
+	identity, cached := getCachedSteamAuth(ctx, token)
+
+	if !cached {
+		identity, err = verifySteamTicket(ctx, token)
+
+		if err != nil {
+			return
+		}
+
+		cacheSteamAuth(ctx, token, identity)
+	}
+
+	if userID != identity.UserID {
+		identity = authIdentity{}
+		err = errInvalidUserID
+	}
+
+	return
+}
+
+// verifySteamTicket authenticates the session ticket, applying a Family Sharing owner's bans
+func verifySteamTicket(ctx context.Context, token string) (identity authIdentity, err error) {
+	authenticated, params, err := steamAuth(ctx, token)
+
+	if err != nil {
+		return
+	}
+
+	if !authenticated {
+		err = errInvalidAuthToken
+		return
+	}
+
+	identity.UserID = params.SteamID
+	identity.PublisherBanned = params.PublisherBanned
+	identity.VACBanned = params.VacBanned
+
+	// Family Sharing borrowers inherit the owner's bans
+	if params.OwnerSteamID != "" && params.OwnerSteamID != params.SteamID {
+		identity.OwnerID = params.OwnerSteamID
+
+		if config.Steam.ApplyOwnerBans {
+			var ownerBans steamPlayerBans
+			ownerBans, err = getSteamPlayerBans(ctx, params.OwnerSteamID)
+
+			if err != nil {
+				return
+			}
+
+			identity.VACBanned = identity.VACBanned || ownerBans.VACBanned
+			identity.GameBans = ownerBans.NumberOfGameBans
+		}
+	}
+
+	return
+}
+
+// testAuthProvider accepts a fixed token per developer, for testing without a storefront. The
+// client's user ID is scoped to the developer so one token can run several clients.
+type testAuthProvider struct {
+	developers map[string]string // By token
+}
+
+func newTestAuthProvider(tokens map[string]string) testAuthProvider {
+	developers := make(map[string]string)
+
+	for developer, token := range tokens {
+		developers[token] = developer
+	}
+
+	return testAuthProvider{developers: developers}
+}
+
+func (p testAuthProvider) Authenticate(ctx context.Context, userID, token string) (identity authIdentity, err error) {
+	for developerToken, developer := range p.developers {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(developerToken)) != 1 {
+			continue
+		}
+
+		identity.UserID = developer
+		if userID != "" {
+			identity.UserID += "/" + userID
+		}
+
+		return
+	}
+
+	err = errInvalidAuthToken
+	return
+}
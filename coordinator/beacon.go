@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	beaconMagic         = "PING" // Packets not starting with this are ignored, so the beacon can't be used to reflect traffic
+	beaconMaxPacketSize = 64
+)
+
+var errInvalidLatencies = errors.New("invalid latencies")
+
+// regionLatency is a client's measured round trip time to a region's beacon
+type regionLatency struct {
+	Region    string
+	LatencyMS int
+}
+
+// runBeacon echoes UDP packets starting with beaconMagic back to their sender, so clients can measure
+// their round trip time to the region it runs in. It returns when ctx is cancelled.
+func runBeacon(ctx context.Context, address string) error {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	log.Infof(ctx, "[Beacon] Listening on %v", conn.LocalAddr())
+
+	packet := make([]byte, beaconMaxPacketSize)
+
+	for {
+		n, addr, err := conn.ReadFrom(packet)
+
+		if ctx.Err() != nil {
+			return nil
+		} else if err != nil {
+			log.Errorf(ctx, "[Beacon] %v", err.Error())
+			continue
+		}
+
+		if !bytes.HasPrefix(packet[:n], []byte(beaconMagic)) {
+			continue
+		}
+
+		_, err = conn.WriteTo(packet[:n], addr)
+		if err != nil {
+			log.Errorf(ctx, "[Beacon] %v", err.Error())
+		}
+	}
+}
+
+// parseLatencies reads the Latencies enqueue parameter, comma separated region:milliseconds pairs
+// such as "na:35,eu:120". Unknown regions are ignored.
+func parseLatencies(value string) (latencies []regionLatency, err error) {
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.Split(strings.TrimSpace(pair), ":")
+
+		if len(parts) != 2 {
+			return nil, errInvalidLatencies
+		}
+
+		latency, err := strconv.Atoi(parts[1])
+		if err != nil || latency < 0 {
+			return nil, errInvalidLatencies
+		}
+
+		if _, ok := findRegion(parts[0]); ok {
+			latencies = append(latencies, regionLatency{Region: parts[0], LatencyMS: latency})
+		}
+	}
+
+	return latencies, nil
+}
+
+// latencyPermits reports whether a player who sent the Latencies enqueue parameter may be placed in
+// region. Players who measured nothing may be placed anywhere.
+func latencyPermits(latenciesParam, region string) bool {
+	if latenciesParam == "" {
+		return true
+	}
+
+	latencies, err := parseLatencies(latenciesParam)
+	if err != nil {
+		return false
+	}
+
+	for _, latency := range rankRegions(latencies) {
+		if latency.Region == region {
+			return true
+		}
+	}
+
+	return false
+}
+
+// rankRegions orders the measured regions by latency, leaving out VAC pools and those over
+// matchmaking.max_latency_ms
+func rankRegions(latencies []regionLatency) (ranked []regionLatency) {
+	for _, latency := range latencies {
+		if region, _ := findRegion(latency.Region); region.VACPool {
+			continue
+		}
+
+		if config.Matchmaking.MaxLatencyMS == 0 || latency.LatencyMS <= config.Matchmaking.MaxLatencyMS {
+			ranked = append(ranked, latency)
+		}
+	}
+
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return ranked[i].LatencyMS < ranked[j].LatencyMS
+	})
+
+	return
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/appengine/memcache"
+)
+
+var errCacheMiss = errors.New("cache miss")
+
+// cacheStore is a shared key/value cache with memcache semantics
+type cacheStore interface {
+	Get(ctx context.Context, key string) ([]byte, error)
+	Set(ctx context.Context, key string, value []byte, expiration time.Duration) error
+	Delete(ctx context.Context, key string) error
+	Increment(ctx context.Context, key string, delta int64, initialValue uint64) (uint64, error)
+}
+
+var cache cacheStore = memcacheStore{}
+
+type memcacheStore struct{}
+
+func (memcacheStore) Get(ctx context.Context, key string) ([]byte, error) {
+	item, err := memcache.Get(ctx, key)
+
+	if err == memcache.ErrCacheMiss {
+		return nil, errCacheMiss
+	} else if err != nil {
+		return nil, err
+	}
+
+	return item.Value, nil
+}
+
+func (memcacheStore) Set(ctx context.Context, key string, value []byte, expiration time.Duration) error {
+	return memcache.Set(ctx, &memcache.Item{Key: key, Value: value, Expiration: expiration})
+}
+
+func (memcacheStore) Delete(ctx context.Context, key string) error {
+	err := memcache.Delete(ctx, key)
+
+	if err == memcache.ErrCacheMiss {
+		return nil
+	}
+
+	return err
+}
+
+func (memcacheStore) Increment(ctx context.Context, key string, delta int64, initialValue uint64) (uint64, error) {
+	return memcache.Increment(ctx, key, delta, initialValue)
+}
+
+type memoryCacheItem struct {
+	value   []byte
+	expires time.Time
+}
+
+// memoryCacheStore is a process local cacheStore used when running standalone
+type memoryCacheStore struct {
+	mu    sync.Mutex
+	items map[string]memoryCacheItem
+}
+
+func newMemoryCacheStore() *memoryCacheStore {
+	return &memoryCacheStore{items: make(map[string]memoryCacheItem)}
+}
+
+func (c *memoryCacheStore) get(key string) (memoryCacheItem, bool) {
+	item, ok := c.items[key]
+
+	if ok && !item.expires.IsZero() && time.Now().After(item.expires) {
+		delete(c.items, key)
+		return item, false
+	}
+
+	return item, ok
+}
+
+func (c *memoryCacheStore) Get(ctx context.Context, key string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	item, ok := c.get(key)
+	if !ok {
+		return nil, errCacheMiss
+	}
+
+	return item.value, nil
+}
+
+func (c *memoryCacheStore) Set(ctx context.Context, key string, value []byte, expiration time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	item := memoryCacheItem{value: value}
+	if expiration > 0 {
+		item.expires = time.Now().Add(expiration)
+	}
+
+	c.items[key] = item
+
+	return nil
+}
+
+func (c *memoryCacheStore) Delete(ctx context.Context, key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.items, key)
+
+	return nil
+}
+
+func (c *memoryCacheStore) Increment(ctx context.Context, key string, delta int64, initialValue uint64) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	value := initialValue
+
+	item, ok := c.get(key)
+	if ok {
+		parsed, err := strconv.ParseUint(string(item.value), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		value = parsed
+	}
+
+	if delta < 0 && uint64(-delta) > value { // Decrements floor at zero, as with memcache
+		value = 0
+	} else {
+		value = uint64(int64(value) + delta)
+	}
+
+	item.value = []byte(strconv.FormatUint(value, 10))
+	c.items[key] = item
+
+	return value, nil
+}
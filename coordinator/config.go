@@ -0,0 +1,797 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"google.golang.org/appengine"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	matchmakingModeFill   = "fill"
+	matchmakingModeRating = "rating"
+)
+
+const (
+	banPolicyAllow    = "allow"
+	banPolicyReject   = "reject"
+	banPolicySeparate = "separate"
+)
+
+const (
+	defaultModeName = "default" // The only mode when none are configured
+)
+
+const (
+	standaloneStoreFile   = "file"
+	standaloneStoreMemory = "memory"
+)
+
+const (
+	defaultConfigPath      = "coordinator.yaml"
+	configPathEnv          = "COORDINATOR_CONFIG"
+	minSessionSecretLength = 32
+)
+
+// coordinatorConfig holds all deployment settings. Values are read from a YAML or JSON file and
+// may be overridden by the environment variable named in each field's env tag.
+type coordinatorConfig struct {
+	Regions     []regionConfig    `json:"regions" yaml:"regions" env:"COORDINATOR_REGIONS"` // JSON array in the environment
+	Modes       []modeConfig      `json:"modes" yaml:"modes" env:"COORDINATOR_MODES"`       // JSON array in the environment
+	ClanForge   clanForgeConfig   `json:"clanforge" yaml:"clanforge"`
+	Steam       steamConfig       `json:"steam" yaml:"steam"`
+	Auth        authConfig        `json:"auth" yaml:"auth"`
+	Matchmaking matchmakingConfig `json:"matchmaking" yaml:"matchmaking"`
+	RateLimits  rateLimitsConfig  `json:"rate_limits" yaml:"rate_limits"`
+	Servers     serversConfig     `json:"servers" yaml:"servers"`
+	Standalone  standaloneConfig  `json:"standalone" yaml:"standalone"`
+}
+
+type clanForgeConfig struct {
+	AccessKey string `json:"access_key" yaml:"access_key" env:"COORDINATOR_CLANFORGE_ACCESS_KEY"`
+	SecretKey string `json:"secret_key" yaml:"secret_key" env:"COORDINATOR_CLANFORGE_SECRET_KEY"`
+	ProfileID string `json:"profile_id" yaml:"profile_id" env:"COORDINATOR_CLANFORGE_PROFILE_ID"`
+}
+
+// regionConfig defines a matchmaking region. Unset limits take the values in serversConfig.
+type regionConfig struct {
+	Name                       string                 `json:"name" yaml:"name"`
+	ClanForgeRegionID          string                 `json:"clanforge_region_id" yaml:"clanforge_region_id"`
+	MaxServers                 int                    `json:"max_servers" yaml:"max_servers"`
+	AllocateNewServerThreshold float64                `json:"allocate_new_server_threshold" yaml:"allocate_new_server_threshold"`
+	VACBannedRegion            string                 `json:"vac_banned_region" yaml:"vac_banned_region"` // Where VAC banned players are sent with the separate policy
+	VACPool                    bool                   `json:"vac_pool" yaml:"vac_pool"`                   // Only holds players sent by vac_banned_region, hidden from everyone else
+	Beacon                     string                 `json:"beacon" yaml:"beacon"`                       // host:port of the region's UDP ping beacon, published by /regions
+	Fallbacks                  []regionFallbackConfig `json:"fallbacks" yaml:"fallbacks"`
+}
+
+// regionFallbackConfig lets tickets without a server in their region spill into another region
+// once they have waited after_seconds
+type regionFallbackConfig struct {
+	Region       string `json:"region" yaml:"region"`
+	AfterSeconds int    `json:"after_seconds" yaml:"after_seconds"`
+}
+
+// modeConfig defines a game mode, queued for and served separately in every region. Unset values
+// take those in clanForgeConfig and serversConfig, and unset limits the region's.
+type modeConfig struct {
+	Name                       string  `json:"name" yaml:"name"`
+	ClanForgeProfileID         string  `json:"clanforge_profile_id" yaml:"clanforge_profile_id"`
+	MaxPlayers                 int     `json:"max_players" yaml:"max_players"`
+	FullThreshold              float64 `json:"full_threshold" yaml:"full_threshold"` // Fill at which a server counts as full
+	AllocateNewServerThreshold float64 `json:"allocate_new_server_threshold" yaml:"allocate_new_server_threshold"`
+	MinServers                 int     `json:"min_servers" yaml:"min_servers"` // Allocated servers kept in each region
+	MaxServers                 int     `json:"max_servers" yaml:"max_servers"` // Allocated servers allowed in each region
+}
+
+type steamConfig struct {
+	Enabled             bool   `json:"enabled" yaml:"enabled" env:"COORDINATOR_STEAM_ENABLED"`
+	AppID               string `json:"app_id" yaml:"app_id" env:"COORDINATOR_STEAM_APP_ID"`
+	APIKey              string `json:"api_key" yaml:"api_key" env:"COORDINATOR_STEAM_API_KEY"`
+	PublisherBanPolicy  string `json:"publisher_ban_policy" yaml:"publisher_ban_policy" env:"COORDINATOR_STEAM_PUBLISHER_BAN_POLICY"`       // reject or allow
+	VACBanPolicy        string `json:"vac_ban_policy" yaml:"vac_ban_policy" env:"COORDINATOR_STEAM_VAC_BAN_POLICY"`                         // allow, reject or separate
+	ApplyOwnerBans      bool   `json:"apply_owner_bans" yaml:"apply_owner_bans" env:"COORDINATOR_STEAM_APPLY_OWNER_BANS"`                   // Apply a Family Sharing owner's VAC and game bans to the borrower
+	RejectOwnerGameBans bool   `json:"reject_owner_game_bans" yaml:"reject_owner_game_bans" env:"COORDINATOR_STEAM_REJECT_OWNER_GAME_BANS"` // Reject borrowers whose owner has game bans, with apply_owner_bans
+	AuthCacheSeconds    int    `json:"auth_cache_seconds" yaml:"auth_cache_seconds" env:"COORDINATOR_STEAM_AUTH_CACHE_SECONDS"`             // How long a verified ticket is reused, 0 to verify every time
+}
+
+type authConfig struct {
+	DefaultPlatform   string              `json:"default_platform" yaml:"default_platform" env:"COORDINATOR_AUTH_DEFAULT_PLATFORM"` // Used when a request has no Platform
+	TestTokens        map[string]string   `json:"test_tokens" yaml:"test_tokens" env:"COORDINATOR_AUTH_TEST_TOKENS"`                // Developer name to token, JSON object in the environment
+	JWT               []jwtProviderConfig `json:"jwt" yaml:"jwt" env:"COORDINATOR_AUTH_JWT"`                                        // JSON array in the environment
+	SessionKeys       []sessionKeyConfig  `json:"session_keys" yaml:"session_keys" env:"COORDINATOR_AUTH_SESSION_KEYS"`             // The first signs new tokens, JSON array in the environment
+	SessionTTLMinutes int                 `json:"session_ttl_minutes" yaml:"session_ttl_minutes" env:"COORDINATOR_AUTH_SESSION_TTL_MINUTES"`
+}
+
+// sessionKeyConfig is a key for signing session tokens. Keep retired keys listed after the
+// new first key until tokens signed with them have expired.
+type sessionKeyConfig struct {
+	ID     string `json:"id" yaml:"id"`
+	Secret string `json:"secret" yaml:"secret"`
+}
+
+type jwtProviderConfig struct {
+	Platform string `json:"platform" yaml:"platform"`
+	Issuer   string `json:"issuer" yaml:"issuer"`
+	Audience string `json:"audience" yaml:"audience"`
+	KeysFile string `json:"keys_file" yaml:"keys_file"` // JWKS or PEM public keys
+}
+
+type matchmakingConfig struct {
+	JoinDelaySeconds    int                  `json:"join_delay_seconds" yaml:"join_delay_seconds" env:"COORDINATOR_JOIN_DELAY_SECONDS"`
+	JoinTokenTTLMinutes int                  `json:"join_token_ttl_minutes" yaml:"join_token_ttl_minutes" env:"COORDINATOR_JOIN_TOKEN_TTL_MINUTES"`
+	JoinTokenKeys       []joinTokenKeyConfig `json:"join_token_keys" yaml:"join_token_keys" env:"COORDINATOR_JOIN_TOKEN_KEYS"` // The first signs new tokens, JSON array in the environment
+	MaxPartySize        int                  `json:"max_party_size" yaml:"max_party_size" env:"COORDINATOR_MAX_PARTY_SIZE"`
+	Mode                string               `json:"mode" yaml:"mode" env:"COORDINATOR_MATCHMAKING_MODE"` // fill or rating
+	Rating              ratingConfig         `json:"rating" yaml:"rating"`
+	MaxLatencyMS        int                  `json:"max_latency_ms" yaml:"max_latency_ms" env:"COORDINATOR_MAX_LATENCY_MS"` // Regions measured slower are not chosen from Latencies, 0 for no limit
+}
+
+// ratingConfig tunes rating mode. A ticket accepts servers whose average rating is within
+// initial_window of its own, widening by widen_per_second while it waits, up to max_window.
+type ratingConfig struct {
+	InitialWindow  float64 `json:"initial_window" yaml:"initial_window" env:"COORDINATOR_RATING_INITIAL_WINDOW"`
+	WidenPerSecond float64 `json:"widen_per_second" yaml:"widen_per_second" env:"COORDINATOR_RATING_WIDEN_PER_SECOND"`
+	MaxWindow      float64 `json:"max_window" yaml:"max_window" env:"COORDINATOR_RATING_MAX_WINDOW"`
+	Tau            float64 `json:"tau" yaml:"tau" env:"COORDINATOR_RATING_TAU"` // Glicko-2 system constant, 0.3 to 1.2
+}
+
+// joinTokenKeyConfig is an ECDSA P-256 private key (PEM) signing join tokens. Keep retired keys listed
+// after the new first key until servers have picked up the new key.
+type joinTokenKeyConfig struct {
+	ID             string `json:"id" yaml:"id"`
+	PrivateKeyFile string `json:"private_key_file" yaml:"private_key_file"`
+}
+
+// rateLimitsConfig limits client requests per user and per IP address
+type rateLimitsConfig struct {
+	Enabled bool                    `json:"enabled" yaml:"enabled" env:"COORDINATOR_RATE_LIMITS_ENABLED"`
+	Enqueue endpointRateLimitConfig `json:"enqueue" yaml:"enqueue"`
+	Poll    endpointRateLimitConfig `json:"poll" yaml:"poll"`
+	Dequeue endpointRateLimitConfig `json:"dequeue" yaml:"dequeue"`
+}
+
+type endpointRateLimitConfig struct {
+	PerUser rateLimitConfig `json:"per_user" yaml:"per_user"`
+	PerIP   rateLimitConfig `json:"per_ip" yaml:"per_ip"`
+}
+
+// rateLimitConfig is a token bucket. A zero rate disables the limit.
+type rateLimitConfig struct {
+	RequestsPerMinute float64 `json:"requests_per_minute" yaml:"requests_per_minute"`
+	Burst             int     `json:"burst" yaml:"burst"`
+}
+
+type serversConfig struct {
+	Provider                   string              `json:"provider" yaml:"provider" env:"COORDINATOR_SERVER_PROVIDER"` // clanforge, fake or process, defaults to fake on the dev server
+	MaxServersPerRegion        int                 `json:"max_servers_per_region" yaml:"max_servers_per_region" env:"COORDINATOR_MAX_SERVERS_PER_REGION"`
+	AllocateNewServerThreshold float64             `json:"allocate_new_server_threshold" yaml:"allocate_new_server_threshold" env:"COORDINATOR_ALLOCATE_NEW_SERVER_THRESHOLD"`
+	DefaultMaxPlayers          int                 `json:"default_max_players" yaml:"default_max_players" env:"COORDINATOR_DEFAULT_MAX_PLAYERS"`
+	RegistrationSecret         string              `json:"registration_secret" yaml:"registration_secret" env:"COORDINATOR_REGISTRATION_SECRET"`
+	Fake                       fakeProviderConfig  `json:"fake" yaml:"fake"`
+	Process                    processServerConfig `json:"process" yaml:"process"`
+}
+
+type fakeProviderConfig struct {
+	Address           string `json:"address" yaml:"address" env:"COORDINATOR_FAKE_SERVER_ADDRESS"`
+	Port              int    `json:"port" yaml:"port" env:"COORDINATOR_FAKE_SERVER_PORT"`
+	ReadyDelaySeconds int    `json:"ready_delay_seconds" yaml:"ready_delay_seconds" env:"COORDINATOR_FAKE_SERVER_READY_DELAY_SECONDS"`
+}
+
+type processServerConfig struct {
+	Path string `json:"path" yaml:"path" env:"COORDINATOR_PROCESS_SERVER_PATH"`
+	Args string `json:"args" yaml:"args" env:"COORDINATOR_PROCESS_SERVER_ARGS"` // {uuid}, {region}, {mode} and {port} are substituted
+}
+
+type standaloneConfig struct {
+	Address    string `json:"address" yaml:"address" env:"COORDINATOR_ADDRESS"`
+	DataDir    string `json:"data_dir" yaml:"data_dir" env:"COORDINATOR_DATA_DIR"`
+	Queues     string `json:"queues" yaml:"queues" env:"COORDINATOR_QUEUES"`
+	AdminToken string `json:"admin_token" yaml:"admin_token" env:"COORDINATOR_ADMIN_TOKEN"`
+	Beacon     string `json:"beacon" yaml:"beacon" env:"COORDINATOR_BEACON"` // UDP address to run a ping beacon on, e.g. ":7780"
+	Store      string `json:"store" yaml:"store" env:"COORDINATOR_STORE"`    // file keeps records in data_dir, memory loses them on restart
+}
+
+func defaultConfig() coordinatorConfig {
+	return coordinatorConfig{
+		Regions: []regionConfig{
+			{Name: "na"},
+			{Name: "eu"},
+		},
+		Modes: []modeConfig{
+			{Name: defaultModeName},
+		},
+		Steam: steamConfig{
+			Enabled:             true,
+			PublisherBanPolicy:  banPolicyReject,
+			VACBanPolicy:        banPolicyAllow,
+			ApplyOwnerBans:      true,
+			RejectOwnerGameBans: true,
+			AuthCacheSeconds:    120,
+		},
+		Auth: authConfig{
+			SessionTTLMinutes: 60,
+		},
+		Matchmaking: matchmakingConfig{
+			JoinDelaySeconds:    1,
+			JoinTokenTTLMinutes: 5,
+			MaxPartySize:        4,
+			Mode:                matchmakingModeFill,
+			Rating: ratingConfig{
+				InitialWindow:  100,
+				WidenPerSecond: 10,
+				MaxWindow:      600,
+				Tau:            0.5,
+			},
+			MaxLatencyMS: 150,
+		},
+		RateLimits: rateLimitsConfig{
+			Enabled: true,
+			Enqueue: endpointRateLimitConfig{
+				PerUser: rateLimitConfig{RequestsPerMinute: 6, Burst: 3},
+				PerIP:   rateLimitConfig{RequestsPerMinute: 60, Burst: 20},
+			},
+			Poll: endpointRateLimitConfig{
+				PerUser: rateLimitConfig{RequestsPerMinute: 60, Burst: 10},
+				PerIP:   rateLimitConfig{RequestsPerMinute: 600, Burst: 100},
+			},
+			Dequeue: endpointRateLimitConfig{
+				PerUser: rateLimitConfig{RequestsPerMinute: 10, Burst: 5},
+				PerIP:   rateLimitConfig{RequestsPerMinute: 120, Burst: 30},
+			},
+		},
+		Servers: serversConfig{
+			MaxServersPerRegion:        10,
+			AllocateNewServerThreshold: 0.75,
+			DefaultMaxPlayers:          64,
+			Fake: fakeProviderConfig{
+				Address: "127.0.0.1",
+				Port:    7777,
+			},
+			Process: processServerConfig{
+				Args: "-port {port}",
+			},
+		},
+		Standalone: standaloneConfig{
+			Address: ":8080",
+			DataDir: "data",
+			Queues:  "queue.yaml",
+			Store:   standaloneStoreFile,
+		},
+	}
+}
+
+var config = defaultConfig()
+
+// configErrors lists every problem found in the configuration
+type configErrors []string
+
+func (e configErrors) Error() string {
+	return "invalid configuration:\n  " + strings.Join(e, "\n  ")
+}
+
+// loadConfig reads the configuration file at path, applies environment overrides and validates the
+// result. A missing file is only an error if the path was given explicitly.
+func loadConfig(path string) error {
+	loaded := defaultConfig()
+	var problems configErrors
+
+	explicit := path != ""
+	if !explicit {
+		path = os.Getenv(configPathEnv)
+		explicit = path != ""
+	}
+	if !explicit {
+		path = defaultConfigPath
+	}
+
+	data, err := ioutil.ReadFile(path)
+
+	if err == nil {
+		if ext := strings.ToLower(filepath.Ext(path)); ext == ".yaml" || ext == ".yml" {
+			err = yaml.UnmarshalStrict(data, &loaded)
+		} else {
+			decoder := json.NewDecoder(bytes.NewReader(data))
+			decoder.DisallowUnknownFields()
+			err = decoder.Decode(&loaded)
+		}
+
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%v: %v", path, err))
+		}
+	} else if explicit || !os.IsNotExist(err) {
+		problems = append(problems, err.Error())
+	}
+
+	problems = append(problems, applyEnvOverrides(reflect.ValueOf(&loaded).Elem())...)
+	loaded.applyRegionDefaults()
+	loaded.applyModeDefaults()
+	problems = append(problems, loaded.validate()...)
+
+	if len(problems) > 0 {
+		return problems
+	}
+
+	config = loaded
+	return nil
+}
+
+// applyEnvOverrides sets each field with an env tag from its environment variable, if set
+func applyEnvOverrides(v reflect.Value) (problems configErrors) {
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		field := v.Field(i)
+
+		if field.Kind() == reflect.Struct {
+			problems = append(problems, applyEnvOverrides(field)...)
+			continue
+		}
+
+		name := t.Field(i).Tag.Get("env")
+		value, ok := os.LookupEnv(name)
+
+		if name == "" || !ok {
+			continue
+		}
+
+		var err error
+
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Int:
+			var parsed int64
+			parsed, err = strconv.ParseInt(value, 10, 64)
+			field.SetInt(parsed)
+		case reflect.Float64:
+			var parsed float64
+			parsed, err = strconv.ParseFloat(value, 64)
+			field.SetFloat(parsed)
+		case reflect.Bool:
+			var parsed bool
+			parsed, err = strconv.ParseBool(value)
+			field.SetBool(parsed)
+		case reflect.Slice, reflect.Map:
+			err = json.Unmarshal([]byte(value), field.Addr().Interface())
+		}
+
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%v: %v", name, err))
+		}
+	}
+
+	return
+}
+
+func (c *coordinatorConfig) validate() (problems configErrors) {
+	require := func(value, name string) {
+		if strings.TrimSpace(value) == "" {
+			problems = append(problems, name+" is required")
+		}
+	}
+
+	if c.Steam.Enabled {
+		require(c.Steam.AppID, "steam.app_id")
+		require(c.Steam.APIKey, "steam.api_key")
+	}
+
+	if c.Steam.PublisherBanPolicy != banPolicyReject && c.Steam.PublisherBanPolicy != banPolicyAllow {
+		problems = append(problems, fmt.Sprintf("steam.publisher_ban_policy %q is not one of reject, allow", c.Steam.PublisherBanPolicy))
+	}
+
+	if c.Steam.VACBanPolicy != banPolicyAllow && c.Steam.VACBanPolicy != banPolicyReject && c.Steam.VACBanPolicy != banPolicySeparate {
+		problems = append(problems, fmt.Sprintf("steam.vac_ban_policy %q is not one of allow, reject, separate", c.Steam.VACBanPolicy))
+	}
+
+	if c.Steam.AuthCacheSeconds < 0 {
+		problems = append(problems, "steam.auth_cache_seconds must not be negative")
+	}
+
+	problems = append(problems, c.validateAuth()...)
+
+	if c.Standalone.Store != standaloneStoreFile && c.Standalone.Store != standaloneStoreMemory {
+		problems = append(problems, fmt.Sprintf("standalone.store %q is not one of file, memory", c.Standalone.Store))
+	}
+
+	switch c.serverProvider() {
+	case "clanforge":
+		require(c.ClanForge.AccessKey, "clanforge.access_key")
+		require(c.ClanForge.SecretKey, "clanforge.secret_key")
+
+		for i, region := range c.Regions {
+			require(region.ClanForgeRegionID, fmt.Sprintf("regions[%v].clanforge_region_id", i))
+		}
+
+		for i, mode := range c.Modes {
+			require(mode.ClanForgeProfileID, fmt.Sprintf("modes[%v].clanforge_profile_id or clanforge.profile_id", i))
+		}
+	case "fake":
+	case "process":
+		require(c.Servers.Process.Path, "servers.process.path")
+	default:
+		problems = append(problems, fmt.Sprintf("servers.provider %q is not one of clanforge, fake, process", c.Servers.Provider))
+	}
+
+	if len(c.Regions) == 0 {
+		problems = append(problems, "at least one region is required")
+	}
+
+	regionNames := make(map[string]bool)
+	vacPools := make(map[string]bool)
+
+	for i, region := range c.Regions {
+		if strings.TrimSpace(region.Name) == "" {
+			problems = append(problems, fmt.Sprintf("regions[%v].name is required", i))
+		} else if regionNames[region.Name] {
+			problems = append(problems, fmt.Sprintf("regions[%v].name %q is used more than once", i, region.Name))
+		}
+
+		regionNames[region.Name] = true
+		vacPools[region.Name] = region.VACPool
+
+		if region.MaxServers <= 0 {
+			problems = append(problems, fmt.Sprintf("regions[%v].max_servers must be positive", i))
+		}
+
+		if region.AllocateNewServerThreshold <= 0 || region.AllocateNewServerThreshold > 1 {
+			problems = append(problems, fmt.Sprintf("regions[%v].allocate_new_server_threshold must be in (0, 1]", i))
+		}
+	}
+
+	for i, region := range c.Regions {
+		if region.VACBannedRegion != "" && !regionNames[region.VACBannedRegion] {
+			problems = append(problems, fmt.Sprintf("regions[%v].vac_banned_region %q is not a configured region", i, region.VACBannedRegion))
+		} else if region.VACBannedRegion != "" && !vacPools[region.VACBannedRegion] {
+			problems = append(problems, fmt.Sprintf("regions[%v].vac_banned_region %q is not a vac_pool region", i, region.VACBannedRegion))
+		} else if region.VACBannedRegion == "" && c.Steam.VACBanPolicy == banPolicySeparate && !region.VACPool {
+			problems = append(problems, fmt.Sprintf("regions[%v].vac_banned_region is required when steam.vac_ban_policy is separate", i))
+		}
+
+		if region.VACPool && len(region.Fallbacks) > 0 {
+			problems = append(problems, fmt.Sprintf("regions[%v].fallbacks are not allowed in a vac_pool region", i))
+		}
+
+		for j, fallback := range region.Fallbacks {
+			if !regionNames[fallback.Region] || fallback.Region == region.Name {
+				problems = append(problems, fmt.Sprintf("regions[%v].fallbacks[%v].region %q is not another configured region", i, j, fallback.Region))
+			} else if vacPools[fallback.Region] {
+				problems = append(problems, fmt.Sprintf("regions[%v].fallbacks[%v].region %q is a vac_pool region", i, j, fallback.Region))
+			}
+
+			if fallback.AfterSeconds < 0 {
+				problems = append(problems, fmt.Sprintf("regions[%v].fallbacks[%v].after_seconds must not be negative", i, j))
+			}
+		}
+	}
+
+	limits := map[string]rateLimitConfig{
+		"enqueue.per_user": c.RateLimits.Enqueue.PerUser,
+		"enqueue.per_ip":   c.RateLimits.Enqueue.PerIP,
+		"poll.per_user":    c.RateLimits.Poll.PerUser,
+		"poll.per_ip":      c.RateLimits.Poll.PerIP,
+		"dequeue.per_user": c.RateLimits.Dequeue.PerUser,
+		"dequeue.per_ip":   c.RateLimits.Dequeue.PerIP,
+	}
+
+	for name, limit := range limits {
+		if limit.RequestsPerMinute < 0 {
+			problems = append(problems, fmt.Sprintf("rate_limits.%v.requests_per_minute must not be negative", name))
+		} else if limit.RequestsPerMinute > 0 && limit.Burst <= 0 {
+			problems = append(problems, fmt.Sprintf("rate_limits.%v.burst must be positive", name))
+		}
+	}
+
+	if c.Matchmaking.JoinDelaySeconds < 0 {
+		problems = append(problems, "matchmaking.join_delay_seconds must not be negative")
+	}
+
+	if c.Matchmaking.JoinTokenTTLMinutes <= 0 {
+		problems = append(problems, "matchmaking.join_token_ttl_minutes must be positive")
+	}
+
+	if c.Matchmaking.MaxPartySize <= 0 {
+		problems = append(problems, "matchmaking.max_party_size must be positive")
+	}
+
+	if c.Matchmaking.Mode != matchmakingModeFill && c.Matchmaking.Mode != matchmakingModeRating {
+		problems = append(problems, fmt.Sprintf("matchmaking.mode %q is not one of fill, rating", c.Matchmaking.Mode))
+	}
+
+	if c.Matchmaking.Rating.InitialWindow <= 0 || c.Matchmaking.Rating.WidenPerSecond < 0 || c.Matchmaking.Rating.MaxWindow < c.Matchmaking.Rating.InitialWindow {
+		problems = append(problems, "matchmaking.rating needs a positive initial_window, no more than max_window, and a non-negative widen_per_second")
+	}
+
+	if c.Matchmaking.Rating.Tau <= 0 {
+		problems = append(problems, "matchmaking.rating.tau must be positive")
+	}
+
+	if c.Matchmaking.MaxLatencyMS < 0 {
+		problems = append(problems, "matchmaking.max_latency_ms must not be negative")
+	}
+
+	joinKeyIDs := make(map[string]bool)
+
+	for i, key := range c.Matchmaking.JoinTokenKeys {
+		name := fmt.Sprintf("matchmaking.join_token_keys[%v]", i)
+
+		if strings.TrimSpace(key.ID) == "" {
+			problems = append(problems, name+".id is required")
+		} else if joinKeyIDs[key.ID] {
+			problems = append(problems, fmt.Sprintf("%v.id %q is used more than once", name, key.ID))
+		}
+
+		joinKeyIDs[key.ID] = true
+
+		if strings.TrimSpace(key.PrivateKeyFile) == "" {
+			problems = append(problems, name+".private_key_file is required")
+		}
+	}
+
+	if c.Servers.MaxServersPerRegion <= 0 {
+		problems = append(problems, "servers.max_servers_per_region must be positive")
+	}
+
+	if c.Servers.AllocateNewServerThreshold <= 0 || c.Servers.AllocateNewServerThreshold > 1 {
+		problems = append(problems, "servers.allocate_new_server_threshold must be in (0, 1]")
+	}
+
+	if c.Servers.DefaultMaxPlayers <= 0 {
+		problems = append(problems, "servers.default_max_players must be positive")
+	}
+
+	if len(c.Modes) == 0 {
+		problems = append(problems, "at least one mode is required")
+	}
+
+	modeNames := make(map[string]bool)
+
+	for i, mode := range c.Modes {
+		if strings.TrimSpace(mode.Name) == "" {
+			problems = append(problems, fmt.Sprintf("modes[%v].name is required", i))
+		} else if modeNames[mode.Name] {
+			problems = append(problems, fmt.Sprintf("modes[%v].name %q is used more than once", i, mode.Name))
+		}
+
+		modeNames[mode.Name] = true
+
+		if mode.MaxPlayers <= 0 {
+			problems = append(problems, fmt.Sprintf("modes[%v].max_players must be positive", i))
+		}
+
+		if mode.FullThreshold <= 0 || mode.FullThreshold > 1 {
+			problems = append(problems, fmt.Sprintf("modes[%v].full_threshold must be in (0, 1]", i))
+		}
+
+		if mode.AllocateNewServerThreshold < 0 || mode.AllocateNewServerThreshold > 1 {
+			problems = append(problems, fmt.Sprintf("modes[%v].allocate_new_server_threshold must be between 0 and 1", i))
+		}
+
+		if mode.MinServers < 0 || mode.MaxServers < 0 || (mode.MaxServers > 0 && mode.MinServers > mode.MaxServers) {
+			problems = append(problems, fmt.Sprintf("modes[%v] needs min_servers and max_servers that aren't negative, with min_servers no more than max_servers", i))
+		}
+	}
+
+	return
+}
+
+func (c *coordinatorConfig) validateAuth() (problems configErrors) {
+	platforms := c.platforms()
+
+	if len(platforms) == 0 {
+		problems = append(problems, "no auth platform enabled, set steam.enabled, auth.jwt or auth.test_tokens")
+	}
+
+	if c.Auth.DefaultPlatform != "" && !platforms[c.Auth.DefaultPlatform] {
+		problems = append(problems, fmt.Sprintf("auth.default_platform %q is not an enabled platform", c.Auth.DefaultPlatform))
+	}
+
+	tokens := make(map[string]bool)
+
+	for developer, token := range c.Auth.TestTokens {
+		if strings.TrimSpace(token) == "" {
+			problems = append(problems, fmt.Sprintf("auth.test_tokens.%v is empty", developer))
+		} else if tokens[token] {
+			problems = append(problems, fmt.Sprintf("auth.test_tokens.%v is used by another developer", developer))
+		}
+
+		tokens[token] = true
+	}
+
+	if len(c.Auth.SessionKeys) == 0 {
+		problems = append(problems, "auth.session_keys requires at least one key")
+	}
+
+	keyIDs := make(map[string]bool)
+
+	for i, key := range c.Auth.SessionKeys {
+		name := fmt.Sprintf("auth.session_keys[%v]", i)
+
+		if key.ID == "" || strings.Contains(key.ID, ".") {
+			problems = append(problems, name+".id is required and must not contain '.'")
+		} else if keyIDs[key.ID] {
+			problems = append(problems, fmt.Sprintf("%v.id %q is used more than once", name, key.ID))
+		}
+
+		keyIDs[key.ID] = true
+
+		if len(key.Secret) < minSessionSecretLength {
+			problems = append(problems, fmt.Sprintf("%v.secret must be at least %v characters", name, minSessionSecretLength))
+		}
+	}
+
+	if c.Auth.SessionTTLMinutes <= 0 {
+		problems = append(problems, "auth.session_ttl_minutes must be positive")
+	}
+
+	jwtPlatforms := make(map[string]bool)
+
+	for i, settings := range c.Auth.JWT {
+		name := fmt.Sprintf("auth.jwt[%v]", i)
+
+		if settings.Platform == steamPlatform || settings.Platform == testPlatform {
+			problems = append(problems, fmt.Sprintf("%v.platform %q is reserved", name, settings.Platform))
+		} else if jwtPlatforms[settings.Platform] {
+			problems = append(problems, fmt.Sprintf("%v.platform %q is used more than once", name, settings.Platform))
+		}
+
+		jwtPlatforms[settings.Platform] = true
+
+		if strings.TrimSpace(settings.Platform) == "" {
+			problems = append(problems, name+".platform is required")
+		}
+		if strings.TrimSpace(settings.Issuer) == "" {
+			problems = append(problems, name+".issuer is required")
+		}
+		if strings.TrimSpace(settings.Audience) == "" {
+			problems = append(problems, name+".audience is required")
+		}
+		if strings.TrimSpace(settings.KeysFile) == "" {
+			problems = append(problems, name+".keys_file is required")
+		}
+	}
+
+	return
+}
+
+// platforms returns the names of the enabled auth platforms
+func (c *coordinatorConfig) platforms() map[string]bool {
+	platforms := make(map[string]bool)
+
+	if c.Steam.Enabled {
+		platforms[steamPlatform] = true
+	}
+
+	if len(c.Auth.TestTokens) > 0 {
+		platforms[testPlatform] = true
+	}
+
+	for _, settings := range c.Auth.JWT {
+		platforms[settings.Platform] = true
+	}
+
+	return platforms
+}
+
+// defaultPlatform returns the configured default platform, or steam if enabled, or the only enabled platform
+func (c *coordinatorConfig) defaultPlatform() string {
+	if c.Auth.DefaultPlatform != "" {
+		return c.Auth.DefaultPlatform
+	}
+
+	platforms := c.platforms()
+
+	if platforms[steamPlatform] {
+		return steamPlatform
+	}
+
+	if len(platforms) == 1 {
+		for platform := range platforms {
+			return platform
+		}
+	}
+
+	return ""
+}
+
+// applyRegionDefaults fills unset region limits from the servers section
+func (c *coordinatorConfig) applyRegionDefaults() {
+	for i := range c.Regions {
+		if c.Regions[i].MaxServers == 0 {
+			c.Regions[i].MaxServers = c.Servers.MaxServersPerRegion
+		}
+
+		if c.Regions[i].AllocateNewServerThreshold == 0 {
+			c.Regions[i].AllocateNewServerThreshold = c.Servers.AllocateNewServerThreshold
+		}
+	}
+}
+
+func (c *coordinatorConfig) applyModeDefaults() {
+	for i := range c.Modes {
+		if c.Modes[i].ClanForgeProfileID == "" {
+			c.Modes[i].ClanForgeProfileID = c.ClanForge.ProfileID
+		}
+
+		if c.Modes[i].MaxPlayers == 0 {
+			c.Modes[i].MaxPlayers = c.Servers.DefaultMaxPlayers
+		}
+
+		if c.Modes[i].FullThreshold == 0 {
+			c.Modes[i].FullThreshold = serverFullThreshold
+		}
+	}
+}
+
+// findMode returns the configured mode with the given name, or the first mode for an empty name
+func findMode(name string) (modeConfig, bool) {
+	if name == "" && len(config.Modes) > 0 {
+		return config.Modes[0], true
+	}
+
+	for _, mode := range config.Modes {
+		if mode.Name == name {
+			return mode, true
+		}
+	}
+
+	return modeConfig{}, false
+}
+
+// recordMode returns the mode of a server or allocation record. Records from before modes, or of a
+// mode no longer configured, belong to the first mode.
+func recordMode(name string) modeConfig {
+	mode, ok := findMode(name)
+	if !ok {
+		return config.Modes[0]
+	}
+
+	return mode
+}
+
+// regionLimits returns the mode's autoscaling limits in region
+func (m modeConfig) regionLimits(region regionConfig) (maxServers int, allocateThreshold float64) {
+	maxServers = m.MaxServers
+	if maxServers == 0 {
+		maxServers = region.MaxServers
+	}
+
+	allocateThreshold = m.AllocateNewServerThreshold
+	if allocateThreshold == 0 {
+		allocateThreshold = region.AllocateNewServerThreshold
+	}
+
+	return
+}
+
+// findRegion returns the configured region with the given name
+func findRegion(name string) (regionConfig, bool) {
+	for _, region := range config.Regions {
+		if region.Name == name {
+			return region, true
+		}
+	}
+
+	return regionConfig{}, false
+}
+
+// serverProvider returns the configured provider name, defaulting to fake on the dev server
+func (c *coordinatorConfig) serverProvider() string {
+	if c.Servers.Provider != "" {
+		return c.Servers.Provider
+	}
+
+	if appengine.IsDevAppServer() {
+		return "fake"
+	}
+
+	return "clanforge"
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// fallbackRegions returns the regions a ticket queued in region may spill into after waiting. A
+// region is reached once the ticket has waited the after_seconds along its shortest path through
+// the regions' fallbacks, and only if the latencies every player measured permit it. Regions are
+// returned in the order they were reached. Tickets in a VAC pool never fall back.
+func fallbackRegions(region string, waited time.Duration, latencies []string) (regions []string) {
+	if settings, _ := findRegion(region); settings.VACPool {
+		return nil
+	}
+
+	delays := map[string]int{region: 0}
+	pending := []string{region}
+
+	for len(pending) > 0 {
+		current := pending[0]
+		pending = pending[1:]
+
+		settings, _ := findRegion(current)
+
+		for _, fallback := range settings.Fallbacks {
+			delay := delays[current] + fallback.AfterSeconds
+
+			if known, ok := delays[fallback.Region]; !ok || delay < known {
+				delays[fallback.Region] = delay
+				pending = append(pending, fallback.Region)
+			}
+		}
+	}
+
+	for fallback, delay := range delays {
+		if fallback == region || float64(delay) > waited.Seconds() {
+			continue
+		}
+
+		permitted := true
+		for _, playerLatencies := range latencies {
+			permitted = permitted && latencyPermits(playerLatencies, fallback)
+		}
+
+		if permitted {
+			regions = append(regions, fallback)
+		}
+	}
+
+	sort.Slice(regions, func(i, j int) bool {
+		if delays[regions[i]] != delays[regions[j]] {
+			return delays[regions[i]] < delays[regions[j]]
+		}
+
+		return regions[i] < regions[j]
+	})
+
+	return
+}
+
+// findFallbackServer looks for a server of the mode with room for the ticket's players, one per
+// entry in latencies, in the regions a ticket queued in region at queued falls back to. Rating mode
+// matches on rating.
+func findFallbackServer(ctx context.Context, region, mode string, queued time.Time, latencies []string, rating float64, attempts int) (server gameServer, err error) {
+	for _, fallback := range fallbackRegions(region, time.Now().Sub(queued), latencies) {
+		if config.Matchmaking.Mode == matchmakingModeRating {
+			server, err = findRatedServer(ctx, fallback, mode, len(latencies), rating, ratingWindow(queued, attempts))
+		} else {
+			server, err = findPartyServer(ctx, fallback, mode, len(latencies))
+		}
+
+		if err != errNotFound {
+			return
+		}
+	}
+
+	return gameServer{}, errNotFound
+}
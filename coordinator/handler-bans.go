@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+const (
+	activeBansKey          = "Bans-Active"
+	activeBansCacheSeconds = 60 // How long servers may go without a new ban in their heartbeats
+)
+
+// banInfo is a ban as reported to admins, banned players and game servers
+type banInfo struct {
+	BanID   string   `json:"BanID"`
+	UserID  string   `json:"UserID"`
+	Reason  string   `json:"Reason"`
+	Regions []string `json:"Regions,omitempty"`
+	Modes   []string `json:"Modes,omitempty"`
+	Expires int64    `json:"Expires"` // Unix seconds, 0 for permanent bans
+}
+
+func newBanInfo(b ban) banInfo {
+	info := banInfo{
+		BanID:   b.ID,
+		UserID:  b.UserID,
+		Reason:  b.Reason,
+		Regions: b.Regions,
+		Modes:   b.Modes,
+	}
+
+	if !b.Permanent {
+		info.Expires = b.ExpiryTime.Unix()
+	}
+
+	return info
+}
+
+// bansHandler administers the ban list. GET lists active bans, optionally for one UserID. POST bans
+// the UserID with a Reason, optional comma separated Regions and Modes, and DurationMinutes (omit
+// for a permanent ban). DELETE removes the ban with the BanID.
+func bansHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(r)
+
+	var response interface{}
+
+	switch r.Method {
+	case "GET":
+		userBans, err := bans.ListBans(ctx, r.FormValue("UserID"))
+
+		if err != nil {
+			log.Errorf(ctx, "[Bans] %v", err.Error())
+			http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+			return
+		}
+
+		infos := []banInfo{}
+		now := time.Now()
+
+		for _, b := range userBans {
+			if b.active(now) {
+				infos = append(infos, newBanInfo(b))
+			}
+		}
+
+		response = infos
+	case "POST":
+		b := ban{
+			ID:           uuid.Must(uuid.NewV4()).String(),
+			UserID:       r.FormValue("UserID"),
+			Reason:       r.FormValue("Reason"),
+			Regions:      splitScope(r.FormValue("Regions")),
+			Modes:        splitScope(r.FormValue("Modes")),
+			CreationTime: time.Now(),
+			Permanent:    r.FormValue("DurationMinutes") == "",
+		}
+
+		if b.UserID == "" || b.Reason == "" {
+			log.Errorf(ctx, "[Bans] UserID and Reason are required")
+			http.Error(w, "Invalid Request.", http.StatusBadRequest)
+			return
+		}
+
+		for _, region := range b.Regions {
+			if _, ok := findRegion(region); !ok {
+				log.Errorf(ctx, "[Bans] Unknown region %v", region)
+				http.Error(w, "Invalid Region.", http.StatusBadRequest)
+				return
+			}
+		}
+
+		if !b.Permanent {
+			minutes, err := strconv.Atoi(r.FormValue("DurationMinutes"))
+
+			if err != nil || minutes <= 0 {
+				log.Errorf(ctx, "[Bans] Invalid DurationMinutes %v", r.FormValue("DurationMinutes"))
+				http.Error(w, "Invalid Request.", http.StatusBadRequest)
+				return
+			}
+
+			b.ExpiryTime = b.CreationTime.Add(time.Minute * time.Duration(minutes))
+		}
+
+		err := bans.PutBan(ctx, b)
+
+		if err != nil {
+			log.Errorf(ctx, "[Bans] %v", err.Error())
+			http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+			return
+		}
+
+		log.Infof(ctx, "[Bans] Banned %v (%v): %v", b.UserID, b.ID, b.Reason)
+
+		if strings.HasPrefix(b.UserID, steamPlatform+":") {
+			err = invalidateSteamAuth(ctx, strings.TrimPrefix(b.UserID, steamPlatform+":"))
+
+			if err != nil {
+				log.Errorf(ctx, "[Bans] %v", err.Error())
+			}
+		}
+
+		clearActiveBans(ctx)
+		response = newBanInfo(b)
+	case "DELETE":
+		banID := r.FormValue("BanID")
+
+		b, err := bans.GetBan(ctx, banID)
+
+		if err == errNotFound {
+			http.Error(w, "Ban not Found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Errorf(ctx, "[Bans] %v", err.Error())
+			http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+			return
+		}
+
+		err = bans.DeleteBan(ctx, banID)
+
+		if err != nil {
+			log.Errorf(ctx, "[Bans] %v", err.Error())
+			http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+			return
+		}
+
+		log.Infof(ctx, "[Bans] Removed ban %v on %v", b.ID, b.UserID)
+
+		clearActiveBans(ctx)
+		response = newBanInfo(b)
+	default:
+		log.Errorf(ctx, "[Bans] Invalid request method %v", r.Method)
+		http.Error(w, "Invalid Request.", http.StatusBadRequest)
+		return
+	}
+
+	data, err := json.Marshal(response)
+
+	if err != nil {
+		log.Errorf(ctx, "[Bans] %v", err.Error())
+		http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// findBan returns an active ban on any of the user IDs covering the region and game mode
+func findBan(ctx context.Context, userIDs []string, region, mode string) (found ban, banned bool, err error) {
+	now := time.Now()
+
+	for _, userID := range userIDs {
+		var userBans []ban
+		userBans, err = bans.ListBans(ctx, userID)
+
+		if err != nil {
+			return
+		}
+
+		for _, b := range userBans {
+			if b.active(now) && b.appliesTo(region, mode) {
+				// Report the ban lasting longest
+				if !banned || b.Permanent || (!found.Permanent && b.ExpiryTime.After(found.ExpiryTime)) {
+					found = b
+					banned = true
+				}
+			}
+		}
+	}
+
+	return
+}
+
+// activeBans returns the active bans covering the region and game mode, from a list cached briefly
+// as it is read on every heartbeat
+func activeBans(ctx context.Context, region, mode string) (infos []banInfo, err error) {
+	var all []ban
+
+	data, err := cache.Get(ctx, activeBansKey)
+
+	if err == nil {
+		err = json.Unmarshal(data, &all)
+	}
+
+	if err != nil {
+		all, err = bans.ListBans(ctx, "")
+
+		if err != nil {
+			return
+		}
+
+		data, err = json.Marshal(all)
+
+		if err != nil {
+			return
+		}
+
+		err = cache.Set(ctx, activeBansKey, data, time.Second*activeBansCacheSeconds)
+
+		if err != nil {
+			log.Errorf(ctx, "[Bans] %v", err.Error())
+		}
+	}
+
+	err = nil
+	infos = []banInfo{}
+	now := time.Now()
+
+	for _, b := range all {
+		if b.active(now) && b.appliesTo(region, mode) {
+			infos = append(infos, newBanInfo(b))
+		}
+	}
+
+	return
+}
+
+func clearActiveBans(ctx context.Context) {
+	err := cache.Delete(ctx, activeBansKey)
+
+	if err != nil {
+		log.Errorf(ctx, "[Bans] %v", err.Error())
+	}
+}
+
+func splitScope(value string) (scope []string) {
+	for _, s := range strings.Split(value, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			scope = append(scope, s)
+		}
+	}
+
+	return
+}
@@ -1,25 +1,33 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"time"
 
 	"github.com/gofrs/uuid"
-	"google.golang.org/appengine"
-	"google.golang.org/appengine/datastore"
-	"google.golang.org/appengine/log"
-	"google.golang.org/appengine/taskqueue"
 )
 
 const (
-	authenticateWithSteam       = true
-	nonSteamAuthenticationToken = "SecretAuthToken"
-	joinDelaySeconds            = 1
-	mmUserResetMatchmakeTime    = 1
+	mmUserResetMatchmakeTime = 1
 )
 
+type mmEnqueue struct {
+	QueryToken     string
+	SessionToken   string // Required by poll and dequeue
+	SessionExpires int64  // Unix seconds
+	PartyID        string `json:",omitempty"`
+	Region         string // Queued in, chosen from Latencies when no Region was requested
+	Mode           string
+}
+
+type mmBanned struct {
+	Reason  string
+	Expires int64 // Unix seconds, 0 for permanent bans
+}
+
 type mmPoll struct {
 	Status int
 }
@@ -29,11 +37,13 @@ type mmPollFull struct {
 	JoinToken     string
 	ServerAddress string
 	ServerPort    int
+	Region        string // May differ from the region queued in after falling back
+	Mode          string
 }
 
 // EnqueueHandler handles requests to queue for matchmaking
 func enqueueHandler(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
+	ctx := newContext(r)
 
 	if r.Method != "GET" {
 		log.Errorf(ctx, "[Enqueue] Invalid request method %v", r.Method)
@@ -41,45 +51,161 @@ func enqueueHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !limitClientRequest(ctx, w, r, "[Enqueue]", "Enqueue", config.RateLimits.Enqueue) {
+		return
+	}
+
 	q := r.URL.Query()
 
-	userID := q.Get("UserID")
+	platform := q.Get("Platform")
+	claimedUserID := q.Get("UserID")
 	authToken := q.Get("AuthToken")
 	region := q.Get("Region")
+	modeParam := q.Get("Mode")
+
+	latenciesParam := q.Get("Latencies")
 
-	if authenticateWithSteam {
-		authenticated, steamID, err := steamAuth(ctx, authToken)
+	if latenciesParam != "" {
+		latencies, err := parseLatencies(latenciesParam)
 
 		if err != nil {
-			log.Errorf(ctx, "[Enqueue] %v", err.Error())
-			http.Error(w, "Unexpected error.", http.StatusInternalServerError)
-			return
-		} else if !authenticated {
-			log.Errorf(ctx, "[Enqueue] Invalid Auth Token")
-			http.Error(w, "Invalid Auth Token.", http.StatusUnauthorized)
-			return
-		} else if userID != steamID {
-			log.Errorf(ctx, "[Enqueue] Invalid UserID")
-			http.Error(w, "Invalid UserID.", http.StatusUnauthorized)
+			log.Errorf(ctx, "[Enqueue] Invalid latencies %v", latenciesParam)
+			http.Error(w, "Invalid Latencies.", http.StatusBadRequest)
 			return
 		}
-	} else if authToken != nonSteamAuthenticationToken {
+
+		// Without a Region, queue in the closest region the client measured
+		if region == "" {
+			ranked := rankRegions(latencies)
+
+			if len(ranked) == 0 {
+				log.Infof(ctx, "[Enqueue] No region within %vms: %v", config.Matchmaking.MaxLatencyMS, latenciesParam)
+				http.Error(w, "No Region Within Max Latency.", http.StatusBadRequest)
+				return
+			}
+
+			region = ranked[0].Region
+		}
+	}
+
+	// VAC pools are only reached by routing VAC banned players from their chosen region
+	regionSettings, ok := findRegion(region)
+	if !ok || regionSettings.VACPool {
+		log.Errorf(ctx, "[Enqueue] Unknown region %v", region)
+		http.Error(w, "Invalid Region.", http.StatusBadRequest)
+		return
+	}
+
+	// Without a Mode, queue for the first configured mode
+	modeSettings, ok := findMode(modeParam)
+	if !ok {
+		log.Errorf(ctx, "[Enqueue] Unknown mode %v", modeParam)
+		http.Error(w, "Invalid Mode.", http.StatusBadRequest)
+		return
+	}
+
+	mode := modeSettings.Name
+
+	identity, err := authenticateUser(ctx, platform, claimedUserID, authToken)
+
+	if err == errUnknownPlatform {
+		log.Errorf(ctx, "[Enqueue] Unknown platform %v", platform)
+		http.Error(w, "Invalid Platform.", http.StatusBadRequest)
+		return
+	} else if err == errInvalidAuthToken {
 		log.Errorf(ctx, "[Enqueue] Invalid Auth Token")
 		http.Error(w, "Invalid Auth Token.", http.StatusUnauthorized)
 		return
+	} else if err == errInvalidUserID {
+		log.Errorf(ctx, "[Enqueue] Invalid UserID")
+		http.Error(w, "Invalid UserID.", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		log.Errorf(ctx, "[Enqueue] %v", err.Error())
+		http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+		return
+	}
+
+	// Limit by the verified user, so a claimed UserID can't spend another player's requests
+	if !limitUserRequest(ctx, w, "[Enqueue]", "Enqueue", identity.qualifiedID(), config.RateLimits.Enqueue) {
+		return
+	}
+
+	if identity.PublisherBanned && config.Steam.PublisherBanPolicy == banPolicyReject {
+		log.Infof(ctx, "[Enqueue] Rejected publisher banned user %v", identity.qualifiedID())
+		http.Error(w, "Publisher Banned.", http.StatusForbidden)
+		return
+	}
+
+	if identity.GameBans > 0 && config.Steam.RejectOwnerGameBans {
+		log.Infof(ctx, "[Enqueue] Rejected user %v borrowing from %v with %v game bans", identity.qualifiedID(), identity.OwnerID, identity.GameBans)
+		http.Error(w, "Owner Game Banned.", http.StatusForbidden)
+		return
+	}
+
+	if identity.VACBanned {
+		switch config.Steam.VACBanPolicy {
+		case banPolicyReject:
+			log.Infof(ctx, "[Enqueue] Rejected VAC banned user %v", identity.qualifiedID())
+			http.Error(w, "VAC Banned.", http.StatusForbidden)
+			return
+		case banPolicySeparate:
+			log.Infof(ctx, "[Enqueue] Routing VAC banned user %v from %v to %v", identity.qualifiedID(), region, regionSettings.VACBannedRegion)
+			region = regionSettings.VACBannedRegion
+		}
+	}
+
+	userID := identity.qualifiedID()
+
+	// Bans on a Family Sharing owner cover the borrower
+	banUserIDs := []string{userID}
+	if identity.OwnerID != "" {
+		banUserIDs = append(banUserIDs, authIdentity{Platform: identity.Platform, UserID: identity.OwnerID}.qualifiedID())
 	}
 
-	key, user, qErr := queryUser(ctx, "UserID =", userID)
-	found := key != nil
+	userBan, banned, err := findBan(ctx, banUserIDs, region, mode)
 
-	if qErr != nil && qErr != datastore.Done {
+	if err != nil {
+		log.Errorf(ctx, "[Enqueue] %v", err.Error())
+		http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+		return
+	}
+
+	if banned {
+		log.Infof(ctx, "[Enqueue] Rejected banned user %v (%v)", userID, userBan.ID)
+
+		info := newBanInfo(userBan)
+		response, err := json.Marshal(mmBanned{Reason: info.Reason, Expires: info.Expires})
+
+		if err != nil {
+			log.Errorf(ctx, "[Enqueue] %v", err.Error())
+			http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write(response)
+		return
+	}
+
+	partyID := q.Get("PartyID")
+
+	if partyID != "" || q.Get("CreateParty") == "true" {
+		enqueuePartyMember(ctx, w, userID, region, mode, latenciesParam, partyID)
+		return
+	}
+
+	user, qErr := users.GetUserByID(ctx, userID)
+	found := qErr == nil
+
+	if qErr != nil && qErr != errNotFound {
 		log.Errorf(ctx, "[Enqueue] %v", qErr.Error())
 		http.Error(w, "Unexpected error.", http.StatusInternalServerError)
 		return
 	}
 
 	var mmtok string
-	var err error
 
 	if found {
 		// Case where reconnecting
@@ -96,15 +222,21 @@ func enqueueHandler(w http.ResponseWriter, r *http.Request) {
 		if canQueue {
 			mmtok = user.MMTok
 
-			if enoughTimeSinceLastCheck {
+			// Queuing in another region or mode, or without the party, replaces the queued ticket
+			changed := user.Region != region || recordMode(user.Mode).Name != mode || user.PartyID != ""
+
+			if enoughTimeSinceLastCheck || changed {
 				log.Infof(ctx, "[Enqueue] Requeuing user %v with token %v", user.UserID, mmtok)
 
 				user.MMStatus = mmStatusInQueue
 				user.CheckTime = time.Now()
+				user.QueueTime = time.Now()
+				user.Region = region
+				user.Mode = mode
+				user.Latencies = latenciesParam
+				user.PartyID = ""
 
-				t := taskqueue.NewPOSTTask("/joinmatch", map[string][]string{"mmtok": {mmtok}, "region": {region}})
-				t.Delay = time.Second * joinDelaySeconds
-				_, err = taskqueue.Add(ctx, t, "default")
+				err = addTask(ctx, "/joinmatch", map[string][]string{"mmtok": {mmtok}, "region": {region}, "mode": {mode}}, time.Second*time.Duration(config.Matchmaking.JoinDelaySeconds), "default")
 
 				if err != nil {
 					log.Errorf(ctx, "[Enqueue] %v", err.Error())
@@ -114,7 +246,7 @@ func enqueueHandler(w http.ResponseWriter, r *http.Request) {
 			} else {
 				log.Infof(ctx, "[Enqueue] More time required to requeue user %v with token %v", user.UserID, mmtok)
 			}
-			_, err := datastore.Put(ctx, key, &user)
+			err := users.PutUser(ctx, user)
 			if err != nil {
 				log.Errorf(ctx, "[Enqueue] %v", err.Error())
 				http.Error(w, "Unexpected error.", http.StatusInternalServerError)
@@ -135,18 +267,20 @@ func enqueueHandler(w http.ResponseWriter, r *http.Request) {
 			MMStatus:     mmStatusInQueue,
 			CreationTime: time.Now(),
 			CheckTime:    time.Now(),
+			QueueTime:    time.Now(),
+			Region:       region,
+			Mode:         mode,
+			Latencies:    latenciesParam,
 		}
 
-		_, err := datastore.Put(ctx, datastore.NewIncompleteKey(ctx, "MMUser", nil), &user)
+		err := users.PutUser(ctx, user)
 		if err != nil {
 			log.Errorf(ctx, "[Enqueue] %v", err.Error())
 			http.Error(w, "[Enqueue] Unexpected error.", http.StatusInternalServerError)
 			return
 		}
 
-		t := taskqueue.NewPOSTTask("/joinmatch", map[string][]string{"mmtok": {mmtok}, "region": {region}})
-		t.Delay = time.Second * joinDelaySeconds
-		_, err = taskqueue.Add(ctx, t, "default")
+		err = addTask(ctx, "/joinmatch", map[string][]string{"mmtok": {mmtok}, "region": {region}, "mode": {mode}}, time.Second*time.Duration(config.Matchmaking.JoinDelaySeconds), "default")
 
 		if err != nil {
 			log.Errorf(ctx, "[Enqueue] %v", err.Error())
@@ -154,14 +288,35 @@ func enqueueHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		log.Infof(ctx, "[Enqueue] Added user %v with token %v in region %v", user.UserID, mmtok, region)
+		log.Infof(ctx, "[Enqueue] Added user %v with token %v in region %v for mode %v", user.UserID, mmtok, region, mode)
 	}
 
-	fmt.Fprintf(w, "%v", mmtok)
+	writeEnqueueResponse(ctx, w, userID, mmtok, "", region, mode)
+}
+
+// writeEnqueueResponse responds with the matchmaking token and a session token for it
+func writeEnqueueResponse(ctx context.Context, w http.ResponseWriter, userID, mmtok, partyID, region, mode string) {
+	session, expires, err := issueSessionToken(userID, mmtok)
+
+	if err != nil {
+		log.Errorf(ctx, "[Enqueue] %v", err.Error())
+		http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+		return
+	}
+
+	response, err := json.Marshal(mmEnqueue{QueryToken: mmtok, SessionToken: session, SessionExpires: expires.Unix(), PartyID: partyID, Region: region, Mode: mode})
+
+	if err != nil {
+		log.Errorf(ctx, "[Enqueue] %v", err.Error())
+		http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(response)
 }
 
 func dequeueHandler(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
+	ctx := newContext(r)
 
 	if r.Method != "GET" {
 		log.Errorf(ctx, "[Dequeue] Invalid request method %v", r.Method)
@@ -169,14 +324,32 @@ func dequeueHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !limitClientRequest(ctx, w, r, "[Dequeue]", "Dequeue", config.RateLimits.Dequeue) {
+		return
+	}
+
 	q := r.URL.Query()
 
 	mmtok := q.Get("QueryToken")
 
-	key, user, qErr := queryUser(ctx, "MMTok =", mmtok)
-	found := key != nil
+	claims, err := verifySessionToken(sessionToken(r))
+
+	if err != nil || (mmtok != "" && mmtok != claims.MMTok) {
+		log.Errorf(ctx, "[Dequeue] Invalid Session Token")
+		http.Error(w, "Invalid Session Token.", http.StatusUnauthorized)
+		return
+	}
 
-	if qErr != nil {
+	if !limitUserRequest(ctx, w, "[Dequeue]", "Dequeue", claims.UserID, config.RateLimits.Dequeue) {
+		return
+	}
+
+	mmtok = claims.MMTok
+
+	user, qErr := users.GetUserByToken(ctx, mmtok)
+	found := qErr == nil
+
+	if qErr != nil && qErr != errNotFound {
 		log.Errorf(ctx, "[Dequeue] %v", qErr.Error())
 		http.Error(w, "Unexpected error.", http.StatusInternalServerError)
 		return
@@ -188,12 +361,18 @@ func dequeueHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if user.UserID != claims.UserID {
+		log.Errorf(ctx, "[Dequeue] Session user %v does not own token %v", claims.UserID, mmtok)
+		http.Error(w, "Invalid Session Token.", http.StatusUnauthorized)
+		return
+	}
+
 	user.MMStatus = mmStatusMatchmakingCancelled
 	user.CheckTime = time.Now().Add(-(userRecordExpiryTime + 1) * time.Minute) // Guarantee stale for next cleanup
 
-	_, err := datastore.Put(ctx, key, &user)
+	err = users.PutUser(ctx, user)
 	if err != nil {
-		log.Errorf(ctx, "[Enqueue] %v", err.Error())
+		log.Errorf(ctx, "[Dequeue] %v", err.Error())
 		http.Error(w, "Unexpected error.", http.StatusInternalServerError)
 		return
 	}
@@ -204,7 +383,7 @@ func dequeueHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func pollHandler(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
+	ctx := newContext(r)
 
 	if r.Method != "GET" {
 		log.Errorf(ctx, "[Poll] Invalid request method %v", r.Method)
@@ -212,14 +391,32 @@ func pollHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !limitClientRequest(ctx, w, r, "[Poll]", "Poll", config.RateLimits.Poll) {
+		return
+	}
+
 	q := r.URL.Query()
 
 	mmtok := q.Get("QueryToken")
 
-	key, user, qErr := queryUser(ctx, "MMTok =", mmtok)
-	found := key != nil
+	claims, err := verifySessionToken(sessionToken(r))
+
+	if err != nil || (mmtok != "" && mmtok != claims.MMTok) {
+		log.Errorf(ctx, "[Poll] Invalid Session Token")
+		http.Error(w, "Invalid Session Token.", http.StatusUnauthorized)
+		return
+	}
+
+	if !limitUserRequest(ctx, w, "[Poll]", "Poll", claims.UserID, config.RateLimits.Poll) {
+		return
+	}
+
+	mmtok = claims.MMTok
+
+	user, qErr := users.GetUserByToken(ctx, mmtok)
+	found := qErr == nil
 
-	if qErr != nil {
+	if qErr != nil && qErr != errNotFound {
 		log.Errorf(ctx, "[Poll] %v", qErr.Error())
 		http.Error(w, "Unexpected error.", http.StatusInternalServerError)
 		return
@@ -231,10 +428,16 @@ func pollHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if user.UserID != claims.UserID {
+		log.Errorf(ctx, "[Poll] Session user %v does not own token %v", claims.UserID, mmtok)
+		http.Error(w, "Invalid Session Token.", http.StatusUnauthorized)
+		return
+	}
+
 	if user.MMStatus == mmStatusInQueue { // Only update time if haven't found a match
 		user.CheckTime = time.Now()
 
-		_, err := datastore.Put(ctx, key, &user)
+		err := users.PutUser(ctx, user)
 		if err != nil {
 			log.Errorf(ctx, "[Poll] %v", err.Error())
 			http.Error(w, "Unexpected error.", http.StatusInternalServerError)
@@ -250,6 +453,8 @@ func pollHandler(w http.ResponseWriter, r *http.Request) {
 			JoinToken:     user.JoinTok,
 			ServerAddress: user.ServerAddr,
 			ServerPort:    user.ServerPort,
+			Region:        user.Region,
+			Mode:          user.Mode,
 		}
 
 		response, err := json.Marshal(pollFull)
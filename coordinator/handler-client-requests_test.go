@@ -0,0 +1,700 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnqueueHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		query  string
+		status int
+		region string // Queued in, when accepted
+		mode   string
+	}{
+		{name: "queues in the requested region", method: "GET", query: "Platform=test&UserID=a&AuthToken=" + testToken + "&Region=eu&Mode=default", status: 200, region: "eu", mode: "default"},
+		{name: "defaults to the first mode", method: "GET", query: "Platform=test&UserID=a&AuthToken=" + testToken + "&Region=na", status: 200, region: "na", mode: "default"},
+		{name: "rejects an unknown region", method: "GET", query: "Platform=test&UserID=a&AuthToken=" + testToken + "&Region=moon", status: 400},
+		{name: "rejects a VAC pool", method: "GET", query: "Platform=test&UserID=a&AuthToken=" + testToken + "&Region=vac", status: 400},
+		{name: "ranks regions without VAC pools", method: "GET", query: "Platform=test&UserID=a&AuthToken=" + testToken + "&Latencies=vac:10,eu:40,na:80", status: 200, region: "eu", mode: "default"},
+		{name: "queues in the closest region", method: "GET", query: "Platform=test&UserID=a&AuthToken=" + testToken + "&Latencies=na:80,eu:40", status: 200, region: "eu", mode: "default"},
+		{name: "keeps the requested region over latencies", method: "GET", query: "Platform=test&UserID=a&AuthToken=" + testToken + "&Region=na&Latencies=eu:10,na:90", status: 200, region: "na", mode: "default"},
+		{name: "skips regions over the max latency", method: "GET", query: "Platform=test&UserID=a&AuthToken=" + testToken + "&Latencies=na:200", status: 400},
+		{name: "rejects invalid latencies", method: "GET", query: "Platform=test&UserID=a&AuthToken=" + testToken + "&Latencies=na:fast", status: 400},
+		{name: "rejects an unknown mode", method: "GET", query: "Platform=test&UserID=a&AuthToken=" + testToken + "&Region=na&Mode=ranked", status: 400},
+		{name: "rejects an invalid token", method: "GET", query: "Platform=test&UserID=a&AuthToken=wrong&Region=na", status: 401},
+		{name: "rejects an unknown platform", method: "GET", query: "Platform=xbox&UserID=a&AuthToken=" + testToken + "&Region=na", status: 400},
+		{name: "rejects POST", method: "POST", query: "Platform=test&UserID=a&AuthToken=" + testToken + "&Region=na", status: 400},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := setupTestCoordinator(t, func(c *coordinatorConfig) {
+				c.Regions = append(c.Regions, regionConfig{Name: "vac", VACPool: true})
+			})
+			ctx := context.Background()
+
+			w := httptest.NewRecorder()
+			enqueueHandler(w, httptest.NewRequest(test.method, "/enqueue?"+test.query, nil))
+
+			if w.Code != test.status {
+				t.Fatalf("status %v, want %v: %v", w.Code, test.status, w.Body.String())
+			}
+
+			queued := recorder.withPath("/joinmatch")
+
+			if test.status != 200 {
+				if len(queued) != 0 {
+					t.Errorf("scheduled %v join tasks for a rejected request", len(queued))
+				}
+				return
+			}
+
+			var response mmEnqueue
+
+			err := json.Unmarshal(w.Body.Bytes(), &response)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if response.Region != test.region || response.Mode != test.mode {
+				t.Errorf("queued in %v for %v, want %v for %v", response.Region, response.Mode, test.region, test.mode)
+			}
+
+			user, err := users.GetUserByToken(ctx, response.QueryToken)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if user.MMStatus != mmStatusInQueue || user.Region != test.region || user.Mode != test.mode {
+				t.Errorf("stored user %+v, want queued in %v for %v", user, test.region, test.mode)
+			}
+
+			if len(queued) != 1 {
+				t.Fatalf("scheduled %v join tasks, want 1", len(queued))
+			}
+
+			params := queued[0].Params
+			if params.Get("mmtok") != response.QueryToken || params.Get("region") != test.region || params.Get("mode") != test.mode {
+				t.Errorf("join task params %v, want the user's token, region and mode", params)
+			}
+		})
+	}
+}
+
+// Queuing again before the first ticket is placed replaces it, leaving any party
+func TestEnqueueReplacesQueuedTicket(t *testing.T) {
+	recorder := setupTestCoordinator(t, nil)
+	ctx := context.Background()
+
+	putTestServer(t, "a", "na", 0)
+	putTestServer(t, "b", "eu", 0)
+
+	first := enqueueTestUser(t, recorder, "a", "na")
+	mmtok := first.Params.Get("mmtok")
+
+	user, err := users.GetUserByToken(ctx, mmtok)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user.PartyID = "party"
+	users.PutUser(ctx, user)
+
+	second := enqueueTestUser(t, recorder, "a", "eu")
+
+	if second.Params.Get("mmtok") != mmtok || second.Params.Get("region") != "eu" {
+		t.Fatalf("requeue task params %v, want the same token in eu", second.Params)
+	}
+
+	user, err = users.GetUserByToken(ctx, mmtok)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if user.Region != "eu" || user.PartyID != "" || user.MMStatus != mmStatusInQueue {
+		t.Fatalf("stored user %+v, want queued alone in eu", user)
+	}
+
+	if w := runTask(joinMatchHandler, first, 0); w.Code != 200 {
+		t.Fatalf("stale join status %v: %v", w.Code, w.Body.String())
+	}
+
+	if user, _ = users.GetUserByToken(ctx, mmtok); user.MMStatus != mmStatusInQueue {
+		t.Fatalf("stale join task placed the user on %v:%v", user.ServerAddr, user.ServerPort)
+	}
+
+	if w := runTask(joinMatchHandler, second, 0); w.Code != 200 {
+		t.Fatalf("join status %v: %v", w.Code, w.Body.String())
+	}
+
+	user, err = users.GetUserByToken(ctx, mmtok)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	join, err := getTestJoin(user.JoinTok)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if user.MMStatus != mmStatusJoinedMatch || join.ServerID != "b" {
+		t.Errorf("user %v joined %v, want b", user.MMStatus, join.ServerID)
+	}
+}
+
+// The per user limit is taken from the verified user, so requests claiming another player's UserID
+// don't spend that player's requests
+func TestEnqueueRateLimit(t *testing.T) {
+	setupTestCoordinator(t, func(c *coordinatorConfig) {
+		c.RateLimits.Enabled = true
+		c.RateLimits.Enqueue = endpointRateLimitConfig{PerUser: rateLimitConfig{RequestsPerMinute: 1, Burst: 1}}
+	})
+
+	enqueue := func(userID, authToken string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		enqueueHandler(w, httptest.NewRequest("GET", "/enqueue?Platform=test&UserID="+userID+"&AuthToken="+authToken+"&Region=na", nil))
+		return w
+	}
+
+	for i := 0; i < 3; i++ {
+		if w := enqueue("a", "wrong"); w.Code != 401 {
+			t.Fatalf("forged enqueue status %v, want 401", w.Code)
+		}
+	}
+
+	if w := enqueue("a", testToken); w.Code != 200 {
+		t.Fatalf("enqueue status %v after forged requests: %v", w.Code, w.Body.String())
+	}
+
+	w := enqueue("a", testToken)
+	if w.Code != 429 {
+		t.Fatalf("repeated enqueue status %v, want 429", w.Code)
+	}
+
+	if retryAfter := w.Header().Get("Retry-After"); retryAfter != "60" {
+		t.Errorf("Retry-After %q, want 60", retryAfter)
+	}
+
+	if w := enqueue("b", testToken); w.Code != 200 {
+		t.Errorf("another user's enqueue status %v: %v", w.Code, w.Body.String())
+	}
+}
+
+// signTestJWT returns a JWT of claims signed with key, an *ecdsa.PrivateKey or *rsa.PrivateKey,
+// whose header names algorithm
+func signTestJWT(t *testing.T, algorithm string, key crypto.Signer, claims map[string]interface{}) string {
+	header, _ := json.Marshal(jwtHeader{Algorithm: algorithm})
+	payload, _ := json.Marshal(claims)
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		signature = append(leftPad(r.Bytes(), 32), leftPad(s.Bytes(), 32)...)
+	case *rsa.PrivateKey:
+		var err error
+
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestEnqueueJWT(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "coordinator-jwt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var keys []byte
+
+	for _, public := range []crypto.PublicKey{&ecKey.PublicKey, &rsaKey.PublicKey} {
+		der, err := x509.MarshalPKIXPublicKey(public)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keys = append(keys, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})...)
+	}
+
+	keysFile := filepath.Join(dir, "keys.pem")
+
+	err = ioutil.WriteFile(keysFile, keys, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := func(change func(c map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{"iss": "https://issuer", "aud": "coordinator", "sub": "a", "exp": time.Now().Add(time.Hour).Unix()}
+		if change != nil {
+			change(c)
+		}
+
+		return c
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		userID string
+		status int
+	}{
+		{name: "accepts ES256", token: signTestJWT(t, "ES256", ecKey, claims(nil)), userID: "a", status: 200},
+		{name: "accepts RS256", token: signTestJWT(t, "RS256", rsaKey, claims(nil)), userID: "a", status: 200},
+		{name: "accepts the audience in a list", token: signTestJWT(t, "ES256", ecKey, claims(func(c map[string]interface{}) { c["aud"] = []string{"other", "coordinator"} })), userID: "a", status: 200},
+		{name: "rejects another issuer", token: signTestJWT(t, "ES256", ecKey, claims(func(c map[string]interface{}) { c["iss"] = "https://other" })), userID: "a", status: 401},
+		{name: "rejects another audience", token: signTestJWT(t, "ES256", ecKey, claims(func(c map[string]interface{}) { c["aud"] = "other" })), userID: "a", status: 401},
+		{name: "rejects an expired token", token: signTestJWT(t, "ES256", ecKey, claims(func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() })), userID: "a", status: 401},
+		{name: "rejects a token without expiry", token: signTestJWT(t, "ES256", ecKey, claims(func(c map[string]interface{}) { delete(c, "exp") })), userID: "a", status: 401},
+		{name: "rejects an algorithm not matching the key", token: signTestJWT(t, "RS256", ecKey, claims(nil)), userID: "a", status: 401},
+		{name: "rejects alg none", token: signTestJWT(t, "none", nil, claims(nil)), userID: "a", status: 401},
+		{name: "rejects an unknown key", token: signTestJWT(t, "ES256", otherKey, claims(nil)), userID: "a", status: 401},
+		{name: "rejects another subject", token: signTestJWT(t, "ES256", ecKey, claims(nil)), userID: "b", status: 401},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupTestCoordinator(t, func(c *coordinatorConfig) {
+				c.Auth.JWT = []jwtProviderConfig{{Platform: "oidc", Issuer: "https://issuer", Audience: "coordinator", KeysFile: keysFile}}
+			})
+
+			w := httptest.NewRecorder()
+			enqueueHandler(w, httptest.NewRequest("GET", "/enqueue?Platform=oidc&UserID="+test.userID+"&AuthToken="+test.token+"&Region=na", nil))
+
+			if w.Code != test.status {
+				t.Fatalf("status %v, want %v: %v", w.Code, test.status, w.Body.String())
+			}
+
+			if test.status != 200 {
+				return
+			}
+
+			if _, err := users.GetUserByID(context.Background(), "oidc:a"); err != nil {
+				t.Errorf("queued user not stored: %v", err)
+			}
+		})
+	}
+}
+
+// enqueueTestSession queues userID and returns the enqueue response with its session token
+func enqueueTestSession(t *testing.T, userID string) mmEnqueue {
+	w := httptest.NewRecorder()
+	enqueueHandler(w, httptest.NewRequest("GET", "/enqueue?Platform=test&UserID="+userID+"&AuthToken="+testToken+"&Region=na", nil))
+
+	if w.Code != 200 {
+		t.Fatalf("enqueue status %v: %v", w.Code, w.Body.String())
+	}
+
+	var response mmEnqueue
+
+	err := json.Unmarshal(w.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return response
+}
+
+// signTestSession signs claims with the session key like issueSessionToken
+func signTestSession(key sessionKeyConfig, claims sessionClaims) string {
+	payload, _ := json.Marshal(claims)
+	signed := key.ID + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signSession(key.Secret, signed))
+}
+
+func TestSessionTokens(t *testing.T) {
+	oldKey := sessionKeyConfig{ID: "old", Secret: strings.Repeat("o", minSessionSecretLength)}
+	newKey := sessionKeyConfig{ID: "new", Secret: strings.Repeat("n", minSessionSecretLength)}
+
+	tests := []struct {
+		name   string
+		token  func(a, b mmEnqueue) string
+		query  func(a, b mmEnqueue) string // QueryToken, if sent
+		keys   []sessionKeyConfig          // Configured when the request is made
+		header bool                        // Sent as an Authorization header
+		status int
+	}{
+		{name: "accepts the bearer header", token: func(a, b mmEnqueue) string { return a.SessionToken }, header: true, status: 200},
+		{name: "accepts the parameter", token: func(a, b mmEnqueue) string { return a.SessionToken }, status: 200},
+		{name: "accepts a matching query token", token: func(a, b mmEnqueue) string { return a.SessionToken }, query: func(a, b mmEnqueue) string { return a.QueryToken }, status: 200},
+		{name: "rejects a missing token", token: func(a, b mmEnqueue) string { return "" }, status: 401},
+		{name: "rejects another user's query token", token: func(a, b mmEnqueue) string { return a.SessionToken }, query: func(a, b mmEnqueue) string { return b.QueryToken }, status: 401},
+		{
+			name: "rejects claims changed after signing",
+			token: func(a, b mmEnqueue) string {
+				parts := strings.Split(a.SessionToken, ".")
+				forged := strings.Split(signTestSession(oldKey, sessionClaims{UserID: "test:dev/b", MMTok: b.QueryToken, ExpiresAt: time.Now().Add(time.Hour).Unix()}), ".")
+				return parts[0] + "." + forged[1] + "." + parts[2]
+			},
+			status: 401,
+		},
+		{
+			name: "rejects a token signed with another secret",
+			token: func(a, b mmEnqueue) string {
+				return signTestSession(sessionKeyConfig{ID: "old", Secret: strings.Repeat("x", minSessionSecretLength)}, sessionClaims{UserID: "test:dev/b", MMTok: b.QueryToken, ExpiresAt: time.Now().Add(time.Hour).Unix()})
+			},
+			status: 401,
+		},
+		{
+			name: "rejects an expired token",
+			token: func(a, b mmEnqueue) string {
+				return signTestSession(oldKey, sessionClaims{UserID: "test:dev/a", MMTok: a.QueryToken, ExpiresAt: time.Now().Add(-time.Minute).Unix()})
+			},
+			status: 401,
+		},
+		{name: "accepts the old key while it is listed after the new one", token: func(a, b mmEnqueue) string { return a.SessionToken }, keys: []sessionKeyConfig{newKey, oldKey}, status: 200},
+		{name: "rejects the old key once removed", token: func(a, b mmEnqueue) string { return a.SessionToken }, keys: []sessionKeyConfig{newKey}, status: 401},
+	}
+
+	handlers := []struct {
+		path    string
+		handler http.HandlerFunc
+	}{
+		{"/poll", pollHandler},
+		{"/dequeue", dequeueHandler},
+	}
+
+	for _, h := range handlers {
+		for _, test := range tests {
+			t.Run(h.path+" "+test.name, func(t *testing.T) {
+				setupTestCoordinator(t, func(c *coordinatorConfig) {
+					c.Auth.SessionKeys = []sessionKeyConfig{oldKey}
+				})
+				ctx := context.Background()
+
+				a := enqueueTestSession(t, "a")
+				b := enqueueTestSession(t, "b")
+
+				if test.keys != nil {
+					config.Auth.SessionKeys = test.keys
+				}
+
+				q := url.Values{}
+				token := test.token(a, b)
+
+				if test.query != nil {
+					q.Set("QueryToken", test.query(a, b))
+				}
+
+				if !test.header {
+					q.Set("SessionToken", token)
+				}
+
+				req := httptest.NewRequest("GET", h.path+"?"+q.Encode(), nil)
+				if test.header {
+					req.Header.Set("Authorization", "Bearer "+token)
+				}
+
+				w := httptest.NewRecorder()
+				h.handler(w, req)
+
+				if w.Code != test.status {
+					t.Fatalf("status %v, want %v: %v", w.Code, test.status, w.Body.String())
+				}
+
+				if h.path != "/dequeue" {
+					return
+				}
+
+				for _, queued := range []mmEnqueue{a, b} {
+					user, err := users.GetUserByToken(ctx, queued.QueryToken)
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					cancelled := user.MMStatus == mmStatusMatchmakingCancelled
+					if want := test.status == 200 && queued.QueryToken == a.QueryToken; cancelled != want {
+						t.Errorf("user %v cancelled %v, want %v", user.UserID, cancelled, want)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestEnqueueSteamBans(t *testing.T) {
+	tests := []struct {
+		name      string
+		params    steamAuthParams
+		ownerBans steamPlayerBans
+		configure func(c *steamConfig)
+		status    int
+		body      string
+	}{
+		{name: "admits a clean player", status: 200},
+		{name: "rejects a publisher ban", params: steamAuthParams{PublisherBanned: true}, status: 403, body: "Publisher Banned."},
+		{name: "admits a publisher ban when allowed", params: steamAuthParams{PublisherBanned: true}, configure: func(c *steamConfig) { c.PublisherBanPolicy = banPolicyAllow }, status: 200},
+		{name: "rejects a VAC ban", params: steamAuthParams{VacBanned: true}, configure: func(c *steamConfig) { c.VACBanPolicy = banPolicyReject }, status: 403, body: "VAC Banned."},
+		{name: "rejects a borrower from a VAC banned owner", params: steamAuthParams{OwnerSteamID: "200"}, ownerBans: steamPlayerBans{VACBanned: true}, configure: func(c *steamConfig) { c.VACBanPolicy = banPolicyReject }, status: 403, body: "VAC Banned."},
+		{name: "rejects a borrower from a game banned owner", params: steamAuthParams{OwnerSteamID: "200"}, ownerBans: steamPlayerBans{NumberOfGameBans: 1}, status: 403, body: "Owner Game Banned."},
+		{name: "admits a borrower from a game banned owner when allowed", params: steamAuthParams{OwnerSteamID: "200"}, ownerBans: steamPlayerBans{NumberOfGameBans: 1}, configure: func(c *steamConfig) { c.RejectOwnerGameBans = false }, status: 200},
+		{name: "ignores owner bans unless applied", params: steamAuthParams{OwnerSteamID: "200"}, ownerBans: steamPlayerBans{NumberOfGameBans: 1, VACBanned: true}, configure: func(c *steamConfig) { c.ApplyOwnerBans = false; c.VACBanPolicy = banPolicyReject }, status: 200},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupTestCoordinator(t, func(c *coordinatorConfig) {
+				if test.configure != nil {
+					test.configure(&c.Steam)
+				}
+			})
+
+			api, restore := useFakeSteamAPI()
+			defer restore()
+
+			test.params.SteamID = "100"
+			api.tickets["ticket"] = test.params
+			api.bans["200"] = test.ownerBans
+
+			w := httptest.NewRecorder()
+			enqueueHandler(w, httptest.NewRequest("GET", "/enqueue?Platform=steam&UserID=100&AuthToken=ticket&Region=na", nil))
+
+			if w.Code != test.status {
+				t.Fatalf("status %v, want %v: %v", w.Code, test.status, w.Body.String())
+			}
+
+			if test.body != "" && strings.TrimSpace(w.Body.String()) != test.body {
+				t.Errorf("body %q, want %q", w.Body.String(), test.body)
+			}
+		})
+	}
+}
+
+// banTestUser bans userID through bansHandler with the form values
+func banTestUser(t *testing.T, userID string, values url.Values) banInfo {
+	values.Set("UserID", userID)
+
+	req := httptest.NewRequest("POST", "/bans", strings.NewReader(values.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	w := httptest.NewRecorder()
+	bansHandler(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("ban status %v: %v", w.Code, w.Body.String())
+	}
+
+	var info banInfo
+
+	err := json.Unmarshal(w.Body.Bytes(), &info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return info
+}
+
+func TestEnqueueBannedUser(t *testing.T) {
+	tests := []struct {
+		name    string
+		ban     url.Values
+		region  string
+		expired bool
+		status  int
+	}{
+		{name: "rejects a permanent ban", ban: url.Values{"Reason": {"cheating"}}, region: "na", status: 403},
+		{name: "rejects a timed ban", ban: url.Values{"Reason": {"cheating"}, "DurationMinutes": {"60"}}, region: "na", status: 403},
+		{name: "rejects a ban in the region", ban: url.Values{"Reason": {"cheating"}, "Regions": {"na"}}, region: "na", status: 403},
+		{name: "admits outside the ban's regions", ban: url.Values{"Reason": {"cheating"}, "Regions": {"na"}}, region: "eu", status: 200},
+		{name: "admits once the ban expired", ban: url.Values{"Reason": {"cheating"}, "DurationMinutes": {"60"}}, region: "na", expired: true, status: 200},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := setupTestCoordinator(t, nil)
+			ctx := context.Background()
+
+			info := banTestUser(t, "test:dev/a", test.ban)
+
+			if test.expired {
+				b, err := bans.GetBan(ctx, info.BanID)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				b.ExpiryTime = time.Now().Add(-time.Minute)
+				bans.PutBan(ctx, b)
+			}
+
+			w := httptest.NewRecorder()
+			enqueueHandler(w, httptest.NewRequest("GET", "/enqueue?Platform=test&UserID=a&AuthToken="+testToken+"&Region="+test.region, nil))
+
+			if w.Code != test.status {
+				t.Fatalf("status %v, want %v: %v", w.Code, test.status, w.Body.String())
+			}
+
+			if test.status == 200 {
+				return
+			}
+
+			var response mmBanned
+
+			err := json.Unmarshal(w.Body.Bytes(), &response)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if response.Reason != "cheating" || response.Expires != info.Expires {
+				t.Errorf("ban response %+v, want the reason and expiry of %+v", response, info)
+			}
+
+			if queued := recorder.withPath("/joinmatch"); len(queued) != 0 {
+				t.Errorf("scheduled %v join tasks for a banned user", len(queued))
+			}
+
+			// Other players are unaffected
+			enqueueTestUser(t, recorder, "b", test.region)
+		})
+	}
+}
+
+// Polls are limited per address, and starting a party spends the leader's enqueue requests
+func TestClientRateLimits(t *testing.T) {
+	setupTestCoordinator(t, func(c *coordinatorConfig) {
+		c.RateLimits.Enabled = true
+		c.RateLimits.Poll = endpointRateLimitConfig{PerIP: rateLimitConfig{RequestsPerMinute: 6, Burst: 2}}
+		c.RateLimits.Enqueue = endpointRateLimitConfig{PerUser: rateLimitConfig{RequestsPerMinute: 1, Burst: 1}}
+	})
+
+	session := enqueueTestSession(t, "b")
+
+	poll := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/poll?SessionToken="+url.QueryEscape(session.SessionToken), nil)
+		req.RemoteAddr = remoteAddr
+
+		w := httptest.NewRecorder()
+		pollHandler(w, req)
+
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := poll("10.1.0.1:5000"); w.Code != 200 {
+			t.Fatalf("poll %v status %v: %v", i, w.Code, w.Body.String())
+		}
+	}
+
+	w := poll("10.1.0.1:5001")
+	if w.Code != 429 || w.Header().Get("Retry-After") != "10" {
+		t.Errorf("poll over the limit status %v, Retry-After %q, want 429 after 10", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	if w := poll("10.1.0.2:5000"); w.Code != 200 {
+		t.Errorf("poll from another address status %v", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	enqueueHandler(w, httptest.NewRequest("GET", "/enqueue?Platform=test&UserID=a&AuthToken="+testToken+"&Region=na&CreateParty=true", nil))
+
+	if w.Code != 200 {
+		t.Fatalf("enqueue status %v: %v", w.Code, w.Body.String())
+	}
+
+	var leader mmEnqueue
+
+	err := json.Unmarshal(w.Body.Bytes(), &leader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/startparty", nil)
+	req.Header.Set("Authorization", "Bearer "+leader.SessionToken)
+
+	w = httptest.NewRecorder()
+	startPartyHandler(w, req)
+
+	if w.Code != 429 {
+		t.Errorf("start party status %v, want 429 sharing the leader's enqueue limit", w.Code)
+	}
+}
+
+// A verified Steam ticket is reused until a ban on the player or the account they borrow from
+func TestEnqueueSteamAuthCache(t *testing.T) {
+	setupTestCoordinator(t, nil)
+
+	api, restore := useFakeSteamAPI()
+	defer restore()
+
+	api.tickets["ticket"] = steamAuthParams{SteamID: "100", OwnerSteamID: "200"}
+
+	const authPath = "/ISteamUserAuth/AuthenticateUserTicket/v1/"
+
+	steps := []struct {
+		name     string
+		ban      string // Banned in eu before enqueuing in na
+		verified int    // Tickets verified with Steam so far
+	}{
+		{name: "verifies the first time", verified: 1},
+		{name: "reuses the result on requeue", verified: 1},
+		{name: "keeps the result after banning another account", ban: "steam:300", verified: 1},
+		{name: "verifies again after banning the owner", ban: "steam:200", verified: 2},
+		{name: "reuses the new result", verified: 2},
+		{name: "verifies again after banning the player", ban: "steam:100", verified: 3},
+	}
+
+	for _, step := range steps {
+		if step.ban != "" {
+			banTestUser(t, step.ban, url.Values{"Reason": {"cheating"}, "Regions": {"eu"}})
+		}
+
+		w := httptest.NewRecorder()
+		enqueueHandler(w, httptest.NewRequest("GET", "/enqueue?Platform=steam&UserID=100&AuthToken=ticket&Region=na", nil))
+
+		if w.Code != 200 {
+			t.Fatalf("%v: enqueue status %v: %v", step.name, w.Code, w.Body.String())
+		}
+
+		if api.requests[authPath] != step.verified {
+			t.Errorf("%v: verified %v tickets, want %v", step.name, api.requests[authPath], step.verified)
+		}
+	}
+}
@@ -3,40 +3,58 @@ package main
 import (
 	"context"
 	"net/http"
-	"strconv"
+	"time"
+)
 
-	"google.golang.org/appengine"
-	"google.golang.org/appengine/log"
-	"google.golang.org/appengine/memcache"
+const (
+	allocationStuckMinutes = 30
 )
 
 func freeAllocationsHandler(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
+	ctx := newContext(r)
 
 	log.Infof(ctx, "[Free-Allocs] Running Free Allocations...")
 
-	clearStuckAllocations(ctx, naRegionName)
-	clearStuckAllocations(ctx, euRegionName)
+	for _, region := range config.Regions {
+		clearStuckAllocations(ctx, region.Name)
+	}
 }
 
+// clearStuckAllocations fails allocations that have not changed state for allocationStuckMinutes and
+// deallocates them, in case the provider did start a server
 func clearStuckAllocations(ctx context.Context, region string) {
-	activeAllocsItem, err := memcache.Get(ctx, activeAllocationsKey+region)
+	openAllocs, err := allocations.ListOpenAllocations(ctx, region)
 
-	if err != nil && err != memcache.ErrCacheMiss {
+	if err != nil {
 		log.Errorf(ctx, "[Free-Allocs] %v", err.Error())
+		return
 	}
 
-	activeAllocs := 0
+	cleared := 0
+
+	for _, alloc := range openAllocs {
+		if time.Now().Sub(alloc.UpdateTime).Minutes() < allocationStuckMinutes {
+			continue
+		}
+
+		log.Infof(ctx, "[Free-Allocs] Allocation %v stuck %v since %v", alloc.ServerID, allocationStateName(alloc.State), alloc.UpdateTime)
 
-	if err == nil { // Found ActiveAllocations in cache
-		parsedAllocs, err := strconv.Atoi(string(activeAllocsItem.Value))
+		err := addTask(ctx, "/dealloc", map[string][]string{"serverID": {alloc.ServerID}}, 0, "coordinator-deallocate")
 		if err != nil {
 			log.Errorf(ctx, "[Free-Allocs] %v", err.Error())
+			continue
 		}
-		activeAllocs = parsedAllocs
-	}
 
-	if activeAllocs != 0 {
-		memcache.Delete(ctx, activeAllocationsKey+region)
+		alloc.Error = "stuck " + allocationStateName(alloc.State)
+
+		err = updateAllocation(ctx, &alloc, allocationStateFailed)
+		if err != nil {
+			log.Errorf(ctx, "[Free-Allocs] %v", err.Error())
+			continue
+		}
+
+		cleared++
 	}
+
+	log.Infof(ctx, "[Free-Allocs] Failed %v stuck allocations in region %v", cleared, region)
 }
@@ -1,16 +1,12 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
 	"time"
-
-	"github.com/gofrs/uuid"
-	"google.golang.org/appengine"
-	"google.golang.org/appengine/datastore"
-	"google.golang.org/appengine/log"
-	"google.golang.org/appengine/memcache"
 )
 
 const (
@@ -19,14 +15,23 @@ const (
 	noServersRetryAttempts    = 5
 )
 
+var errServerFull = errors.New("server full")
+
+// lastServerKey caches the server the last ticket for the region and mode joined
+func lastServerKey(region, mode string) string {
+	return mmLastServerKey + region + "-" + mode
+}
+
 func joinMatchHandler(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
+	ctx := newContext(r)
 
 	var mmtok string
 	var region string
 
 	mmtok = r.FormValue("mmtok")
 	region = r.FormValue("region")
+	mode := recordMode(r.FormValue("mode")).Name
+	partyID := r.FormValue("partyID")
 
 	attemptsHeader := r.Header.Get("X-AppEngine-TaskRetryCount")
 	attempts, err := strconv.Atoi(attemptsHeader)
@@ -36,37 +41,46 @@ func joinMatchHandler(w http.ResponseWriter, r *http.Request) {
 		return // Return 200 for the request to disregard it
 	}
 
+	if partyID != "" {
+		log.Debugf(ctx, "[JoinMatch] Handling join request for party %v in region %v (attempt %v)", partyID, region, attemptsHeader)
+
+		joinPartyMatch(ctx, w, partyID, region, attempts)
+		return
+	}
+
 	log.Debugf(ctx, "[JoinMatch] Handling join request for %v in region %v (attempt %v)", mmtok, region, attemptsHeader)
 
 	// Get User
 
-	userKey, mmUser, uErr := queryUser(ctx, "MMTok =", mmtok)
-	foundUser := userKey != nil
+	mmUser, uErr := users.GetUserByToken(ctx, mmtok)
 
-	if !foundUser {
-		if uErr == datastore.Done { // Possible if dequeued prior to join attempt
-			if attempts >= userNotFoundRetryAttempts {
-				log.Errorf(ctx, "[JoinMatch] Out of attempts to find user with token: %v", mmtok)
-				return // Return 200 for the request to disregard it
-			}
-			log.Errorf(ctx, "[JoinMatch] Could not find user with token: %v", mmtok)
-			http.Error(w, "Token Not Found.", http.StatusNotFound)
-			return
-		} else if uErr != nil {
-			log.Errorf(ctx, "[JoinMatch] %v", uErr.Error())
-			http.Error(w, "Unexpected error.", http.StatusInternalServerError)
-			return
+	if uErr == errNotFound { // Possible if dequeued prior to join attempt
+		if attempts >= userNotFoundRetryAttempts {
+			log.Errorf(ctx, "[JoinMatch] Out of attempts to find user with token: %v", mmtok)
+			return // Return 200 for the request to disregard it
 		}
+		log.Errorf(ctx, "[JoinMatch] Could not find user with token: %v", mmtok)
+		http.Error(w, "Token Not Found.", http.StatusNotFound)
+		return
+	} else if uErr != nil {
+		log.Errorf(ctx, "[JoinMatch] %v", uErr.Error())
+		http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+		return
+	}
+
+	if mmUser.MMStatus != mmStatusInQueue || mmUser.PartyID != "" { // Already out of queue, or placed with a party
+		return // Return 200 for the request to disregard it
 	}
 
-	if mmUser.MMStatus != mmStatusInQueue { // Already out of queue
+	if mmUser.Region != region || recordMode(mmUser.Mode).Name != mode { // Requeued elsewhere since the task was added
+		log.Infof(ctx, "[JoinMatch] Disregarding stale join request for %v in region %v mode %v", mmtok, region, mode)
 		return // Return 200 for the request to disregard it
 	}
 
 	if attempts > noServersRetryAttempts {
 		mmUser.MMStatus = mmStatusMatchmakingFailed
 
-		_, err = datastore.Put(ctx, userKey, &mmUser)
+		err = users.PutUser(ctx, mmUser)
 		if err != nil {
 			log.Errorf(ctx, "[JoinMatch] %v", err.Error())
 			http.Error(w, "Unexpected error.", http.StatusInternalServerError)
@@ -78,109 +92,140 @@ func joinMatchHandler(w http.ResponseWriter, r *http.Request) {
 
 	//Get Server
 
-	var sk *datastore.Key
-	var serverKey datastore.Key
+	var serverID string
 	var server gameServer
 	var sErr error
 	var foundKey bool
+	var playerRatings []float64
 
-	serverItem, err := memcache.Get(ctx, mmLastServerKey+region)
-
-	if err == nil { // Found stored server key
-		encodedKey := serverItem.Value
-		err = serverKey.GobDecode(encodedKey)
-		if err != nil {
-			log.Errorf(ctx, "[JoinMatch] %v", err.Error())
-		} else {
-			foundKey = true
-		}
-	} else if err != memcache.ErrCacheMiss {
-		log.Errorf(ctx, "[JoinMatch] %v", err.Error())
-	}
-
-	if foundKey { // If previous server key was stored in memcache, retrieve it
-		err := datastore.Get(ctx, &serverKey, &server)
+	if config.Matchmaking.Mode == matchmakingModeRating { // Match by rating rather than filling the last server
+		rating, err := getPlayerRating(ctx, mmUser.UserID)
 		if err != nil {
-			memcache.Delete(ctx, mmLastServerKey+region) // Remove key as server is not found, next pass will find new server
 			log.Errorf(ctx, "[JoinMatch] %v", err.Error())
 			http.Error(w, "Unexpected error.", http.StatusInternalServerError)
 			return
-		} else if server.State != serverStateActive {
-			memcache.Delete(ctx, mmLastServerKey+region) // Remove key as server is in invalid state, next pass will find new server
-			log.Errorf(ctx, "[JoinMatch] Cached Server in Invalid State.")
-			http.Error(w, "Server in Invalid State.", http.StatusInternalServerError)
-			return
-		} else if server.PlayerCount >= server.MaxPlayerCount {
-			memcache.Delete(ctx, mmLastServerKey+region) // Remove key as server is full, next pass will find new server
-			log.Errorf(ctx, "[JoinMatch] Cached Server Full.")
-			http.Error(w, "Cached Server Full.", http.StatusInternalServerError)
-			return
 		}
-	} else { // Else query the datastore for a server to join
-		sk, server, sErr = queryServer(ctx, region, true)
-
-		if sErr == datastore.Done { // No available non-empty servers
-			sk, server, sErr = queryServer(ctx, region, false)
-			if sErr == datastore.Done { // No available servers
-				log.Errorf(ctx, "[JoinMatch] No Available Servers")
-				http.Error(w, "No Available Servers", http.StatusServiceUnavailable)
-				return
-			} else if sErr != nil {
-				log.Errorf(ctx, "[JoinMatch] %v", sErr.Error())
-				http.Error(w, "Unexpected error.", http.StatusInternalServerError)
-				return
-			} else if server.PlayerCount >= server.MaxPlayerCount {
-				log.Errorf(ctx, "[JoinMatch] Retrieved Server Full.")
-				http.Error(w, "Retrieved Server Full.", http.StatusInternalServerError)
-				return
-			}
+
+		server, sErr = findRatedServer(ctx, region, mode, 1, rating.Rating, ratingWindow(mmUser.QueueTime, attempts))
+
+		if sErr == errNotFound { // Spill into a fallback region
+			server, sErr = findFallbackServer(ctx, region, mode, mmUser.QueueTime, []string{mmUser.Latencies}, rating.Rating, attempts)
+		}
+
+		if sErr == errNotFound {
+			log.Errorf(ctx, "[JoinMatch] No Available Servers for rating %.0f", rating.Rating)
+			http.Error(w, "No Available Servers", http.StatusServiceUnavailable)
+			return
 		} else if sErr != nil {
 			log.Errorf(ctx, "[JoinMatch] %v", sErr.Error())
 			http.Error(w, "Unexpected error.", http.StatusInternalServerError)
 			return
-		} else if server.PlayerCount >= server.MaxPlayerCount {
-			log.Errorf(ctx, "[JoinMatch] Retrieved Server Full.")
-			http.Error(w, "Retrieved Server Full.", http.StatusInternalServerError)
-			return
 		}
 
-		serverKey = *sk
-
-		// Store the server key as the new last server
+		playerRatings = append(playerRatings, rating.Rating)
+	} else {
+		serverValue, err := cache.Get(ctx, lastServerKey(region, mode))
 
-		newEncodedKey, err := serverKey.GobEncode()
+		if err == nil { // Found stored server ID
+			serverID = string(serverValue)
+			foundKey = true
+		} else if err != errCacheMiss {
+			log.Errorf(ctx, "[JoinMatch] %v", err.Error())
+		}
 
-		if err != nil {
-			log.Errorf(ctx, "[JoinMatch] %v", sErr.Error())
-		} else {
-			serverItem := &memcache.Item{
-				Key:   mmLastServerKey + region,
-				Value: newEncodedKey,
+		if foundKey { // If previous server ID was stored in memcache, retrieve it
+			server, err = servers.GetServer(ctx, serverID)
+			if err != nil {
+				cache.Delete(ctx, lastServerKey(region, mode)) // Remove key as server is not found, next pass will find new server
+				log.Errorf(ctx, "[JoinMatch] %v", err.Error())
+				http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+				return
+			} else if server.State != serverStateActive {
+				cache.Delete(ctx, lastServerKey(region, mode)) // Remove key as server is in invalid state, next pass will find new server
+				log.Errorf(ctx, "[JoinMatch] Cached Server in Invalid State.")
+				http.Error(w, "Server in Invalid State.", http.StatusInternalServerError)
+				return
+			} else if server.PlayerCount >= server.MaxPlayerCount {
+				cache.Delete(ctx, lastServerKey(region, mode)) // Remove key as server is full, next pass will find new server
+				log.Errorf(ctx, "[JoinMatch] Cached Server Full.")
+				http.Error(w, "Cached Server Full.", http.StatusInternalServerError)
+				return
 			}
+		} else { // Else query the store for a server to join
+			server, sErr = servers.FindServer(ctx, region, mode, true)
 
-			err = memcache.Set(ctx, serverItem)
+			if sErr == nil && server.PlayerCount >= server.MaxPlayerCount { // The least filled server is full, so are the others
+				sErr = errNotFound
+			}
 
-			if err != nil {
+			if sErr == errNotFound { // No available non-empty servers
+				server, sErr = servers.FindServer(ctx, region, mode, false)
+				if sErr == errNotFound { // No available servers in the region, spill into a fallback region
+					server, sErr = findFallbackServer(ctx, region, mode, mmUser.QueueTime, []string{mmUser.Latencies}, 0, attempts)
+				}
+
+				if sErr == errNotFound { // No available servers
+					log.Errorf(ctx, "[JoinMatch] No Available Servers")
+					http.Error(w, "No Available Servers", http.StatusServiceUnavailable)
+					return
+				} else if sErr != nil {
+					log.Errorf(ctx, "[JoinMatch] %v", sErr.Error())
+					http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+					return
+				} else if server.PlayerCount >= server.MaxPlayerCount {
+					log.Errorf(ctx, "[JoinMatch] Retrieved Server Full.")
+					http.Error(w, "Retrieved Server Full.", http.StatusInternalServerError)
+					return
+				}
+			} else if sErr != nil {
 				log.Errorf(ctx, "[JoinMatch] %v", sErr.Error())
+				http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+				return
+			}
+
+			// Store the server ID as the new last server, unless it is in a fallback region
+
+			if server.Region == region {
+				err = cache.Set(ctx, lastServerKey(region, mode), []byte(server.UUID), 0)
+
+				if err != nil {
+					log.Errorf(ctx, "[JoinMatch] %v", err.Error())
+				}
 			}
 		}
 	}
 
-	server.PlayerCount++
+	if server.Region != region {
+		log.Infof(ctx, "[JoinMatch] User %v falling back from %v to %v", mmUser.UserID, region, server.Region)
+		region = server.Region
+	}
+
+	reserved, err := reserveSlots(ctx, server.UUID, 1, playerRatings)
+
+	if err == errServerFull || err == errNotFound {
+		cache.Delete(ctx, lastServerKey(region, mode)) // Remove key as the server filled up or went away, next pass will find new server
+		log.Errorf(ctx, "[JoinMatch] Server %v no longer has room.", server.UUID)
+		http.Error(w, "Server Full.", http.StatusInternalServerError)
+		return
+	} else if err != nil {
+		log.Errorf(ctx, "[JoinMatch] %v", err.Error())
+		http.Error(w, "[JoinMatch] Unexpected error.", http.StatusInternalServerError)
+		return
+	}
+
+	server = reserved
 
 	if server.PlayerCount >= server.MaxPlayerCount {
-		memcache.Delete(ctx, mmLastServerKey+region)
+		cache.Delete(ctx, lastServerKey(region, mode))
 	}
 
-	_, err = datastore.Put(ctx, &serverKey, &server)
+	joinTok, err := newJoinToken(mmUser.UserID, server.UUID, region)
 	if err != nil {
 		log.Errorf(ctx, "[JoinMatch] %v", err.Error())
 		http.Error(w, "[JoinMatch] Unexpected error.", http.StatusInternalServerError)
 		return
 	}
 
-	joinTok := uuid.Must(uuid.NewV4()).String()
-
 	// Store join record to notify server of joining player
 
 	join := joinRecord{
@@ -192,7 +237,7 @@ func joinMatchHandler(w http.ResponseWriter, r *http.Request) {
 		Checked:      false,
 	}
 
-	_, err = datastore.Put(ctx, datastore.NewIncompleteKey(ctx, "JoinRecord", nil), &join)
+	err = joins.PutJoin(ctx, join)
 	if err != nil {
 		log.Errorf(ctx, "[JoinMatch] %v", err.Error())
 		http.Error(w, "[JoinMatch] Unexpected error.", http.StatusInternalServerError)
@@ -205,8 +250,9 @@ func joinMatchHandler(w http.ResponseWriter, r *http.Request) {
 	mmUser.JoinTok = joinTok
 	mmUser.ServerAddr = server.Address
 	mmUser.ServerPort = server.Port
+	mmUser.Region = region
 
-	_, err = datastore.Put(ctx, userKey, &mmUser)
+	err = users.PutUser(ctx, mmUser)
 	if err != nil {
 		log.Errorf(ctx, "[JoinMatch] %v", err.Error())
 		http.Error(w, "Unexpected error.", http.StatusInternalServerError)
@@ -217,3 +263,51 @@ func joinMatchHandler(w http.ResponseWriter, r *http.Request) {
 
 	fmt.Fprintf(w, "%v (%v) joined %v (%v, %v)", mmtok, mmUser.UserID, server.UUID, server.Address, server.Port)
 }
+
+// reserveSlots counts players, with their ratings if rated, onto the server unless it is no longer
+// active with room for them. The count is updated in place, so heartbeats and the sequence numbers
+// of signed requests saved since the server was read are kept.
+func reserveSlots(ctx context.Context, serverID string, players int, playerRatings []float64) (server gameServer, err error) {
+	err = servers.UpdateServer(ctx, serverID, func(s *gameServer) error {
+		if s.State != serverStateActive || s.MaxPlayerCount-s.PlayerCount < players {
+			return errServerFull
+		}
+
+		s.PlayerCount += players
+
+		for _, rating := range playerRatings {
+			s.addRating(rating)
+		}
+
+		server = *s
+		return nil
+	})
+
+	return
+}
+
+// releaseSlots takes back players counted by reserveSlots. The server's rating range is left as is.
+func releaseSlots(ctx context.Context, serverID string, players int, playerRatings []float64) error {
+	err := servers.UpdateServer(ctx, serverID, func(s *gameServer) error {
+		s.PlayerCount -= players
+		if s.PlayerCount < 0 {
+			s.PlayerCount = 0
+		}
+
+		for _, rating := range playerRatings {
+			if s.RatedPlayers > 0 {
+				s.RatingTotal -= rating
+				s.RatedPlayers--
+			}
+		}
+
+		s.trimRatings()
+		return nil
+	})
+
+	if err == errNotFound {
+		return nil // Nothing left to release
+	}
+
+	return err
+}
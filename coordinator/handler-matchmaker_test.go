@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// enqueueTestUser queues userID through enqueueHandler and returns its join task
+func enqueueTestUser(t *testing.T, recorder *recordingTasks, userID, region string) recordedTask {
+	before := len(recorder.withPath("/joinmatch"))
+
+	w := httptest.NewRecorder()
+	enqueueHandler(w, httptest.NewRequest("GET", "/enqueue?Platform=test&UserID="+userID+"&AuthToken="+testToken+"&Region="+region, nil))
+
+	if w.Code != 200 {
+		t.Fatalf("enqueue status %v: %v", w.Code, w.Body.String())
+	}
+
+	var response mmEnqueue
+
+	err := json.Unmarshal(w.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queued := recorder.withPath("/joinmatch")
+	if len(queued) != before+1 {
+		t.Fatalf("scheduled %v join tasks, want %v", len(queued), before+1)
+	}
+
+	return queued[len(queued)-1]
+}
+
+func TestJoinMatchHandler(t *testing.T) {
+	type testServer struct {
+		id          string
+		region      string
+		playerCount int
+	}
+
+	tests := []struct {
+		name       string
+		servers    []testServer
+		lastServer string // Cached as the last server joined in na
+		fallback   bool   // na falls back to eu immediately
+		attempt    int
+		status     int
+		joined     string // Server the user is placed on
+	}{
+		{name: "joins the only server", servers: []testServer{{"a", "na", 0}}, status: 200, joined: "a"},
+		{name: "fills the least filled non-empty server", servers: []testServer{{"a", "na", 6}, {"b", "na", 3}, {"c", "na", 0}}, status: 200, joined: "b"},
+		{name: "moves on to an empty server once the others are full", servers: []testServer{{"a", "na", 10}, {"b", "na", 0}}, status: 200, joined: "b"},
+		{name: "joins the cached last server", servers: []testServer{{"a", "na", 2}, {"b", "na", 1}}, lastServer: "a", status: 200, joined: "a"},
+		{name: "retries when the cached server is full", servers: []testServer{{"a", "na", 10}, {"b", "na", 0}}, lastServer: "a", status: 500},
+		{name: "retries with every server full", servers: []testServer{{"a", "na", 10}}, status: 503},
+		{name: "retries without servers in the region", servers: []testServer{{"a", "eu", 0}}, status: 503},
+		{name: "falls back to another region", servers: []testServer{{"a", "eu", 0}}, fallback: true, status: 200, joined: "a"},
+		{name: "gives up after the last attempt", attempt: noServersRetryAttempts + 1, status: 200},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := setupTestCoordinator(t, func(c *coordinatorConfig) {
+				if test.fallback {
+					c.Regions[0].Fallbacks = []regionFallbackConfig{{Region: "eu"}}
+				}
+			})
+			ctx := context.Background()
+
+			for _, server := range test.servers {
+				putTestServer(t, server.id, server.region, server.playerCount)
+			}
+
+			if test.lastServer != "" {
+				cache.Set(ctx, lastServerKey("na", defaultModeName), []byte(test.lastServer), 0)
+			}
+
+			task := enqueueTestUser(t, recorder, "a", "na")
+
+			w := runTask(joinMatchHandler, task, test.attempt)
+			if w.Code != test.status {
+				t.Fatalf("status %v, want %v: %v", w.Code, test.status, w.Body.String())
+			}
+
+			user, err := users.GetUserByToken(ctx, task.Params.Get("mmtok"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.joined == "" {
+				want := mmStatusInQueue
+				if test.attempt > noServersRetryAttempts {
+					want = mmStatusMatchmakingFailed
+				}
+
+				if user.MMStatus != want {
+					t.Errorf("user status %v, want %v", user.MMStatus, want)
+				}
+				return
+			}
+
+			server, err := servers.GetServer(ctx, test.joined)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if user.MMStatus != mmStatusJoinedMatch || user.Region != server.Region || user.ServerAddr != server.Address || user.ServerPort != server.Port {
+				t.Errorf("stored user %+v, want joined to %v", user, test.joined)
+			}
+
+			for _, s := range test.servers {
+				if s.id == test.joined && server.PlayerCount != s.playerCount+1 {
+					t.Errorf("server %v has %v players, want %v", s.id, server.PlayerCount, s.playerCount+1)
+				}
+			}
+
+			join, err := getTestJoin(user.JoinTok)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if join.UserID != user.UserID || join.ServerID != test.joined {
+				t.Errorf("join record %+v, want %v on %v", join, user.UserID, test.joined)
+			}
+		})
+	}
+}
+
+// The ticket that fills a server leaves the next ticket to start an empty one
+func TestJoinMatchFullServerThenNewServer(t *testing.T) {
+	recorder := setupTestCoordinator(t, nil)
+	ctx := context.Background()
+
+	putTestServer(t, "a", "na", 9)
+	putTestServer(t, "b", "na", 0)
+
+	first := enqueueTestUser(t, recorder, "a", "na")
+	second := enqueueTestUser(t, recorder, "b", "na")
+
+	if w := runTask(joinMatchHandler, first, 0); w.Code != 200 {
+		t.Fatalf("first join status %v: %v", w.Code, w.Body.String())
+	}
+
+	if w := runTask(joinMatchHandler, second, 0); w.Code != 200 {
+		t.Fatalf("second join status %v: %v", w.Code, w.Body.String())
+	}
+
+	user, err := users.GetUserByToken(ctx, second.Params.Get("mmtok"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	join, err := getTestJoin(user.JoinTok)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if join.ServerID != "b" {
+		t.Errorf("second user joined %v, want b", join.ServerID)
+	}
+}
+
+// Reserving works on the stored record, so a stale copy can't overfill the server or roll back
+// the sequence numbers of signed requests accepted since it was read
+func TestReserveSlots(t *testing.T) {
+	setupTestCoordinator(t, nil)
+	ctx := context.Background()
+
+	stale := putTestServer(t, "a", "na", 8)
+
+	err := servers.AdvanceSequence(ctx, "a", sequenceHeartbeat, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reserved, err := reserveSlots(ctx, stale.UUID, 2, []float64{1500, 1600})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reserved.PlayerCount != 10 || reserved.RatedPlayers != 2 || reserved.HeartbeatSequence != 7 {
+		t.Errorf("reserved server %+v, want 10 players, 2 rated and heartbeat sequence 7", reserved)
+	}
+
+	_, err = reserveSlots(ctx, stale.UUID, 1, nil)
+	if err != errServerFull {
+		t.Errorf("reserving on a full server returned %v, want errServerFull", err)
+	}
+
+	_, err = reserveSlots(ctx, "missing", 1, nil)
+	if err != errNotFound {
+		t.Errorf("reserving on a missing server returned %v, want errNotFound", err)
+	}
+}
+
+// Signed join tokens verify offline against the published keys, as a game server would check them
+func TestSignedJoinTokens(t *testing.T) {
+	recorder := setupTestCoordinator(t, nil)
+	ctx := context.Background()
+
+	for _, id := range []string{"current", "previous"} {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		joinTokenKeys = append(joinTokenKeys, joinTokenKey{ID: id, Key: key})
+	}
+
+	putTestServer(t, "a", "na", 0)
+
+	task := enqueueTestUser(t, recorder, "a", "na")
+
+	if w := runTask(joinMatchHandler, task, 0); w.Code != 200 {
+		t.Fatalf("join status %v: %v", w.Code, w.Body.String())
+	}
+
+	user, err := users.GetUserByToken(ctx, task.Params.Get("mmtok"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	joinTokenKeysHandler(w, httptest.NewRequest("GET", "/jointokenkeys", nil))
+
+	published, err := parseJWTKeys(w.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(published) != 2 {
+		t.Fatalf("published %v keys, want 2", len(published))
+	}
+
+	verify := func(token string) (claims joinTokenClaims, verified bool) {
+		parts := strings.Split(token, ".")
+		if len(parts) != 3 {
+			return
+		}
+
+		var header jwtHeader
+		signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+
+		if decodeJWTSegment(parts[0], &header) != nil || decodeJWTSegment(parts[1], &claims) != nil || err != nil {
+			return
+		}
+
+		for _, key := range published {
+			if key.ID == header.KeyID && header.Algorithm == "ES256" {
+				verified = verifyJWTSignature(header.Algorithm, key.Key, []byte(parts[0]+"."+parts[1]), signature)
+			}
+		}
+
+		return
+	}
+
+	claims, verified := verify(user.JoinTok)
+	if !verified {
+		t.Fatalf("join token %v not verified with the published keys", user.JoinTok)
+	}
+
+	if claims.UserID != user.UserID || claims.ServerID != "a" || claims.Region != "na" || claims.ExpiresAt <= time.Now().Unix() {
+		t.Errorf("join token claims %+v, want %v on a in na, not expired", claims, user.UserID)
+	}
+
+	parts := strings.Split(user.JoinTok, ".")
+	forged, _ := json.Marshal(joinTokenClaims{ID: claims.ID, UserID: "test:dev/z", ServerID: "a", Region: "na", ExpiresAt: claims.ExpiresAt})
+
+	if _, verified := verify(parts[0] + "." + base64.RawURLEncoding.EncodeToString(forged) + "." + parts[2]); verified {
+		t.Errorf("join token verified with changed claims")
+	}
+
+	join, err := getTestJoin(user.JoinTok)
+	if err != nil || join.UserID != user.UserID {
+		t.Errorf("join record for the signed token %+v: %v", join, err)
+	}
+}
+
+// Tickets spill into a fallback region only once they have waited its after_seconds, and only
+// where the latencies they measured permit
+func TestJoinMatchFallback(t *testing.T) {
+	tests := []struct {
+		name      string
+		region    string // Region of the only server
+		waited    time.Duration
+		latencies string
+		status    int
+	}{
+		{name: "waits before falling back", region: "eu", waited: 30 * time.Second, status: 503},
+		{name: "falls back after waiting", region: "eu", waited: 90 * time.Second, status: 200},
+		{name: "falls back within the max latency", region: "eu", waited: 90 * time.Second, latencies: "na:40,eu:120", status: 200},
+		{name: "does not fall back over the max latency", region: "eu", waited: 90 * time.Second, latencies: "na:40,eu:200", status: 503},
+		{name: "does not fall back to an unmeasured region", region: "eu", waited: 90 * time.Second, latencies: "na:40", status: 503},
+		{name: "waits for chained fallbacks to add up", region: "ap", waited: 90 * time.Second, status: 503},
+		{name: "follows chained fallbacks", region: "ap", waited: 150 * time.Second, status: 200},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := setupTestCoordinator(t, func(c *coordinatorConfig) {
+				c.Regions = append(c.Regions, regionConfig{Name: "ap"})
+				c.Regions[0].Fallbacks = []regionFallbackConfig{{Region: "eu", AfterSeconds: 60}}
+				c.Regions[1].Fallbacks = []regionFallbackConfig{{Region: "ap", AfterSeconds: 60}}
+			})
+			ctx := context.Background()
+
+			putTestServer(t, "a", test.region, 0)
+
+			task := enqueueTestUser(t, recorder, "a", "na")
+
+			user, err := users.GetUserByToken(ctx, task.Params.Get("mmtok"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			user.QueueTime = time.Now().Add(-test.waited)
+			user.Latencies = test.latencies
+
+			err = users.PutUser(ctx, user)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if w := runTask(joinMatchHandler, task, 0); w.Code != test.status {
+				t.Fatalf("status %v, want %v: %v", w.Code, test.status, w.Body.String())
+			}
+
+			user, err = users.GetUserByToken(ctx, task.Params.Get("mmtok"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.status != 200 {
+				if user.MMStatus != mmStatusInQueue {
+					t.Errorf("user status %v, want still in queue", user.MMStatus)
+				}
+				return
+			}
+
+			join, err := getTestJoin(user.JoinTok)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if user.MMStatus != mmStatusJoinedMatch || user.Region != test.region || join.ServerID != "a" {
+				t.Errorf("stored user %+v joined %v, want joined to a in %v", user, join.ServerID, test.region)
+			}
+		})
+	}
+}
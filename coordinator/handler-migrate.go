@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+const (
+	migrateKeysBatchSize = 200
+)
+
+type migrateKeysResponse struct {
+	Migrated  int
+	Remaining bool // Another batch has been queued
+}
+
+// migrateKeysHandler re-keys the GameServer, MMUser and JoinRecord entities earlier versions saved with
+// auto-allocated IDs under their natural identifiers. It handles a batch of each kind, queuing itself
+// again until none are left.
+func migrateKeysHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(r)
+
+	response := migrateKeysResponse{}
+
+	if _, ok := servers.(datastoreServerStore); ok {
+		var err error
+
+		response.Migrated, response.Remaining, err = migrateLegacyKeys(ctx, migrateKeysBatchSize)
+
+		if err != nil {
+			log.Errorf(ctx, "[MigrateKeys] %v", err.Error())
+			http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if response.Remaining {
+		err := addTask(ctx, "/migratekeys", map[string][]string{}, 0, "default")
+
+		if err != nil {
+			log.Errorf(ctx, "[MigrateKeys] %v", err.Error())
+			http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	log.Infof(ctx, "[MigrateKeys] Re-keyed %v entities, more remaining: %v", response.Migrated, response.Remaining)
+
+	data, err := json.Marshal(response)
+
+	if err != nil {
+		log.Errorf(ctx, "[MigrateKeys] %v", err.Error())
+		http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+var (
+	errPartyNotForming = errors.New("party already queued")
+	errPartyRegion     = errors.New("party is in another region")
+	errPartyMode       = errors.New("party is queued for another mode")
+	errPartyFull       = errors.New("party full")
+	errPartyNotLeader  = errors.New("not the party leader")
+	errPartyPlaced     = errors.New("party already placed")
+)
+
+type mmParty struct {
+	PartyID string
+	Members []string
+}
+
+// enqueuePartyMember creates a party led by the user, or adds the user to partyID. Members wait in
+// queue until the leader starts the party with /startparty.
+func enqueuePartyMember(ctx context.Context, w http.ResponseWriter, userID, region, mode, latencies, partyID string) {
+	user, err := users.GetUserByID(ctx, userID)
+	found := err == nil
+
+	if err != nil && err != errNotFound {
+		log.Errorf(ctx, "[Enqueue] %v", err.Error())
+		http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+		return
+	}
+
+	mmtok := uuid.Must(uuid.NewV4()).String()
+
+	if found {
+		enoughTimeSinceLastCheck := time.Now().Sub(user.CheckTime).Minutes() >= mmUserResetMatchmakeTime
+
+		if user.MMStatus != mmStatusInQueue && !enoughTimeSinceLastCheck {
+			log.Infof(ctx, "[Enqueue] Invalid state for queuing: %v", user.MMStatus)
+			http.Error(w, "Unexpected error.", http.StatusNotAcceptable)
+			return
+		}
+
+		mmtok = user.MMTok
+	} else {
+		user = mmUser{UserID: userID, CreationTime: time.Now()}
+	}
+
+	if partyID == "" {
+		p := newParty(uuid.Must(uuid.NewV4()).String(), userID, region, mode)
+
+		err = parties.PutParty(ctx, p)
+		partyID = p.ID
+
+		log.Infof(ctx, "[Enqueue] User %v created party %v in region %v", userID, partyID, region)
+	} else {
+		err = parties.UpdateParty(ctx, partyID, func(p *party) error {
+			if p.Region != region {
+				return errPartyRegion
+			} else if p.Mode != mode {
+				return errPartyMode
+			} else if p.hasMember(userID) {
+				return nil
+			} else if p.State != partyStateForming {
+				return errPartyNotForming
+			} else if len(p.Members) >= config.Matchmaking.MaxPartySize {
+				return errPartyFull
+			}
+
+			p.Members = append(p.Members, userID)
+			p.UpdateTime = time.Now()
+			return nil
+		})
+
+		log.Infof(ctx, "[Enqueue] User %v joining party %v: %v", userID, partyID, err)
+	}
+
+	if err == errNotFound {
+		http.Error(w, "Party Not Found.", http.StatusNotFound)
+		return
+	} else if err == errPartyRegion {
+		http.Error(w, "Invalid Region.", http.StatusBadRequest)
+		return
+	} else if err == errPartyMode {
+		http.Error(w, "Invalid Mode.", http.StatusBadRequest)
+		return
+	} else if err == errPartyNotForming {
+		http.Error(w, "Party Already Queued.", http.StatusConflict)
+		return
+	} else if err == errPartyFull {
+		http.Error(w, "Party Full.", http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Errorf(ctx, "[Enqueue] %v", err.Error())
+		http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+		return
+	}
+
+	user.MMTok = mmtok
+	user.MMStatus = mmStatusInQueue
+	user.CheckTime = time.Now()
+	user.Region = region
+	user.Mode = mode
+	user.Latencies = latencies
+	user.PartyID = partyID
+
+	err = users.PutUser(ctx, user)
+	if err != nil {
+		log.Errorf(ctx, "[Enqueue] %v", err.Error())
+		http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+		return
+	}
+
+	writeEnqueueResponse(ctx, w, userID, mmtok, partyID, region, mode)
+}
+
+// startPartyHandler queues the session user's party as one ticket. Only the leader may start it.
+func startPartyHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(r)
+
+	if r.Method != "GET" {
+		log.Errorf(ctx, "[StartParty] Invalid request method %v", r.Method)
+		http.Error(w, "Invalid Request.", http.StatusBadRequest)
+		return
+	}
+
+	if !limitClientRequest(ctx, w, r, "[StartParty]", "Enqueue", config.RateLimits.Enqueue) {
+		return
+	}
+
+	claims, err := verifySessionToken(sessionToken(r))
+
+	if err != nil {
+		log.Errorf(ctx, "[StartParty] Invalid Session Token")
+		http.Error(w, "Invalid Session Token.", http.StatusUnauthorized)
+		return
+	}
+
+	if !limitUserRequest(ctx, w, "[StartParty]", "Enqueue", claims.UserID, config.RateLimits.Enqueue) {
+		return
+	}
+
+	user, err := users.GetUserByToken(ctx, claims.MMTok)
+
+	if err == errNotFound {
+		log.Errorf(ctx, "[StartParty] Matchmaker Token Not Found")
+		http.Error(w, "Matchmaker Token Not Found.", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Errorf(ctx, "[StartParty] %v", err.Error())
+		http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+		return
+	}
+
+	if user.UserID != claims.UserID {
+		log.Errorf(ctx, "[StartParty] Session user %v does not own token %v", claims.UserID, claims.MMTok)
+		http.Error(w, "Invalid Session Token.", http.StatusUnauthorized)
+		return
+	}
+
+	if user.PartyID == "" || user.MMStatus != mmStatusInQueue {
+		http.Error(w, "Not In Party.", http.StatusBadRequest)
+		return
+	}
+
+	var started party
+
+	err = parties.UpdateParty(ctx, user.PartyID, func(p *party) error {
+		if p.LeaderID != user.UserID {
+			return errPartyNotLeader
+		} else if p.State != partyStateForming {
+			return errPartyNotForming
+		}
+
+		p.State = partyStateQueued
+		p.UpdateTime = time.Now()
+
+		started = *p
+		return nil
+	})
+
+	if err == errNotFound {
+		http.Error(w, "Party Not Found.", http.StatusNotFound)
+		return
+	} else if err == errPartyNotLeader {
+		http.Error(w, "Not Party Leader.", http.StatusForbidden)
+		return
+	} else if err == errPartyNotForming {
+		http.Error(w, "Party Already Queued.", http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Errorf(ctx, "[StartParty] %v", err.Error())
+		http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+		return
+	}
+
+	err = addTask(ctx, "/joinmatch", map[string][]string{"partyID": {started.ID}, "region": {started.Region}, "mode": {started.Mode}}, time.Second*time.Duration(config.Matchmaking.JoinDelaySeconds), "default")
+
+	if err != nil {
+		log.Errorf(ctx, "[StartParty] %v", err.Error())
+
+		// Let the leader try again
+		started.State = partyStateForming
+		err = parties.PutParty(ctx, started)
+		if err != nil {
+			log.Errorf(ctx, "[StartParty] %v", err.Error())
+		}
+
+		http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+		return
+	}
+
+	log.Infof(ctx, "[StartParty] Queued party %v (%v members) in region %v", started.ID, len(started.Members), started.Region)
+
+	response, err := json.Marshal(mmParty{PartyID: started.ID, Members: started.Members})
+
+	if err != nil {
+		log.Errorf(ctx, "[StartParty] %v", err.Error())
+		http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(response)
+}
+
+// joinPartyMatch places the party's members still in queue together on a server with room for all
+// of them, issuing each a join token
+func joinPartyMatch(ctx context.Context, w http.ResponseWriter, partyID, region string, attempts int) {
+	p, err := parties.GetParty(ctx, partyID)
+
+	if err == errNotFound {
+		log.Errorf(ctx, "[JoinMatch] Party not found: %v", partyID)
+		return // Return 200 for the request to disregard it
+	} else if err != nil {
+		log.Errorf(ctx, "[JoinMatch] %v", err.Error())
+		http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+		return
+	}
+
+	if p.State != partyStateQueued {
+		return // Return 200 for the request to disregard it
+	}
+
+	// Slots reserved by an earlier attempt are not reserved again
+	if p.ServerID != "" {
+		joinPlacedParty(ctx, w, p)
+		return
+	}
+
+	mode := recordMode(p.Mode).Name
+
+	var members []mmUser
+
+	for _, memberID := range p.Members {
+		member, err := users.GetUserByID(ctx, memberID)
+
+		if err == errNotFound {
+			continue
+		} else if err != nil {
+			log.Errorf(ctx, "[JoinMatch] %v", err.Error())
+			http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+			return
+		}
+
+		// Members who dequeued or requeued on their own are left out
+		if member.PartyID == p.ID && member.MMStatus == mmStatusInQueue {
+			members = append(members, member)
+		}
+	}
+
+	if len(members) == 0 {
+		log.Infof(ctx, "[JoinMatch] Party %v has no members in queue", partyID)
+		updateParty(ctx, &p, partyStateCancelled)
+		return
+	}
+
+	if attempts > noServersRetryAttempts {
+		for _, member := range members {
+			member.MMStatus = mmStatusMatchmakingFailed
+
+			err = users.PutUser(ctx, member)
+			if err != nil {
+				log.Errorf(ctx, "[JoinMatch] %v", err.Error())
+				http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		updateParty(ctx, &p, partyStateFailed)
+		return
+	}
+
+	var server gameServer
+	var memberRatings []playerRating
+	partyRating := 0.0
+
+	if config.Matchmaking.Mode == matchmakingModeRating { // Match on the party's mean rating
+		total := 0.0
+
+		for _, member := range members {
+			rating, err := getPlayerRating(ctx, member.UserID)
+			if err != nil {
+				log.Errorf(ctx, "[JoinMatch] %v", err.Error())
+				http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+				return
+			}
+
+			memberRatings = append(memberRatings, rating)
+			total += rating.Rating
+		}
+
+		partyRating = total / float64(len(members))
+		server, err = findRatedServer(ctx, region, mode, len(members), partyRating, ratingWindow(p.UpdateTime, attempts))
+	} else {
+		server, err = findPartyServer(ctx, region, mode, len(members))
+	}
+
+	if err == errNotFound { // Spill into a fallback region every member can reach
+		var latencies []string
+		for _, member := range members {
+			latencies = append(latencies, member.Latencies)
+		}
+
+		server, err = findFallbackServer(ctx, region, mode, p.UpdateTime, latencies, partyRating, attempts)
+	}
+
+	if err == errNotFound {
+		log.Errorf(ctx, "[JoinMatch] No Available Servers for party %v of %v", partyID, len(members))
+		http.Error(w, "No Available Servers", http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		log.Errorf(ctx, "[JoinMatch] %v", err.Error())
+		http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+		return
+	}
+
+	if server.Region != region {
+		log.Infof(ctx, "[JoinMatch] Party %v falling back from %v to %v", partyID, region, server.Region)
+	}
+
+	var playerRatings []float64
+	for _, rating := range memberRatings {
+		playerRatings = append(playerRatings, rating.Rating)
+	}
+
+	reserved, err := reserveSlots(ctx, server.UUID, len(members), playerRatings)
+
+	if err == errServerFull || err == errNotFound {
+		log.Errorf(ctx, "[JoinMatch] Server %v no longer has room for party %v", server.UUID, partyID)
+		http.Error(w, "Server Full.", http.StatusInternalServerError)
+		return
+	} else if err != nil {
+		log.Errorf(ctx, "[JoinMatch] %v", err.Error())
+		http.Error(w, "[JoinMatch] Unexpected error.", http.StatusInternalServerError)
+		return
+	}
+
+	server = reserved
+
+	var placed []string
+	for _, member := range members {
+		placed = append(placed, member.UserID)
+	}
+
+	err = parties.UpdateParty(ctx, partyID, func(stored *party) error {
+		if stored.ServerID != "" {
+			return errPartyPlaced
+		}
+
+		stored.ServerID = server.UUID
+		stored.Placed = placed
+
+		p = *stored
+		return nil
+	})
+
+	if err != nil {
+		log.Errorf(ctx, "[JoinMatch] Recording party %v on server %v: %v", partyID, server.UUID, err.Error())
+
+		// Give the slots back for the next attempt to reserve
+		err = releaseSlots(ctx, server.UUID, len(members), playerRatings)
+		if err != nil {
+			log.Errorf(ctx, "[JoinMatch] %v", err.Error())
+		}
+
+		http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+		return
+	}
+
+	placePartyMembers(ctx, w, p, server, members)
+}
+
+// joinPlacedParty places the members still in queue onto the server an earlier attempt reserved
+// their slots on
+func joinPlacedParty(ctx context.Context, w http.ResponseWriter, p party) {
+	server, err := servers.GetServer(ctx, p.ServerID)
+
+	if err == errNotFound { // Expired since, so place the remaining members elsewhere
+		log.Errorf(ctx, "[JoinMatch] Server %v of party %v not found", p.ServerID, p.ID)
+
+		err = parties.UpdateParty(ctx, p.ID, func(stored *party) error {
+			stored.ServerID = ""
+			stored.Placed = nil
+			return nil
+		})
+		if err != nil {
+			log.Errorf(ctx, "[JoinMatch] %v", err.Error())
+		}
+
+		http.Error(w, "Server Not Found.", http.StatusInternalServerError)
+		return
+	} else if err != nil {
+		log.Errorf(ctx, "[JoinMatch] %v", err.Error())
+		http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+		return
+	}
+
+	var members []mmUser
+
+	for _, memberID := range p.Placed {
+		member, err := users.GetUserByID(ctx, memberID)
+
+		if err == errNotFound {
+			continue
+		} else if err != nil {
+			log.Errorf(ctx, "[JoinMatch] %v", err.Error())
+			http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+			return
+		}
+
+		if member.PartyID == p.ID && member.MMStatus == mmStatusInQueue {
+			members = append(members, member)
+		}
+	}
+
+	placePartyMembers(ctx, w, p, server, members)
+}
+
+// placePartyMembers gives each member a join to the server their slots were reserved on. Joins
+// saved by an earlier attempt are reused, so retrying leaves one join per member.
+func placePartyMembers(ctx context.Context, w http.ResponseWriter, p party, server gameServer, members []mmUser) {
+	serverJoins, err := joins.ListServerJoins(ctx, server.UUID)
+	if err != nil {
+		log.Errorf(ctx, "[JoinMatch] %v", err.Error())
+		http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+		return
+	}
+
+	partyJoins := map[string]joinRecord{} // By user ID
+	for _, join := range serverJoins {
+		if join.PartyID == p.ID {
+			partyJoins[join.UserID] = join
+		}
+	}
+
+	for _, member := range members {
+		join, found := partyJoins[member.UserID]
+
+		if !found {
+			joinTok, err := newJoinToken(member.UserID, server.UUID, server.Region)
+			if err != nil {
+				log.Errorf(ctx, "[JoinMatch] %v", err.Error())
+				http.Error(w, "[JoinMatch] Unexpected error.", http.StatusInternalServerError)
+				return
+			}
+
+			join = joinRecord{
+				UserID:       member.UserID,
+				ServerID:     server.UUID,
+				Region:       server.Region,
+				JoinToken:    joinTok,
+				PartyID:      p.ID,
+				CreationTime: time.Now(),
+				Checked:      false,
+			}
+
+			err = joins.PutJoin(ctx, join)
+			if err != nil {
+				log.Errorf(ctx, "[JoinMatch] %v", err.Error())
+				http.Error(w, "[JoinMatch] Unexpected error.", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		member.MMStatus = mmStatusJoinedMatch
+		member.JoinTok = join.JoinToken
+		member.ServerAddr = server.Address
+		member.ServerPort = server.Port
+		member.Region = server.Region
+
+		err = users.PutUser(ctx, member)
+		if err != nil {
+			log.Errorf(ctx, "[JoinMatch] %v", err.Error())
+			http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	updateParty(ctx, &p, partyStateMatched)
+
+	log.Infof(ctx, "[JoinMatch] Party %v (%v members) joined server %v (%v, %v)", p.ID, len(members), server.UUID, server.Address, server.Port)
+}
+
+// findPartyServer returns the active server of the mode in region with at least slots free places,
+// preferring the least filled server that already has players
+func findPartyServer(ctx context.Context, region, mode string, slots int) (found gameServer, err error) {
+	regionServers, err := servers.ListServers(ctx, region)
+
+	if err != nil {
+		return
+	}
+
+	err = errNotFound
+
+	for _, server := range regionServers {
+		if server.State != serverStateActive || server.Mode != mode || server.MaxPlayerCount-server.PlayerCount < slots {
+			continue
+		}
+
+		if err == nil {
+			foundEmpty := found.PlayerCount == 0
+			empty := server.PlayerCount == 0
+
+			if empty && !foundEmpty || (empty == foundEmpty && server.Fill >= found.Fill) {
+				continue
+			}
+		}
+
+		found = server
+		err = nil
+	}
+
+	return
+}
+
+func updateParty(ctx context.Context, p *party, state int) {
+	p.State = state
+	p.UpdateTime = time.Now()
+
+	err := parties.PutParty(ctx, *p)
+	if err != nil {
+		log.Errorf(ctx, "[JoinMatch] %v", err.Error())
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// putTestParty stores a queued party of memberIDs in region and its members in queue, returning
+// the party's join task
+func putTestParty(t *testing.T, partyID, region string, memberIDs ...string) recordedTask {
+	ctx := context.Background()
+
+	p := newParty(partyID, memberIDs[0], region, defaultModeName)
+	p.Members = memberIDs
+	p.State = partyStateQueued
+
+	err := parties.PutParty(ctx, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, memberID := range memberIDs {
+		err = users.PutUser(ctx, mmUser{UserID: memberID, MMTok: "tok-" + memberID, MMStatus: mmStatusInQueue, PartyID: partyID, Region: region, Mode: defaultModeName, CreationTime: time.Now(), CheckTime: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return recordedTask{Path: "/joinmatch", Params: url.Values{"partyID": {partyID}, "region": {region}, "mode": {defaultModeName}}}
+}
+
+// failingUserStore fails to save the user failUserID while it is set
+type failingUserStore struct {
+	*memoryUserStore
+	failUserID string
+}
+
+func (s *failingUserStore) PutUser(ctx context.Context, user mmUser) error {
+	if user.UserID == s.failUserID {
+		return errors.New("unavailable")
+	}
+
+	return s.memoryUserStore.PutUser(ctx, user)
+}
+
+// A retried party join reuses its reserved slots and the joins already saved
+func TestJoinPartyMatchRetried(t *testing.T) {
+	setupTestCoordinator(t, nil)
+	ctx := context.Background()
+
+	store := &failingUserStore{memoryUserStore: newMemoryUserStore()}
+	users = store
+
+	putTestServer(t, "s", "na", 0)
+	task := putTestParty(t, "party", "na", "test:dev/a", "test:dev/b", "test:dev/c")
+
+	store.failUserID = "test:dev/b"
+
+	if w := runTask(joinMatchHandler, task, 0); w.Code != 500 {
+		t.Fatalf("failed join status %v, want 500", w.Code)
+	}
+
+	store.failUserID = ""
+
+	if w := runTask(joinMatchHandler, task, 1); w.Code != 200 {
+		t.Fatalf("retried join status %v: %v", w.Code, w.Body.String())
+	}
+
+	server, err := servers.GetServer(ctx, "s")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if server.PlayerCount != 3 {
+		t.Errorf("server has %v players, want 3", server.PlayerCount)
+	}
+
+	serverJoins, err := joins.ListServerJoins(ctx, "s")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(serverJoins) != 3 {
+		t.Errorf("saved %v joins, want 3", len(serverJoins))
+	}
+
+	for _, memberID := range []string{"test:dev/a", "test:dev/b", "test:dev/c"} {
+		member, err := users.GetUserByID(ctx, memberID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		join, err := getTestJoin(member.JoinTok)
+		if err != nil {
+			t.Fatalf("%v has no join: %v", memberID, err)
+		}
+
+		if member.MMStatus != mmStatusJoinedMatch || join.ServerID != "s" {
+			t.Errorf("member %v status %v on %v, want joined to s", memberID, member.MMStatus, join.ServerID)
+		}
+	}
+
+	p, err := parties.GetParty(ctx, "party")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.State != partyStateMatched {
+		t.Errorf("party state %v, want matched", p.State)
+	}
+}
+
+func TestJoinPartyMatch(t *testing.T) {
+	type testServer struct {
+		id          string
+		playerCount int
+	}
+
+	tests := []struct {
+		name     string
+		servers  []testServer
+		dequeued string // Member who left the queue before the party was placed
+		status   int
+		joined   string
+		placed   int // Members placed
+	}{
+		{name: "places the party on a server with room for all", servers: []testServer{{"a", 8}, {"b", 5}}, status: 200, joined: "b", placed: 3},
+		{name: "fills a server with players before an empty one", servers: []testServer{{"a", 0}, {"b", 7}}, status: 200, joined: "b", placed: 3},
+		{name: "does not split the party", servers: []testServer{{"a", 8}, {"b", 9}}, status: 503},
+		{name: "leaves out members no longer in queue", servers: []testServer{{"a", 8}}, dequeued: "test:dev/c", status: 200, joined: "a", placed: 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupTestCoordinator(t, nil)
+			ctx := context.Background()
+
+			for _, s := range test.servers {
+				putTestServer(t, s.id, "na", s.playerCount)
+			}
+
+			members := []string{"test:dev/a", "test:dev/b", "test:dev/c"}
+			task := putTestParty(t, "party", "na", members...)
+
+			if test.dequeued != "" {
+				user, _ := users.GetUserByID(ctx, test.dequeued)
+				user.MMStatus = mmStatusMatchmakingCancelled
+				users.PutUser(ctx, user)
+			}
+
+			if w := runTask(joinMatchHandler, task, 0); w.Code != test.status {
+				t.Fatalf("status %v, want %v: %v", w.Code, test.status, w.Body.String())
+			}
+
+			placed := 0
+
+			for _, memberID := range members {
+				member, err := users.GetUserByID(ctx, memberID)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if member.MMStatus != mmStatusJoinedMatch {
+					continue
+				}
+
+				placed++
+
+				join, err := getTestJoin(member.JoinTok)
+				if err != nil || join.ServerID != test.joined {
+					t.Errorf("member %v joined %+v, want %v: %v", memberID, join, test.joined, err)
+				}
+			}
+
+			if placed != test.placed {
+				t.Errorf("placed %v members, want %v", placed, test.placed)
+			}
+
+			for _, s := range test.servers {
+				server, err := servers.GetServer(ctx, s.id)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				want := s.playerCount
+				if s.id == test.joined {
+					want += test.placed
+				}
+
+				if server.PlayerCount != want {
+					t.Errorf("server %v has %v players, want %v", s.id, server.PlayerCount, want)
+				}
+			}
+		})
+	}
+}
+
+// A party formed through /enqueue and started by its leader lands on one server
+func TestStartPartyHandler(t *testing.T) {
+	recorder := setupTestCoordinator(t, nil)
+	ctx := context.Background()
+
+	putTestServer(t, "a", "na", 9)
+	putTestServer(t, "b", "na", 6)
+
+	enqueue := func(userID, params string) mmEnqueue {
+		w := httptest.NewRecorder()
+		enqueueHandler(w, httptest.NewRequest("GET", "/enqueue?Platform=test&UserID="+userID+"&AuthToken="+testToken+"&Region=na&"+params, nil))
+
+		if w.Code != 200 {
+			t.Fatalf("enqueue status %v: %v", w.Code, w.Body.String())
+		}
+
+		var response mmEnqueue
+
+		err := json.Unmarshal(w.Body.Bytes(), &response)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return response
+	}
+
+	start := func(session mmEnqueue) int {
+		req := httptest.NewRequest("GET", "/startparty", nil)
+		req.Header.Set("Authorization", "Bearer "+session.SessionToken)
+
+		w := httptest.NewRecorder()
+		startPartyHandler(w, req)
+
+		return w.Code
+	}
+
+	leader := enqueue("a", "CreateParty=true")
+	member := enqueue("b", "PartyID="+leader.PartyID)
+
+	if status := start(member); status != 403 {
+		t.Fatalf("member start status %v, want 403", status)
+	}
+
+	if status := start(leader); status != 200 {
+		t.Fatalf("leader start status %v", status)
+	}
+
+	queued := recorder.withPath("/joinmatch")
+	if len(queued) != 1 || queued[0].Params.Get("partyID") != leader.PartyID {
+		t.Fatalf("join tasks %+v, want one for party %v", queued, leader.PartyID)
+	}
+
+	if w := runTask(joinMatchHandler, queued[0], 0); w.Code != 200 {
+		t.Fatalf("join status %v: %v", w.Code, w.Body.String())
+	}
+
+	for _, session := range []mmEnqueue{leader, member} {
+		user, err := users.GetUserByToken(ctx, session.QueryToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		join, err := getTestJoin(user.JoinTok)
+		if err != nil || join.ServerID != "b" {
+			t.Errorf("user %v joined %+v, want b: %v", user.UserID, join, err)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	reconcileSuspectKey           = "Reconcile-Suspect-"
+	reconcileSuspectExpiryMinutes = 40 // Covers two runs of the 15 minute cron job
+)
+
+const (
+	discrepancyOrphanAllocation = "orphan-allocation" // Allocated by the provider without a GameServer record
+	discrepancyPhantomServer    = "phantom-server"    // GameServer record without a provider allocation
+)
+
+type reconcileEntry struct {
+	ServerID    string
+	Region      string
+	Discrepancy string
+	Action      string
+	Result      string
+}
+
+// reconcileHandler compares the provider's allocations against GameServer records, deallocating
+// orphaned allocations and removing phantom records. A discrepancy is only fixed once it has been
+// seen on two consecutive runs, so allocations and expirations in flight are left alone.
+func reconcileHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(r)
+
+	log.Infof(ctx, "[Reconcile] Running Reconciliation...")
+
+	providerAllocs, err := provider.ListAllocations(ctx)
+
+	if err != nil {
+		log.Errorf(ctx, "[Reconcile] %v", err.Error())
+		http.Error(w, "Internal error.", http.StatusInternalServerError)
+		return
+	}
+
+	allocated := make(map[string]allocationsResponseInfo)
+
+	for _, info := range providerAllocs {
+		allocated[info.UUID] = info
+	}
+
+	recorded := make(map[string]gameServer)
+
+	for _, region := range config.Regions {
+		regionServers, err := servers.ListServers(ctx, region.Name)
+
+		if err != nil {
+			log.Errorf(ctx, "[Reconcile] %v", err.Error())
+			http.Error(w, "Internal error.", http.StatusInternalServerError)
+			return
+		}
+
+		for _, server := range regionServers {
+			if !server.Static {
+				recorded[server.UUID] = server
+			}
+		}
+	}
+
+	var report []reconcileEntry
+
+	for serverID, info := range allocated {
+		if _, ok := recorded[serverID]; ok {
+			continue
+		}
+
+		alloc, err := allocations.GetAllocation(ctx, serverID)
+
+		if err != nil && err != errNotFound {
+			log.Errorf(ctx, "[Reconcile] %v", err.Error())
+			continue
+		} else if err == nil && alloc.open() {
+			continue // Still being set up
+		}
+
+		if !confirmDiscrepancy(ctx, serverID) {
+			continue
+		}
+
+		entry := reconcileEntry{ServerID: serverID, Region: info.Regions, Discrepancy: discrepancyOrphanAllocation, Action: "deallocate"}
+
+		err = addTask(ctx, "/dealloc", map[string][]string{"serverID": {serverID}}, 0, "coordinator-deallocate")
+		entry.Result = reconcileResult(err)
+
+		report = append(report, entry)
+	}
+
+	for serverID, server := range recorded {
+		if _, ok := allocated[serverID]; ok {
+			continue
+		}
+
+		if !confirmDiscrepancy(ctx, serverID) {
+			continue
+		}
+
+		entry := reconcileEntry{ServerID: serverID, Region: server.Region, Discrepancy: discrepancyPhantomServer, Action: "remove record"}
+
+		err := servers.DeleteServers(ctx, []string{serverID})
+
+		if err == nil {
+			err = releaseMissingAllocation(ctx, serverID)
+		}
+
+		entry.Result = reconcileResult(err)
+
+		report = append(report, entry)
+	}
+
+	for _, entry := range report {
+		log.Infof(ctx, "[Reconcile] %v %v in region %v: %v (%v)", entry.Discrepancy, entry.ServerID, entry.Region, entry.Action, entry.Result)
+	}
+
+	log.Infof(ctx, "[Reconcile] %v allocations, %v server records, %v discrepancies fixed", len(allocated), len(recorded), len(report))
+
+	if len(report) == 0 {
+		return
+	}
+
+	err = storeReconcileReport(ctx, report)
+
+	if err != nil {
+		log.Errorf(ctx, "[Reconcile] %v", err.Error())
+	}
+}
+
+// confirmDiscrepancy records serverID as suspect, returning true if it was already suspect from the previous run
+func confirmDiscrepancy(ctx context.Context, serverID string) bool {
+	key := reconcileSuspectKey + serverID
+
+	_, err := cache.Get(ctx, key)
+
+	if err == nil {
+		cache.Delete(ctx, key)
+		return true
+	}
+
+	if err != errCacheMiss {
+		log.Errorf(ctx, "[Reconcile] %v", err.Error())
+	}
+
+	err = cache.Set(ctx, key, []byte(time.Now().Format(time.RFC3339)), time.Minute*reconcileSuspectExpiryMinutes)
+
+	if err != nil {
+		log.Errorf(ctx, "[Reconcile] %v", err.Error())
+	}
+
+	log.Infof(ctx, "[Reconcile] Server %v does not match its allocation, will fix if still mismatched next run", serverID)
+
+	return false
+}
+
+// releaseMissingAllocation marks the allocation record of a server the provider no longer has as released
+func releaseMissingAllocation(ctx context.Context, serverID string) error {
+	alloc, err := allocations.GetAllocation(ctx, serverID)
+
+	if err == errNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if alloc.State == allocationStateReleased {
+		return nil
+	}
+
+	alloc.Error = "missing from provider"
+
+	return updateAllocation(ctx, &alloc, allocationStateReleased)
+}
+
+func reconcileResult(err error) string {
+	if err != nil {
+		return "failed: " + err.Error()
+	}
+
+	return "ok"
+}
+
+func storeReconcileReport(ctx context.Context, report []reconcileEntry) error {
+	timestamp := time.Now()
+
+	buffer := &bytes.Buffer{}
+	w := csv.NewWriter(buffer)
+
+	w.Write([]string{"Timestamp", "ServerID", "Region", "Discrepancy", "Action", "Result"})
+
+	for _, entry := range report {
+		w.Write([]string{fmt.Sprint(timestamp.Unix()), entry.ServerID, entry.Region, entry.Discrepancy, entry.Action, entry.Result})
+	}
+
+	w.Flush()
+
+	fileName := fmt.Sprintf("reports/reconcile/%v.csv", timestamp.Format("20060102150405"))
+
+	return storeCSV(ctx, fileName, buffer.Bytes())
+}
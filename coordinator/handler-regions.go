@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+type regionInfo struct {
+	Name      string
+	Beacon    string `json:",omitempty"` // host:port of the region's UDP ping beacon
+	LatencyMS int    `json:",omitempty"`
+}
+
+// regionsHandler lists the matchmaking regions clients can queue in and their ping beacons. Given
+// Latencies, as on /enqueue, it instead ranks them within matchmaking.max_latency_ms, best first.
+func regionsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(r)
+
+	if r.Method != "GET" {
+		log.Errorf(ctx, "[Regions] Invalid request method %v", r.Method)
+		http.Error(w, "Invalid Request.", http.StatusBadRequest)
+		return
+	}
+
+	infos := []regionInfo{}
+
+	if latenciesParam := r.URL.Query().Get("Latencies"); latenciesParam != "" {
+		latencies, err := parseLatencies(latenciesParam)
+
+		if err != nil {
+			http.Error(w, "Invalid Latencies.", http.StatusBadRequest)
+			return
+		}
+
+		for _, latency := range rankRegions(latencies) {
+			region, _ := findRegion(latency.Region)
+			infos = append(infos, regionInfo{Name: region.Name, Beacon: region.Beacon, LatencyMS: latency.LatencyMS})
+		}
+	} else {
+		for _, region := range config.Regions {
+			if !region.VACPool {
+				infos = append(infos, regionInfo{Name: region.Name, Beacon: region.Beacon})
+			}
+		}
+	}
+
+	response, err := json.Marshal(infos)
+
+	if err != nil {
+		log.Errorf(ctx, "[Regions] %v", err.Error())
+		http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(response)
+}
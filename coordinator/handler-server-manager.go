@@ -5,28 +5,18 @@ import (
 	"math"
 	"net/http"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/gofrs/uuid"
-	"google.golang.org/appengine"
-	"google.golang.org/appengine/datastore"
-	"google.golang.org/appengine/log"
-	"google.golang.org/appengine/memcache"
-	"google.golang.org/appengine/taskqueue"
 )
 
 const (
 	serverFullThreshold             = 0.8
-	allocateNewServerThreshold      = 0.75
 	serverTimeoutExpirationDuration = 60
 	serverAgeExpirationDuration     = 60
-	activeAllocationsKey            = "ServerManager-ActiveAllocations"
-	defaultMaxPlayers               = 64
 	serverInitDelaySeconds          = 10
 	maxAllocateAttempts             = 4
 	maxAllocationCheckAttempts      = 4
-	maxServersPerRegion             = 10
 )
 
 type gameServerReport struct {
@@ -34,10 +24,12 @@ type gameServerReport struct {
 	State   int
 	Full    bool
 	Expired bool
+	Static  bool
 }
 
 type serverStats struct {
 	Region              string
+	Mode                string
 	Timestamp           time.Time
 	TotalServers        int
 	TotalCurrentPlayers int
@@ -45,27 +37,31 @@ type serverStats struct {
 }
 
 func manageServersHandler(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
+	ctx := newContext(r)
 
 	c := make(chan int)
 
-	go manageRegionServers(ctx, naRegionName, c)
-	go manageRegionServers(ctx, euRegionName, c)
+	for _, region := range config.Regions {
+		for _, mode := range config.Modes {
+			go manageRegionServers(ctx, region.Name, mode.Name, c)
+		}
+	}
 
-	<-c
-	<-c
+	for range config.Regions {
+		for range config.Modes {
+			<-c
+		}
+	}
 }
 
-func manageRegionServers(ctx context.Context, region string, completeChan chan int) {
-	log.Infof(ctx, "[Manage] Managing region %v servers", region)
+// manageRegionServers expires and allocates the servers of one mode in a region
+func manageRegionServers(ctx context.Context, region, mode string, completeChan chan int) {
+	log.Infof(ctx, "[Manage] Managing region %v mode %v servers", region, mode)
 
-	keys := make(map[string]*datastore.Key)
+	regionSettings, _ := findRegion(region)
+	modeSettings := recordMode(mode)
 
-	var server gameServer
-
-	q := datastore.NewQuery("GameServer").Filter("Region =", region)
-
-	serverCount, err := q.Count(ctx)
+	allServers, err := servers.ListServers(ctx, region)
 
 	if err != nil {
 		log.Errorf(ctx, "[Manage] %v", err.Error())
@@ -73,27 +69,22 @@ func manageRegionServers(ctx context.Context, region string, completeChan chan i
 		return
 	}
 
-	stats := serverStats{Region: region, Timestamp: time.Now()}
-	reports := make([]gameServerReport, serverCount)
-	i := 0
+	var regionServers []gameServer
 
-	for t := q.Run(ctx); ; {
-		key, err := t.Next(&server)
-		if err == datastore.Done {
-			break
-		}
-		if err != nil {
-			log.Errorf(ctx, "[Manage] %v", err.Error())
-			completeChan <- 0
-			return
+	for _, server := range allServers {
+		if recordMode(server.Mode).Name == mode {
+			regionServers = append(regionServers, server)
 		}
+	}
 
+	stats := serverStats{Region: region, Mode: mode, Timestamp: time.Now()}
+	reports := make([]gameServerReport, len(regionServers))
+
+	for i, server := range regionServers {
 		stats.TotalServers++
 		stats.TotalCurrentPlayers += server.PlayerCount
 		stats.TotalMaxPlayers += server.MaxPlayerCount
 
-		keys[server.UUID] = key // Store mapping of UUID to datastore key for later update
-
 		timeDelta := time.Now().Sub(server.CheckTime)
 		timedOut := timeDelta.Seconds() > serverTimeoutExpirationDuration
 
@@ -105,16 +96,16 @@ func manageRegionServers(ctx context.Context, region string, completeChan chan i
 		reports[i] = gameServerReport{
 			UUID:    server.UUID,
 			State:   server.State,
-			Full:    server.Fill >= serverFullThreshold,
+			Full:    float64(server.Fill) >= modeSettings.FullThreshold,
 			Expired: expired,
+			Static:  server.Static,
 		}
-
-		i++
 	}
 
-	_, err = datastore.Put(ctx, datastore.NewIncompleteKey(ctx, "ServerStats", nil), &stats)
+	err = servers.PutServerStats(ctx, stats)
 	if err != nil {
 		log.Errorf(ctx, "[Manage] %v", err.Error())
+		completeChan <- 0
 		return
 	}
 
@@ -122,18 +113,23 @@ func manageRegionServers(ctx context.Context, region string, completeChan chan i
 
 	fullServerCount := 0
 	activeServerCount := 0
+	allocatedServerCount := 0
 
-	var expiredServerKeys []*datastore.Key
+	var expiredServerIDs []string
 
 	for _, report := range reports {
 		if report.Expired {
 			log.Infof(ctx, "[Manage] Scheduling expiration of server %v", report.UUID)
-			expiredServerKeys = append(expiredServerKeys, keys[report.UUID])
+			expiredServerIDs = append(expiredServerIDs, report.UUID)
+
+			if report.Static {
+				continue
+			}
 
-			t := taskqueue.NewPOSTTask("/dealloc", map[string][]string{"serverID": {report.UUID}})
-			_, err := taskqueue.Add(ctx, t, "coordinator-deallocate")
+			err := addTask(ctx, "/dealloc", map[string][]string{"serverID": {report.UUID}}, 0, "coordinator-deallocate")
 			if err != nil {
 				log.Errorf(ctx, "[Manage] %v", err.Error())
+				completeChan <- 0
 				return
 			}
 		} else if report.State == serverStateInitializing || report.State == serverStateActive {
@@ -143,12 +139,16 @@ func manageRegionServers(ctx context.Context, region string, completeChan chan i
 			} else {
 				activeServerCount++
 			}
+
+			if !report.Static {
+				allocatedServerCount++
+			}
 		}
 	}
 
 	// Remove all GameServer records that are expired
 
-	err = datastore.DeleteMulti(ctx, expiredServerKeys)
+	err = servers.DeleteServers(ctx, expiredServerIDs)
 
 	if err != nil {
 		log.Errorf(ctx, "[Manage] %v", err.Error())
@@ -158,9 +158,9 @@ func manageRegionServers(ctx context.Context, region string, completeChan chan i
 
 	// Perform allocation requests
 
-	activeAllocsItem, err := memcache.Get(ctx, activeAllocationsKey+region)
+	openAllocs, err := allocations.ListOpenAllocations(ctx, region)
 
-	if err != nil && err != memcache.ErrCacheMiss {
+	if err != nil {
 		log.Errorf(ctx, "[Manage] %v", err.Error())
 		completeChan <- 0
 		return
@@ -168,14 +168,10 @@ func manageRegionServers(ctx context.Context, region string, completeChan chan i
 
 	activeAllocs := 0
 
-	if err == nil { // Found ActiveAllocations in cache
-		parsedAllocs, err := strconv.Atoi(string(activeAllocsItem.Value))
-		if err != nil {
-			log.Errorf(ctx, "[Manage] %v", err.Error())
-			completeChan <- 0
-			return
+	for _, alloc := range openAllocs {
+		if recordMode(alloc.Mode).Name == mode {
+			activeAllocs++
 		}
-		activeAllocs = parsedAllocs
 	}
 
 	fullServersRatio := float64(fullServerCount) / float64(activeServerCount+activeAllocs)
@@ -184,28 +180,46 @@ func manageRegionServers(ctx context.Context, region string, completeChan chan i
 		fullServersRatio = 0
 	}
 
-	log.Infof(ctx, "[Manage] Region %v Server Fill Stats (Full/Partial/Allocating/Total - Fill Ratio): %v/%v/%v/%v - %.f",
-		region, fullServerCount, activeServerCount-fullServerCount, activeAllocs, activeServerCount+activeAllocs, fullServersRatio)
+	log.Infof(ctx, "[Manage] Region %v Mode %v Server Fill Stats (Full/Partial/Allocating/Total - Fill Ratio): %v/%v/%v/%v - %.f",
+		region, mode, fullServerCount, activeServerCount-fullServerCount, activeAllocs, activeServerCount+activeAllocs, fullServersRatio)
+
+	maxServers, allocateThreshold := modeSettings.regionLimits(regionSettings)
+	belowMinimum := allocatedServerCount+activeAllocs < modeSettings.MinServers
+
+	if activeServerCount == 0 || fullServersRatio > allocateThreshold || belowMinimum {
+		if allocatedServerCount+activeAllocs >= maxServers {
+			log.Infof(ctx, "[Manage] Max Servers In %v for %v Reached, stopping allocation.", region, mode)
+			completeChan <- 1
+			return
+		}
 
-	if activeServerCount == 0 || fullServersRatio > allocateNewServerThreshold {
-		if activeServerCount >= maxServersPerRegion {
-			log.Infof(ctx, "[Manage] Max Servers In %v Reached, stopping allocation.", region)
+		if !providerAvailable(ctx) {
+			log.Warningf(ctx, "[Manage] Server provider is failing, pausing allocation in %v.", region)
+			completeChan <- 1
 			return
 		}
 
-		log.Infof(ctx, "[Manage] Scheduling new server for allocation")
+		alloc := newAllocation(uuid.Must(uuid.NewV4()).String(), region, mode)
 
-		t := taskqueue.NewPOSTTask("/alloc", map[string][]string{"region": {region}})
-		_, err := taskqueue.Add(ctx, t, "coordinator-allocate")
+		log.Infof(ctx, "[Manage] Scheduling new server %v for allocation", alloc.ServerID)
+
+		err := allocations.PutAllocation(ctx, alloc)
 		if err != nil {
 			log.Errorf(ctx, "[Manage] %v", err.Error())
 			completeChan <- 0
 			return
 		}
 
-		_, err = memcache.Increment(ctx, activeAllocationsKey+region, 1, 0)
+		err = addTask(ctx, "/alloc", map[string][]string{"serverID": {alloc.ServerID}, "region": {region}, "mode": {mode}}, 0, "coordinator-allocate")
 		if err != nil {
 			log.Errorf(ctx, "[Manage] %v", err.Error())
+
+			alloc.Error = err.Error()
+			err = updateAllocation(ctx, &alloc, allocationStateFailed)
+			if err != nil {
+				log.Errorf(ctx, "[Manage] %v", err.Error())
+			}
+
 			completeChan <- 0
 			return
 		}
@@ -215,14 +229,13 @@ func manageRegionServers(ctx context.Context, region string, completeChan chan i
 }
 
 func allocateServerHandler(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
-
-	var err error
+	ctx := newContext(r)
 
+	serverID := r.FormValue("serverID")
 	region := r.FormValue("region")
-	regionID := getRegionID(region)
+	mode := r.FormValue("mode")
 
-	attemptsHeader := r.Header.Get("X-AppEngine-TaskRetryCount")
+	attemptsHeader := r.Header.Get(taskRetryCountHeader)
 	attempts, err := strconv.Atoi(attemptsHeader)
 
 	if err != nil {
@@ -231,43 +244,66 @@ func allocateServerHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if attempts > maxAllocateAttempts {
-		log.Infof(ctx, "[Alloc] Allocate max attempts reached for region %v...", region)
+	alloc, err := allocations.GetAllocation(ctx, serverID)
 
-		_, err = memcache.Increment(ctx, activeAllocationsKey+region, -1, 1)
-		if err != nil {
-			log.Errorf(ctx, "[Alloc] %v", err.Error())
-			http.Error(w, "Internal error.", http.StatusInternalServerError)
-			return
+	if err == errNotFound {
+		// Tasks scheduled before allocation records were kept only carry the region
+		if serverID == "" {
+			serverID = uuid.Must(uuid.NewV4()).String()
 		}
+
+		alloc = newAllocation(serverID, region, mode)
+	} else if err != nil {
+		log.Errorf(ctx, "[Alloc] %v", err.Error())
+		http.Error(w, "Internal error.", http.StatusInternalServerError)
+		return
 	}
 
-	serverID := uuid.Must(uuid.NewV4()).String()
+	if alloc.State != allocationStateRequested {
+		log.Infof(ctx, "[Alloc] Allocation %v is already %v", serverID, allocationStateName(alloc.State))
+		return
+	}
 
-	log.Infof(ctx, "[Alloc] Allocating server %v in region %v...", serverID, region)
+	alloc.AllocateAttempts = attempts + 1
 
-	var allocResponse allocateResponse
+	mode = recordMode(alloc.Mode).Name
 
-	if appengine.IsDevAppServer() { // Don't call ClanForge in testing
-		allocResponse = allocateResponse{Success: true}
-		err = nil
-	} else { // Request server from Multiplay (ClanForge)
-		allocResponse, err = queryClanForgeAlloc(ctx, serverID, defaultProfileID, regionID)
-	}
+	log.Infof(ctx, "[Alloc] Allocating server %v in region %v for mode %v...", serverID, region, mode)
+
+	err = provider.Allocate(ctx, serverID, region, mode)
 
 	if err != nil {
-		log.Errorf(ctx, "[Alloc] %v", err.Error())
+		log.Errorf(ctx, "[Alloc] Allocation Failed: %v", err.Error())
+
+		alloc.Error = err.Error()
+
+		if isPermanentProviderError(err) || alloc.AllocateAttempts > maxAllocateAttempts {
+			log.Infof(ctx, "[Alloc] Giving up allocation in region %v after %v attempts...", region, alloc.AllocateAttempts)
+
+			err = updateAllocation(ctx, &alloc, allocationStateFailed)
+			if err != nil {
+				log.Errorf(ctx, "[Alloc] %v", err.Error())
+			}
+			return
+		}
+
+		err = allocations.PutAllocation(ctx, alloc)
+		if err != nil {
+			log.Errorf(ctx, "[Alloc] %v", err.Error())
+		}
+
+		http.Error(w, "Internal error.", http.StatusInternalServerError)
 		return
 	}
 
-	if !allocResponse.Success {
-		log.Errorf(ctx, "[Alloc] Allocation Failed: %v", strings.Join(allocResponse.Messages[:], ","))
-		return
+	alloc.Error = ""
+
+	err = updateAllocation(ctx, &alloc, allocationStatePending)
+	if err != nil {
+		log.Errorf(ctx, "[Alloc] %v", err.Error())
 	}
 
-	t := taskqueue.NewPOSTTask("/allocation", map[string][]string{"serverID": {serverID}, "region": {region}})
-	t.Delay = time.Second * serverInitDelaySeconds
-	_, err = taskqueue.Add(ctx, t, "coordinator-allocations")
+	err = addTask(ctx, "/allocation", map[string][]string{"serverID": {serverID}, "region": {region}, "mode": {mode}}, time.Second*serverInitDelaySeconds, "coordinator-allocations")
 	if err != nil {
 		log.Errorf(ctx, "[Alloc] %v", err.Error())
 		return
@@ -277,126 +313,154 @@ func allocateServerHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func allocationsServerHandler(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
+	ctx := newContext(r)
 
 	serverID := r.FormValue("serverID")
 	region := r.FormValue("region")
 
-	log.Infof(ctx, "[Allocation] Checking server allocation %v...", serverID)
+	attemptsHeader := r.Header.Get(taskRetryCountHeader)
+	attempts, err := strconv.Atoi(attemptsHeader)
 
-	var allocationResponse allocationsResponse
-	var err error
-
-	if appengine.IsDevAppServer() { // Don't call ClanForge in testing
-		allocationResponse = allocationsResponse{
-			Allocations: []allocationsResponseInfo{
-				allocationsResponseInfo{
-					IP:       "127.0.0.1",
-					GamePort: 7777,
-				},
-			},
-			Success: true,
-		}
-		err = nil
-	} else {
-		allocationResponse, err = queryClanForgeAllocations(ctx, serverID)
+	if err != nil {
+		log.Errorf(ctx, "[Allocation] %v", err.Error())
+		http.Error(w, "Internal error.", http.StatusInternalServerError)
+		return
 	}
 
-	if err != nil {
+	alloc, err := allocations.GetAllocation(ctx, serverID)
+
+	if err == errNotFound {
+		alloc = newAllocation(serverID, region, r.FormValue("mode"))
+		alloc.State = allocationStatePending
+	} else if err != nil {
 		log.Errorf(ctx, "[Allocation] %v", err.Error())
+		http.Error(w, "Internal error.", http.StatusInternalServerError)
 		return
 	}
 
-	if !allocationResponse.Success {
-		log.Errorf(ctx, "[Allocation] Allocation Failed: %v", strings.Join(allocationResponse.Messages[:], ","))
+	if alloc.State != allocationStatePending {
+		log.Infof(ctx, "[Allocation] Allocation %v is already %v", serverID, allocationStateName(alloc.State))
 		return
 	}
 
-	info := allocationResponse.Allocations[0]
+	alloc.CheckAttempts = attempts + 1
 
-	if info.IP == "" || info.GamePort == 0 {
-		log.Errorf(ctx, "[Allocation] Allocation not ready: %v", serverID)
+	log.Infof(ctx, "[Allocation] Checking server allocation %v...", serverID)
 
-		attemptsHeader := r.Header.Get("X-AppEngine-TaskRetryCount")
-		attempts, err := strconv.Atoi(attemptsHeader)
+	info, err := provider.GetAllocation(ctx, serverID)
 
+	if err != nil || info.IP == "" || info.GamePort == 0 {
 		if err != nil {
-			log.Errorf(ctx, "[Allocation] %v", err.Error())
-			http.Error(w, "Internal error.", http.StatusInternalServerError)
-			return
+			log.Errorf(ctx, "[Allocation] Allocation check failed: %v", err.Error())
+			alloc.Error = err.Error()
+		} else {
+			log.Errorf(ctx, "[Allocation] Allocation not ready: %v", serverID)
+			alloc.Error = "allocation not ready"
 		}
 
-		if attempts >= maxAllocationCheckAttempts {
+		if alloc.CheckAttempts > maxAllocationCheckAttempts {
 			log.Errorf(ctx, "[Allocation] Allocation check max attempts reached, deallocating server: %v", serverID)
 
-			t := taskqueue.NewPOSTTask("/dealloc", map[string][]string{"serverID": {serverID}})
-			_, err := taskqueue.Add(ctx, t, "coordinator-deallocate")
+			err := addTask(ctx, "/dealloc", map[string][]string{"serverID": {serverID}}, 0, "coordinator-deallocate")
 			if err != nil {
-				log.Errorf(ctx, "[Manage] %v", err.Error())
+				log.Errorf(ctx, "[Allocation] %v", err.Error())
 				http.Error(w, "Internal error.", http.StatusInternalServerError)
 				return
 			}
 
-			_, err = memcache.Increment(ctx, activeAllocationsKey+region, -1, 1)
+			err = updateAllocation(ctx, &alloc, allocationStateFailed)
 			if err != nil {
 				log.Errorf(ctx, "[Allocation] %v", err.Error())
-				http.Error(w, "Internal error.", http.StatusInternalServerError)
-				return
 			}
+			return
+		}
+
+		err = allocations.PutAllocation(ctx, alloc)
+		if err != nil {
+			log.Errorf(ctx, "[Allocation] %v", err.Error())
 		}
 
 		http.Error(w, "Internal error.", http.StatusInternalServerError)
 		return
 	}
 
+	modeSettings := recordMode(alloc.Mode)
+
 	server := gameServer{
 		UUID:           serverID,
 		Address:        info.IP,
 		Port:           info.GamePort,
 		Region:         region,
+		Mode:           modeSettings.Name,
 		State:          serverStateInitializing,
 		CreationTime:   time.Now(),
 		CheckTime:      time.Now(),
 		PlayerCount:    0,
-		MaxPlayerCount: defaultMaxPlayers,
+		MaxPlayerCount: modeSettings.MaxPlayers,
 		Fill:           0,
 	}
 
-	_, err = datastore.Put(ctx, datastore.NewIncompleteKey(ctx, "GameServer", nil), &server)
+	err = servers.PutServer(ctx, server)
 	if err != nil {
 		log.Errorf(ctx, "[Allocation] %v", err.Error())
+		http.Error(w, "Internal error.", http.StatusInternalServerError)
 		return
 	}
 
-	_, err = memcache.Increment(ctx, activeAllocationsKey+region, -1, 1)
+	alloc.Error = ""
+
+	err = updateAllocation(ctx, &alloc, allocationStateFulfilled)
 	if err != nil {
 		log.Errorf(ctx, "[Allocation] %v", err.Error())
-		http.Error(w, "Internal error.", http.StatusInternalServerError)
-		return
 	}
 
 	log.Infof(ctx, "[Allocation] Confirmed new server %v (%v, %v) in region  %v", server.UUID, server.Address, server.Port, region)
 }
 
 func deallocateServerHandler(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
+	ctx := newContext(r)
 
 	serverID := r.FormValue("serverID")
 
 	log.Infof(ctx, "[Dealloc] Deallocating server %v...", serverID)
 
-	var deallocResponse deallocateResponse
-	var err error
-
-	if appengine.IsDevAppServer() { // Don't call ClanForge in testing
-		deallocResponse = deallocateResponse{UUID: serverID}
-	} else {
-		deallocResponse, err = queryClanForgeDealloc(ctx, serverID)
+	if !providerAvailable(ctx) {
+		log.Warningf(ctx, "[Dealloc] Server provider is failing, retrying deallocation of %v later.", serverID)
+		http.Error(w, "Internal error.", http.StatusInternalServerError)
+		return
 	}
 
+	err := provider.Deallocate(ctx, serverID)
+
 	if err != nil {
 		log.Errorf(ctx, "[Dealloc] %v", err.Error())
-	} else if deallocResponse.UUID == "" {
-		log.Infof(ctx, "[Dealloc] Deallocated server %v", serverID)
+
+		// Leave deallocations the provider refused to reconciliation, and retry the rest
+		if !isPermanentProviderError(err) {
+			http.Error(w, "Internal error.", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	log.Infof(ctx, "[Dealloc] Deallocated server %v", serverID)
+
+	alloc, err := allocations.GetAllocation(ctx, serverID)
+
+	if err == nil && alloc.State != allocationStateReleased {
+		err = updateAllocation(ctx, &alloc, allocationStateReleased)
+	}
+
+	if err != nil && err != errNotFound {
+		log.Errorf(ctx, "[Dealloc] %v", err.Error())
 	}
 }
+
+// updateAllocation moves alloc to state and saves it
+func updateAllocation(ctx context.Context, alloc *allocation, state int) error {
+	err := alloc.transition(state)
+	if err != nil {
+		return err
+	}
+
+	return allocations.PutAllocation(ctx, *alloc)
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestManageRegionServers(t *testing.T) {
+	type testServer struct {
+		id          string
+		playerCount int
+		static      bool
+		silent      time.Duration // Since the last heartbeat
+	}
+
+	tests := []struct {
+		name        string
+		servers     []testServer
+		openAllocs  int
+		maxServers  int // Of the region, 0 for the servers default
+		minServers  int // Of the mode
+		allocations int // Newly requested
+		expired     []string
+	}{
+		{name: "allocates a first server", allocations: 1},
+		{name: "waits while servers have room", servers: []testServer{{"a", 9, false, 0}, {"b", 2, false, 0}}},
+		{name: "allocates once most servers are full", servers: []testServer{{"a", 10, false, 0}, {"b", 9, false, 0}}, allocations: 1},
+		{name: "counts open allocations as servers with room", servers: []testServer{{"a", 10, false, 0}}, openAllocs: 1},
+		{name: "stops at the region's max servers", servers: []testServer{{"a", 10, false, 0}, {"b", 10, false, 0}}, maxServers: 2},
+		{name: "stops at max servers counting open allocations", servers: []testServer{{"a", 10, false, 0}}, openAllocs: 1, maxServers: 1},
+		{name: "does not count static servers against max servers", servers: []testServer{{"a", 10, true, 0}}, maxServers: 1, allocations: 1},
+		{name: "keeps the mode's min servers", servers: []testServer{{"a", 0, false, 0}}, minServers: 2, allocations: 1},
+		{name: "expires silent servers", servers: []testServer{{"a", 0, false, time.Hour}, {"b", 0, false, 0}}, expired: []string{"a"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := setupTestCoordinator(t, func(c *coordinatorConfig) {
+				c.Regions[0].MaxServers = test.maxServers
+				c.Modes[0].MinServers = test.minServers
+			})
+			ctx := context.Background()
+
+			for _, s := range test.servers {
+				server := putTestServer(t, s.id, "na", s.playerCount)
+				server.Static = s.static
+				server.CheckTime = time.Now().Add(-s.silent)
+
+				err := servers.PutServer(ctx, server)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for i := 0; i < test.openAllocs; i++ {
+				err := allocations.PutAllocation(ctx, newAllocation("open-"+strconv.Itoa(i), "na", defaultModeName))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			done := make(chan int, 1)
+			manageRegionServers(ctx, "na", defaultModeName, done)
+
+			if result := <-done; result != 1 {
+				t.Fatalf("manage failed with %v", result)
+			}
+
+			allocated := recorder.withPath("/alloc")
+			if len(allocated) != test.allocations {
+				t.Fatalf("requested %v allocations, want %v", len(allocated), test.allocations)
+			}
+
+			for _, task := range allocated {
+				if task.Params.Get("region") != "na" || task.Params.Get("mode") != defaultModeName {
+					t.Errorf("allocation task params %v, want na and %v", task.Params, defaultModeName)
+				}
+
+				alloc, err := allocations.GetAllocation(ctx, task.Params.Get("serverID"))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if alloc.State != allocationStateRequested || alloc.Region != "na" {
+					t.Errorf("allocation %+v, want requested in na", alloc)
+				}
+			}
+
+			deallocated := recorder.withPath("/dealloc")
+			if len(deallocated) != len(test.expired) {
+				t.Fatalf("scheduled %v deallocations, want %v", len(deallocated), len(test.expired))
+			}
+
+			for i, id := range test.expired {
+				if deallocated[i].Params.Get("serverID") != id {
+					t.Errorf("deallocated %v, want %v", deallocated[i].Params.Get("serverID"), id)
+				}
+
+				_, err := servers.GetServer(ctx, id)
+				if err != errNotFound {
+					t.Errorf("expired server %v was not removed: %v", id, err)
+				}
+			}
+		})
+	}
+}
+
+// failingProvider is a fake provider whose deallocations fail with err, and that reports whether
+// its backend is available
+type failingProvider struct {
+	*fakeServerProvider
+	err       error
+	available bool
+}
+
+func (p failingProvider) Deallocate(ctx context.Context, serverID string) error {
+	return p.err
+}
+
+func (p failingProvider) Available(ctx context.Context) bool {
+	return p.available
+}
+
+func TestDeallocateServerHandler(t *testing.T) {
+	tests := []struct {
+		name        string
+		err         error
+		unavailable bool
+		status      int
+		released    bool
+	}{
+		{name: "releases the allocation", status: http.StatusOK, released: true},
+		{name: "retries a failing provider", err: &clanForgeError{Kind: clanForgeErrorServer, StatusCode: 503}, status: http.StatusInternalServerError},
+		{name: "retries a network error", err: &clanForgeError{Kind: clanForgeErrorNetwork}, status: http.StatusInternalServerError},
+		{name: "retries while the circuit is open", unavailable: true, status: http.StatusInternalServerError},
+		{name: "gives up on a refused request", err: &clanForgeError{Kind: clanForgeErrorRequest, StatusCode: 400}, status: http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupTestCoordinator(t, nil)
+			ctx := context.Background()
+
+			provider = failingProvider{fakeServerProvider: newFakeServerProvider("127.0.0.1", 7777, 0), err: test.err, available: !test.unavailable}
+
+			alloc := newAllocation("s", "na", defaultModeName)
+			alloc.State = allocationStateFulfilled
+
+			err := allocations.PutAllocation(ctx, alloc)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w := runTask(deallocateServerHandler, recordedTask{Path: "/dealloc", Params: url.Values{"serverID": {"s"}}}, 0)
+			if w.Code != test.status {
+				t.Fatalf("status %v, want %v: %v", w.Code, test.status, w.Body.String())
+			}
+
+			alloc, err = allocations.GetAllocation(ctx, "s")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if released := alloc.State == allocationStateReleased; released != test.released {
+				t.Errorf("allocation state %v, want released %v", allocationStateName(alloc.State), test.released)
+			}
+		})
+	}
+}
+
+// clanForgeAPI is a transport failing every ClanForge request with status, counting them
+type clanForgeAPI struct {
+	status   int
+	requests int
+}
+
+func (api *clanForgeAPI) RoundTrip(req *http.Request) (*http.Response, error) {
+	api.requests++
+
+	return &http.Response{StatusCode: api.status, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader("unavailable")), Request: req}, nil
+}
+
+// Once ClanForge fails repeatedly, allocations and deallocations wait without calling it
+func TestClanForgeCircuitOpen(t *testing.T) {
+	recorder := setupTestCoordinator(t, nil)
+	ctx := context.Background()
+
+	provider = clanForgeProvider{}
+
+	api := &clanForgeAPI{status: http.StatusServiceUnavailable}
+	transport := http.DefaultTransport
+	http.DefaultTransport = api
+	defer func() { http.DefaultTransport = transport }()
+
+	allocate := func(serverID string) int {
+		err := allocations.PutAllocation(ctx, newAllocation(serverID, "na", defaultModeName))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return runTask(allocateServerHandler, recordedTask{Path: "/alloc", Params: url.Values{"serverID": {serverID}, "region": {"na"}, "mode": {defaultModeName}}}, 0).Code
+	}
+
+	for i := 0; i < clanForgeCircuitThreshold; i++ {
+		if status := allocate("failing-" + strconv.Itoa(i)); status != http.StatusInternalServerError {
+			t.Fatalf("failing allocation status %v, want 500", status)
+		}
+	}
+
+	if api.requests != clanForgeCircuitThreshold {
+		t.Fatalf("sent %v requests, want %v", api.requests, clanForgeCircuitThreshold)
+	}
+
+	if status := allocate("paused"); status != http.StatusInternalServerError {
+		t.Errorf("allocation status %v with the circuit open, want 500 to retry", status)
+	}
+
+	alloc := newAllocation("allocated", "na", defaultModeName)
+	alloc.State = allocationStateFulfilled
+	allocations.PutAllocation(ctx, alloc)
+
+	if w := runTask(deallocateServerHandler, recordedTask{Path: "/dealloc", Params: url.Values{"serverID": {"allocated"}}}, 0); w.Code != http.StatusInternalServerError {
+		t.Errorf("deallocation status %v with the circuit open, want 500 to retry", w.Code)
+	}
+
+	done := make(chan int, 1)
+	manageRegionServers(ctx, "eu", defaultModeName, done)
+	<-done
+
+	if allocated := recorder.withPath("/alloc"); len(allocated) != 0 {
+		t.Errorf("scheduled %v allocations with the circuit open", len(allocated))
+	}
+
+	if api.requests != clanForgeCircuitThreshold {
+		t.Errorf("sent %v requests with the circuit open", api.requests-clanForgeCircuitThreshold)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	signedRequestWindowSeconds = 300
+)
+
+type registrationResponse struct {
+	ServerID        string
+	HeartbeatSecret string
+	Sequence        int64 // Highest sequence number accepted so far, signed requests must continue above it
+}
+
+var (
+	errStaleRegistration = errors.New("stale registration")
+	errServerIDInUse     = errors.New("server ID in use")
+)
+
+// registerServerHandler adds or updates a long-lived static server. Requests are POSTed forms signed
+// with the shared registration secret: Signature is the hex HMAC-SHA256 of the ServerID, Address,
+// Port, Region, MaxPlayerCount and Timestamp (unix seconds) values joined by newlines, followed by
+// the Mode value when one is given. Values containing a newline are rejected. Each registration of a server must have a later Timestamp than
+// the last, so a captured request can't be replayed. The response carries the server's secret for
+// signing heartbeats, issued on its first registration and kept on later ones.
+func registerServerHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(r)
+
+	if r.Method != "POST" {
+		log.Errorf(ctx, "[Register] Invalid request method %v", r.Method)
+		http.Error(w, "Invalid Request.", http.StatusBadRequest)
+		return
+	}
+
+	if config.Servers.RegistrationSecret == "" {
+		log.Errorf(ctx, "[Register] Registration secret not configured")
+		http.Error(w, "Registration Disabled.", http.StatusForbidden)
+		return
+	}
+
+	serverID := r.PostFormValue("ServerID")
+	address := r.PostFormValue("Address")
+	portParam := r.PostFormValue("Port")
+	region := r.PostFormValue("Region")
+	maxPlayerCount := r.PostFormValue("MaxPlayerCount")
+	timestamp := r.PostFormValue("Timestamp")
+	modeParam := r.PostFormValue("Mode")
+	signature := r.PostFormValue("Signature")
+
+	signed := []string{serverID, address, portParam, region, maxPlayerCount, timestamp}
+	if modeParam != "" {
+		signed = append(signed, modeParam)
+	}
+
+	if !signableValues(signed) {
+		log.Errorf(ctx, "[Register] Newline in a signed value for server %q", serverID)
+		http.Error(w, "Invalid Request.", http.StatusBadRequest)
+		return
+	}
+
+	expected := signRequest(config.Servers.RegistrationSecret, signed...)
+	providedSignature, err := hex.DecodeString(signature)
+
+	if err != nil || !hmac.Equal(providedSignature, expected) {
+		log.Errorf(ctx, "[Register] Invalid signature for server %v", serverID)
+		http.Error(w, "Invalid Signature.", http.StatusUnauthorized)
+		return
+	}
+
+	signedAt, err := strconv.ParseInt(timestamp, 10, 64)
+
+	if err != nil || math.Abs(time.Now().Sub(time.Unix(signedAt, 0)).Seconds()) > signedRequestWindowSeconds {
+		log.Errorf(ctx, "[Register] Stale registration for server %v", serverID)
+		http.Error(w, "Stale Request.", http.StatusUnauthorized)
+		return
+	}
+
+	port, err := strconv.ParseInt(portParam, 10, 32)
+	_, knownRegion := findRegion(region)
+	mode, knownMode := findMode(modeParam)
+
+	if err != nil || serverID == "" || address == "" || port <= 0 || !knownRegion || !knownMode {
+		log.Errorf(ctx, "[Register] Invalid request args")
+		http.Error(w, "Invalid Request.", http.StatusBadRequest)
+		return
+	}
+
+	maxPlayers := int64(mode.MaxPlayers)
+
+	if maxPlayerCount != "" {
+		maxPlayers, err = strconv.ParseInt(maxPlayerCount, 10, 32)
+
+		if err != nil || maxPlayers <= 0 {
+			log.Errorf(ctx, "[Register] Invalid request args")
+			http.Error(w, "Invalid Request.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	register := func(server *gameServer) error {
+		if !server.Static {
+			return errServerIDInUse
+		} else if signedAt <= server.RegistrationTime {
+			return errStaleRegistration
+		}
+
+		if server.HeartbeatSecret == "" {
+			secret, err := newSecret()
+			if err != nil {
+				return err
+			}
+
+			server.HeartbeatSecret = secret
+			server.resetSequences()
+		}
+
+		server.Address = address
+		server.Port = int(port)
+		server.Region = region
+		server.Mode = mode.Name
+		server.CheckTime = time.Now()
+		server.MaxPlayerCount = int(maxPlayers)
+		server.Fill = float32(server.PlayerCount) / float32(server.MaxPlayerCount)
+		server.RegistrationTime = signedAt
+
+		return nil
+	}
+
+	var server gameServer
+
+	err = servers.UpdateServer(ctx, serverID, func(s *gameServer) error {
+		err := register(s)
+		server = *s
+		return err
+	})
+
+	if err == errNotFound {
+		server = gameServer{
+			UUID:         serverID,
+			State:        serverStateInitializing,
+			CreationTime: time.Now(),
+			Static:       true,
+		}
+
+		err = register(&server)
+
+		if err == nil {
+			err = servers.PutServer(ctx, server)
+		}
+	}
+
+	if err == errServerIDInUse {
+		log.Errorf(ctx, "[Register] Server %v is an allocated server", serverID)
+		http.Error(w, "Server ID In Use.", http.StatusConflict)
+		return
+	} else if err == errStaleRegistration {
+		log.Errorf(ctx, "[Register] Replayed registration for server %v", serverID)
+		http.Error(w, "Stale Request.", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		log.Errorf(ctx, "[Register] %v", err.Error())
+		http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+		return
+	}
+
+	response, err := json.Marshal(registrationResponse{ServerID: serverID, HeartbeatSecret: server.HeartbeatSecret, Sequence: server.lastSequence()})
+
+	if err != nil {
+		log.Errorf(ctx, "[Register] %v", err.Error())
+		http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(response)
+
+	log.Infof(ctx, "[Register] Registered static server %v (%v, %v) in region %v for mode %v", server.UUID, server.Address, server.Port, server.Region, server.Mode)
+}
+
+// signRequest returns the HMAC-SHA256 of values joined by newlines. The values must pass
+// signableValues.
+func signRequest(secret string, values ...string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join(values, "\n")))
+
+	return mac.Sum(nil)
+}
+
+// signableValues reports whether none of the values contain a newline. A newline inside a value
+// would let the same signed string be split into other values.
+func signableValues(values []string) bool {
+	for _, value := range values {
+		if strings.Contains(value, "\n") {
+			return false
+		}
+	}
+
+	return true
+}
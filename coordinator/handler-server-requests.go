@@ -1,14 +1,18 @@
 package main
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"math"
+	"net"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
-
-	"google.golang.org/appengine"
-	"google.golang.org/appengine/datastore"
-	"google.golang.org/appengine/log"
 )
 
 type joinInfo struct {
@@ -18,10 +22,118 @@ type joinInfo struct {
 
 type joinReport struct {
 	JoinInfo []joinInfo `json:"JoinInfo"`
+	Bans     []banInfo  `json:"Bans"` // Active bans in the server's region, connected players should be kicked
+}
+
+type ratingInfo struct {
+	UserID    string
+	Rating    float64
+	Deviation float64
+}
+
+type bootstrapResponse struct {
+	HeartbeatSecret string
 }
 
+var (
+	errReplayedRequest     = errors.New("replayed request")
+	errJoinRated           = errors.New("join already rated")
+	errBootstrapForbidden  = errors.New("bootstrap from another address")
+	errAlreadyBootstrapped = errors.New("server already bootstrapped")
+)
+
+// Reasons a join token is rejected, reported to the server
+var (
+	errJoinNotFound    = errors.New("not_found")
+	errJoinWrongServer = errors.New("wrong_server")
+	errJoinWrongUser   = errors.New("wrong_user")
+	errJoinExpired     = errors.New("expired")
+	errJoinConsumed    = errors.New("consumed")
+)
+
+type joinVerification struct {
+	Valid  bool
+	Reason string `json:",omitempty"`
+}
+
+// bootstrapHandler issues the heartbeat secret of an allocated server, POSTed a form with its
+// ServerID. It is issued once, and only to a request from the address the provider allocated the
+// server on.
+func bootstrapHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(r)
+
+	if r.Method != "POST" {
+		log.Errorf(ctx, "[Bootstrap] Invalid request method %v", r.Method)
+		http.Error(w, "Invalid Request.", http.StatusBadRequest)
+		return
+	}
+
+	serverID := r.PostFormValue("ServerID")
+	remoteHost := remoteIP(r)
+
+	secret, err := newSecret()
+	if err != nil {
+		log.Errorf(ctx, "[Bootstrap] %v", err.Error())
+		http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+		return
+	}
+
+	// Only the first of concurrent bootstraps sets the secret
+	var server gameServer
+
+	err = servers.UpdateServer(ctx, serverID, func(s *gameServer) error {
+		server = *s
+
+		if s.Static || !net.ParseIP(remoteHost).Equal(net.ParseIP(s.Address)) {
+			return errBootstrapForbidden
+		} else if s.HeartbeatSecret != "" {
+			return errAlreadyBootstrapped
+		}
+
+		s.HeartbeatSecret = secret
+		server = *s
+		return nil
+	})
+
+	if err == errNotFound {
+		log.Errorf(ctx, "[Bootstrap] Server not Found: "+serverID)
+		http.Error(w, "Server not Found", http.StatusNotFound)
+		return
+	} else if err == errBootstrapForbidden {
+		log.Errorf(ctx, "[Bootstrap] Request for server %v from %v, allocated on %v", serverID, remoteHost, server.Address)
+		http.Error(w, "Forbidden.", http.StatusForbidden)
+		return
+	} else if err == errAlreadyBootstrapped {
+		log.Errorf(ctx, "[Bootstrap] Server %v already bootstrapped", serverID)
+		http.Error(w, "Already Bootstrapped.", http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Errorf(ctx, "[Bootstrap] %v", err.Error())
+		http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+		return
+	}
+
+	response, err := json.Marshal(bootstrapResponse{HeartbeatSecret: server.HeartbeatSecret})
+
+	if err != nil {
+		log.Errorf(ctx, "[Bootstrap] %v", err.Error())
+		http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(response)
+
+	log.Infof(ctx, "[Bootstrap] Issued heartbeat secret to server %v (%v, %v)", server.UUID, server.Address, server.Port)
+}
+
+// heartbeatHandler updates a server's state and returns its pending joins. Heartbeats are signed
+// with the server's heartbeat secret: Signature is the hex HMAC-SHA256 of the ServerID, ServerState,
+// PlayerCount, MaxPlayerCount, Timestamp (unix seconds) and Sequence values joined by newlines.
+// Requests with a newline in any signed value are rejected, so values can't be shifted between fields.
+// Each kind of signed request from a server has its own Sequence, which must not repeat and may only
+// arrive out of order within the last 64 numbers.
 func heartbeatHandler(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
+	ctx := newContext(r)
 
 	if r.Method != "GET" {
 		log.Errorf(ctx, "[Heartbeat] Invalid request method %v", r.Method)
@@ -60,13 +172,9 @@ func heartbeatHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var server gameServer
-
-	query := datastore.NewQuery("GameServer").Filter("UUID =", serverID)
-	t := query.Run(ctx)
-	serverKey, err := t.Next(&server)
+	server, err := servers.GetServer(ctx, serverID)
 
-	if err == datastore.Done { // No available non-empty servers
+	if err == errNotFound {
 		log.Errorf(ctx, "[Heartbeat] Server not Found: "+serverID)
 		http.Error(w, "Server not Found", http.StatusNotFound)
 		return
@@ -76,13 +184,23 @@ func heartbeatHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	server.State = int(state)
-	server.CheckTime = time.Now()
-	server.PlayerCount = int(players)
-	server.MaxPlayerCount = int(maxPlayers)
-	server.Fill = float32(server.PlayerCount) / float32(server.MaxPlayerCount)
+	if !authenticateServerRequest(ctx, w, r, "[Heartbeat]", server, sequenceHeartbeat, serverID, serverState, playerCount, maxPlayerCount) {
+		return
+	}
+
+	err = servers.UpdateServer(ctx, serverID, func(s *gameServer) error {
+		s.State = int(state)
+		s.CheckTime = time.Now()
+		s.PlayerCount = int(players)
+		s.MaxPlayerCount = int(maxPlayers)
+		s.Fill = float32(s.PlayerCount) / float32(s.MaxPlayerCount)
+		s.Mode = recordMode(s.Mode).Name
+		s.trimRatings()
+
+		server = *s
+		return nil
+	})
 
-	_, err = datastore.Put(ctx, serverKey, &server)
 	if err != nil {
 		log.Errorf(ctx, "[Heartbeat] %v", err.Error())
 		http.Error(w, "Unexpected error.", http.StatusInternalServerError)
@@ -91,49 +209,344 @@ func heartbeatHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Get all unprocessed joins and forward then to the server
 
-	joinQuery := datastore.NewQuery("JoinRecord").Filter("ServerID =", serverID).Filter("Checked = ", false)
+	pendingJoins, err := joins.TakeUncheckedJoins(ctx, serverID)
 
-	var join joinRecord
-	joins := []joinInfo{}
-	i := 0
+	if err != nil {
+		log.Errorf(ctx, "[Heartbeat] %v", err.Error())
+		http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+		return
+	}
 
-	for t := joinQuery.Run(ctx); ; {
-		key, err := t.Next(&join)
-		if err == datastore.Done {
-			break
-		}
-		if err != nil {
-			log.Errorf(ctx, "[Heartbeat] %v", err.Error())
-			return
-		}
+	joinInfos := []joinInfo{}
 
-		joins = append(joins, joinInfo{
+	for _, join := range pendingJoins {
+		joinInfos = append(joinInfos, joinInfo{
 			UserID:    join.UserID,
 			JoinToken: join.JoinToken,
 		})
+	}
+
+	serverBans, err := activeBans(ctx, server.Region, server.Mode)
+
+	if err != nil {
+		log.Errorf(ctx, "[Heartbeat] %v", err.Error())
+		http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+		return
+	}
+
+	report := joinReport{JoinInfo: joinInfos, Bans: serverBans}
+
+	response, err := json.Marshal(report)
+
+	if err != nil {
+		log.Errorf(ctx, "[Heartbeat] %v", err.Error())
+		http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(response)
+
+	log.Infof(ctx, "[Heartbeat] Server %v (%v, %v): %v/%v", server.UUID, server.Address, server.Port, server.PlayerCount, server.MaxPlayerCount)
+}
+
+// verifyJoinHandler checks a connecting player's UserID and JoinToken for the calling server,
+// consuming the token so it can only be used once. The request is signed like a heartbeat over the
+// ServerID, UserID, JoinToken, Timestamp and Sequence values. The server record is left untouched, so
+// verifying joins never races the player count updates of matchmaking.
+func verifyJoinHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(r)
+
+	if r.Method != "GET" {
+		log.Errorf(ctx, "[VerifyJoin] Invalid request method %v", r.Method)
+		http.Error(w, "Invalid Request.", http.StatusBadRequest)
+		return
+	}
+
+	q := r.URL.Query()
+
+	serverID := q.Get("ServerID")
+	userID := q.Get("UserID")
+	joinToken := q.Get("JoinToken")
+
+	server, err := servers.GetServer(ctx, serverID)
+
+	if err == errNotFound {
+		log.Errorf(ctx, "[VerifyJoin] Server not Found: "+serverID)
+		http.Error(w, "Server not Found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Errorf(ctx, "[VerifyJoin] %v", err.Error())
+		http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+		return
+	}
+
+	if !authenticateServerRequest(ctx, w, r, "[VerifyJoin]", server, sequenceVerifyJoin, serverID, userID, joinToken) {
+		return
+	}
+
+	err = joins.UpdateJoin(ctx, joinToken, func(join *joinRecord) error {
+		if join.ServerID != serverID {
+			return errJoinWrongServer
+		} else if join.UserID != userID {
+			return errJoinWrongUser
+		} else if join.Consumed {
+			return errJoinConsumed
+		} else if time.Now().Sub(join.CreationTime).Minutes() >= float64(config.Matchmaking.JoinTokenTTLMinutes) {
+			return errJoinExpired
+		}
+
+		join.Consumed = true
+		join.ConsumedTime = time.Now()
+
+		return nil
+	})
+
+	if err == errNotFound {
+		err = errJoinNotFound
+	}
+
+	verification := joinVerification{Valid: err == nil}
+
+	switch err {
+	case nil:
+	case errJoinNotFound, errJoinWrongServer, errJoinWrongUser, errJoinExpired, errJoinConsumed:
+		verification.Reason = err.Error()
+	default:
+		log.Errorf(ctx, "[VerifyJoin] %v", err.Error())
+		http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+		return
+	}
+
+	response, err := json.Marshal(verification)
+
+	if err != nil {
+		log.Errorf(ctx, "[VerifyJoin] %v", err.Error())
+		http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(response)
+
+	log.Infof(ctx, "[VerifyJoin] Server %v, user %v: valid=%v %v", serverID, userID, verification.Valid, verification.Reason)
+}
+
+// matchResultHandler updates the ratings of a finished match's players. Ranking is the players' user
+// IDs separated by commas, best first, and each player is rated as having beaten everyone below them.
+// The request is signed like a heartbeat over the ServerID, Ranking, Timestamp and Sequence values.
+// Every player must have a join record for the server not yet counted in an earlier result.
+func matchResultHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(r)
+
+	if r.Method != "GET" {
+		log.Errorf(ctx, "[MatchResult] Invalid request method %v", r.Method)
+		http.Error(w, "Invalid Request.", http.StatusBadRequest)
+		return
+	}
+
+	q := r.URL.Query()
+
+	serverID := q.Get("ServerID")
+	ranking := q.Get("Ranking")
+
+	server, err := servers.GetServer(ctx, serverID)
+
+	if err == errNotFound {
+		log.Errorf(ctx, "[MatchResult] Server not Found: "+serverID)
+		http.Error(w, "Server not Found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Errorf(ctx, "[MatchResult] %v", err.Error())
+		http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+		return
+	}
+
+	if !authenticateServerRequest(ctx, w, r, "[MatchResult]", server, sequenceMatchResult, serverID, ranking) {
+		return
+	}
+
+	userIDs := strings.Split(ranking, ",")
+	seen := map[string]bool{}
+
+	for _, userID := range userIDs {
+		if userID == "" || seen[userID] {
+			log.Errorf(ctx, "[MatchResult] Invalid ranking from server %v: %v", serverID, ranking)
+			http.Error(w, "Invalid Request.", http.StatusBadRequest)
+			return
+		}
+
+		seen[userID] = true
+	}
+
+	if len(userIDs) < 2 || len(userIDs) > server.MaxPlayerCount {
+		log.Errorf(ctx, "[MatchResult] Invalid ranking size %v from server %v", len(userIDs), serverID)
+		http.Error(w, "Invalid Request.", http.StatusBadRequest)
+		return
+	}
+
+	// Only players matched onto the server since its last result can be rated
+
+	serverJoins, err := joins.ListServerJoins(ctx, serverID)
+	if err != nil {
+		log.Errorf(ctx, "[MatchResult] %v", err.Error())
+		http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+		return
+	}
+
+	matchJoins := map[string][]string{} // Join tokens by user ID
+
+	for _, join := range serverJoins {
+		if !join.Rated {
+			matchJoins[join.UserID] = append(matchJoins[join.UserID], join.JoinToken)
+		}
+	}
+
+	for _, userID := range userIDs {
+		if len(matchJoins[userID]) == 0 {
+			log.Errorf(ctx, "[MatchResult] User %v was not matched onto server %v", userID, serverID)
+			http.Error(w, "Player Not In Match.", http.StatusForbidden)
+			return
+		}
+	}
 
-		join.Checked = true
+	// Outcomes are scored against the ratings from before the match
 
-		_, err = datastore.Put(ctx, key, &join)
+	var previous []playerRating
+
+	for _, userID := range userIDs {
+		rating, err := getPlayerRating(ctx, userID)
 		if err != nil {
-			log.Errorf(ctx, "[Heartbeat] %v", err.Error())
+			log.Errorf(ctx, "[MatchResult] %v", err.Error())
 			http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+			return
 		}
 
-		i++
+		previous = append(previous, rating)
 	}
 
-	report := joinReport{JoinInfo: joins}
+	var rated []playerRating
+	updated := []ratingInfo{}
 
-	response, err := json.Marshal(report)
+	for i, rating := range previous {
+		rating.update(rankingOutcomes(previous, i), config.Matchmaking.Rating.Tau)
+		rating.Games++
+		rating.UpdateTime = time.Now()
+
+		rated = append(rated, rating)
+		updated = append(updated, ratingInfo{UserID: rating.UserID, Rating: rating.Rating, Deviation: rating.Deviation})
+	}
+
+	// Claim every join at once before rating, so a concurrent result for the same players is rejected
+
+	var joinTokens []string
+
+	for _, userID := range userIDs {
+		joinTokens = append(joinTokens, matchJoins[userID]...)
+	}
+
+	err = joins.ClaimJoins(ctx, joinTokens)
+
+	if err == errJoinRated || err == errNotFound {
+		log.Errorf(ctx, "[MatchResult] Players were already rated on server %v: %v", serverID, ranking)
+		http.Error(w, "Player Not In Match.", http.StatusForbidden)
+		return
+	} else if err != nil {
+		log.Errorf(ctx, "[MatchResult] %v", err.Error())
+		http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+		return
+	}
+
+	err = ratings.PutRatings(ctx, rated)
 
 	if err != nil {
-		log.Errorf(ctx, "[Heartbeat] %v", err.Error())
+		log.Errorf(ctx, "[MatchResult] %v", err.Error())
+
+		// Release the joins so the server can send the result again
+		err = joins.ReleaseJoins(ctx, joinTokens)
+		if err != nil {
+			log.Errorf(ctx, "[MatchResult] Releasing joins on server %v: %v", serverID, err.Error())
+		}
+
+		http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+		return
+	}
+
+	response, err := json.Marshal(updated)
+
+	if err != nil {
+		log.Errorf(ctx, "[MatchResult] %v", err.Error())
 		http.Error(w, "Unexpected error.", http.StatusInternalServerError)
 		return
 	}
 
 	w.Write(response)
 
-	log.Infof(ctx, "[Heartbeat] Server %v (%v, %v): %v/%v", server.UUID, server.Address, server.Port, server.PlayerCount, server.MaxPlayerCount)
+	log.Infof(ctx, "[MatchResult] Server %v rated %v players", serverID, len(updated))
+}
+
+// authenticateServerRequest checks the Signature of a request signed with the server's heartbeat
+// secret over values followed by its Timestamp and Sequence, writing the error response if it is
+// invalid. Values containing a newline are rejected with 400. The Sequence is recorded against the
+// kind of request, without saving the rest of the server.
+func authenticateServerRequest(ctx context.Context, w http.ResponseWriter, r *http.Request, tag string, server gameServer, kind string, values ...string) bool {
+	q := r.URL.Query()
+
+	timestamp := q.Get("Timestamp")
+	sequenceParam := q.Get("Sequence")
+
+	signed := append(values, timestamp, sequenceParam)
+
+	if !signableValues(signed) {
+		log.Errorf(ctx, "%v Newline in a signed value for server %v", tag, server.UUID)
+		http.Error(w, "Invalid Request.", http.StatusBadRequest)
+		return false
+	}
+
+	providedSignature, err := hex.DecodeString(q.Get("Signature"))
+	expected := signRequest(server.HeartbeatSecret, signed...)
+
+	if server.HeartbeatSecret == "" || err != nil || !hmac.Equal(providedSignature, expected) {
+		log.Errorf(ctx, "%v Invalid signature for server %v", tag, server.UUID)
+		http.Error(w, "Invalid Signature.", http.StatusUnauthorized)
+		return false
+	}
+
+	signedAt, err := strconv.ParseInt(timestamp, 10, 64)
+
+	if err != nil || math.Abs(time.Now().Sub(time.Unix(signedAt, 0)).Seconds()) > signedRequestWindowSeconds {
+		log.Errorf(ctx, "%v Stale request for server %v", tag, server.UUID)
+		http.Error(w, "Stale Request.", http.StatusUnauthorized)
+		return false
+	}
+
+	sequence, err := strconv.ParseInt(sequenceParam, 10, 64)
+
+	if err == nil {
+		err = servers.AdvanceSequence(ctx, server.UUID, kind, sequence)
+	} else {
+		err = errReplayedRequest
+	}
+
+	if err == errReplayedRequest || err == errNotFound {
+		log.Errorf(ctx, "%v Replayed request %v for server %v", tag, sequenceParam, server.UUID)
+		http.Error(w, "Replayed Request.", http.StatusUnauthorized)
+		return false
+	} else if err != nil {
+		log.Errorf(ctx, "%v %v", tag, err.Error())
+		http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+		return false
+	}
+
+	return true
+}
+
+// newSecret returns 32 random bytes, hex encoded
+func newSecret() (string, error) {
+	secret := make([]byte, 32)
+
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(secret), nil
 }
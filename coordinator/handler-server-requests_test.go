@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// matchResultRequest builds a /matchresult request signed with secret
+func matchResultRequest(serverID, ranking, secret string, sequence int64) *httptest.ResponseRecorder {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	sequenceParam := strconv.FormatInt(sequence, 10)
+
+	q := url.Values{}
+	q.Set("ServerID", serverID)
+	q.Set("Ranking", ranking)
+	q.Set("Timestamp", timestamp)
+	q.Set("Sequence", sequenceParam)
+	q.Set("Signature", hex.EncodeToString(signRequest(secret, serverID, ranking, timestamp, sequenceParam)))
+
+	w := httptest.NewRecorder()
+	matchResultHandler(w, httptest.NewRequest("GET", "/matchresult?"+q.Encode(), nil))
+
+	return w
+}
+
+func TestMatchResultHandler(t *testing.T) {
+	type testJoin struct {
+		userID   string
+		serverID string
+		rated    bool
+		expired  bool // Created before the join expiry time
+	}
+
+	tests := []struct {
+		name    string
+		joins   []testJoin
+		ranking string
+		status  int
+	}{
+		{name: "rates players matched onto the server", joins: []testJoin{{"test:dev/a", "s", false, false}, {"test:dev/b", "s", false, false}}, ranking: "test:dev/a,test:dev/b", status: 200},
+		{name: "rejects a player never matched", joins: []testJoin{{"test:dev/a", "s", false, false}}, ranking: "test:dev/a,test:dev/z", status: 403},
+		{name: "rejects a player matched onto another server", joins: []testJoin{{"test:dev/a", "s", false, false}, {"test:dev/b", "other", false, false}}, ranking: "test:dev/a,test:dev/b", status: 403},
+		{name: "rejects a player already rated", joins: []testJoin{{"test:dev/a", "s", false, false}, {"test:dev/b", "s", true, false}}, ranking: "test:dev/a,test:dev/b", status: 403},
+		{name: "rejects a player whose join expired", joins: []testJoin{{"test:dev/a", "s", false, false}, {"test:dev/b", "s", false, true}}, ranking: "test:dev/a,test:dev/b", status: 403},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupTestCoordinator(t, nil)
+			ctx := context.Background()
+
+			server := putTestServer(t, "s", "na", 2)
+			server.HeartbeatSecret = "secret"
+			servers.PutServer(ctx, server)
+
+			for i, join := range test.joins {
+				created := time.Now()
+				if join.expired {
+					created = created.Add(-(joinRecordExpiryTime + 1) * time.Minute)
+				}
+
+				err := joins.PutJoin(ctx, joinRecord{UserID: join.userID, ServerID: join.serverID, Region: "na", JoinToken: strconv.Itoa(i), CreationTime: created, Rated: join.rated})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			w := matchResultRequest("s", test.ranking, "secret", 1)
+			if w.Code != test.status {
+				t.Fatalf("status %v, want %v: %v", w.Code, test.status, w.Body.String())
+			}
+
+			rating, err := getPlayerRating(ctx, "test:dev/a")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if rated := rating.Games > 0; rated != (test.status == 200) {
+				t.Errorf("player rated %v times", rating.Games)
+			}
+		})
+	}
+}
+
+// heartbeatRequest sends a heartbeat reporting players, signed with secret over signedPlayers and
+// a Timestamp age ago
+func heartbeatRequest(serverID, secret string, players, signedPlayers int, age time.Duration, sequence int64) *httptest.ResponseRecorder {
+	timestamp := strconv.FormatInt(time.Now().Add(-age).Unix(), 10)
+	sequenceParam := strconv.FormatInt(sequence, 10)
+	state := strconv.Itoa(serverStateActive)
+
+	q := url.Values{}
+	q.Set("ServerID", serverID)
+	q.Set("ServerState", state)
+	q.Set("PlayerCount", strconv.Itoa(players))
+	q.Set("MaxPlayerCount", "10")
+	q.Set("Timestamp", timestamp)
+	q.Set("Sequence", sequenceParam)
+
+	if secret != "" {
+		q.Set("Signature", hex.EncodeToString(signRequest(secret, serverID, state, strconv.Itoa(signedPlayers), "10", timestamp, sequenceParam)))
+	}
+
+	w := httptest.NewRecorder()
+	heartbeatHandler(w, httptest.NewRequest("GET", "/heartbeat?"+q.Encode(), nil))
+
+	return w
+}
+
+func TestHeartbeatHandler(t *testing.T) {
+	type heartbeat struct {
+		secret   string // Signed with
+		players  int
+		signed   int // Player count signed, when changed in transit
+		age      time.Duration
+		sequence int64
+		status   int
+	}
+
+	valid := func(sequence int64, status int) heartbeat {
+		return heartbeat{secret: "secret", players: 4, signed: 4, sequence: sequence, status: status}
+	}
+
+	tests := []struct {
+		name       string
+		heartbeats []heartbeat
+	}{
+		{name: "accepts a signed heartbeat", heartbeats: []heartbeat{valid(1, 200)}},
+		{name: "rejects an unsigned heartbeat", heartbeats: []heartbeat{{players: 4, sequence: 1, status: 401}}},
+		{name: "rejects another secret", heartbeats: []heartbeat{{secret: "other", players: 4, signed: 4, sequence: 1, status: 401}}},
+		{name: "rejects a changed value", heartbeats: []heartbeat{{secret: "secret", players: 9, signed: 4, sequence: 1, status: 401}}},
+		{name: "rejects a stale timestamp", heartbeats: []heartbeat{{secret: "secret", players: 4, signed: 4, age: 10 * time.Minute, sequence: 1, status: 401}}},
+		{name: "rejects a future timestamp", heartbeats: []heartbeat{{secret: "secret", players: 4, signed: 4, age: -10 * time.Minute, sequence: 1, status: 401}}},
+		{name: "rejects a replayed sequence", heartbeats: []heartbeat{valid(1, 200), valid(1, 401)}},
+		{name: "accepts sequences out of order", heartbeats: []heartbeat{valid(5, 200), valid(3, 200), valid(4, 200), valid(3, 401)}},
+		{name: "rejects sequences outside the window", heartbeats: []heartbeat{valid(100, 200), valid(100-sequenceWindow, 401)}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupTestCoordinator(t, nil)
+			ctx := context.Background()
+
+			server := putTestServer(t, "s", "na", 0)
+			server.HeartbeatSecret = "secret"
+			servers.PutServer(ctx, server)
+
+			accepted := 0
+
+			for i, h := range test.heartbeats {
+				w := heartbeatRequest("s", h.secret, h.players, h.signed, h.age, h.sequence)
+				if w.Code != h.status {
+					t.Fatalf("heartbeat %v status %v, want %v: %v", i, w.Code, h.status, w.Body.String())
+				}
+
+				if w.Code == 200 {
+					accepted++
+				}
+			}
+
+			stored, err := servers.GetServer(ctx, "s")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if updated := stored.PlayerCount != 0; updated != (accepted > 0) {
+				t.Errorf("stored player count %v after %v accepted heartbeats", stored.PlayerCount, accepted)
+			}
+		})
+	}
+}
+
+// New bans reach the servers of their regions on the next heartbeat, and removed bans stop
+func TestHeartbeatPushesBans(t *testing.T) {
+	setupTestCoordinator(t, nil)
+	ctx := context.Background()
+
+	for _, region := range []string{"na", "eu"} {
+		server := putTestServer(t, region, region, 0)
+		server.HeartbeatSecret = "secret"
+		servers.PutServer(ctx, server)
+	}
+
+	pushedBans := func(serverID string, sequence int64) []banInfo {
+		w := heartbeatRequest(serverID, "secret", 1, 1, 0, sequence)
+		if w.Code != 200 {
+			t.Fatalf("heartbeat status %v: %v", w.Code, w.Body.String())
+		}
+
+		var report joinReport
+
+		err := json.Unmarshal(w.Body.Bytes(), &report)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return report.Bans
+	}
+
+	// Caches the empty ban list
+	if pushed := pushedBans("na", 1); len(pushed) != 0 {
+		t.Fatalf("pushed %v bans before any were made", len(pushed))
+	}
+
+	info := banTestUser(t, "test:dev/a", url.Values{"Reason": {"cheating"}, "Regions": {"na"}})
+
+	pushed := pushedBans("na", 2)
+	if len(pushed) != 1 || pushed[0].BanID != info.BanID || pushed[0].UserID != "test:dev/a" {
+		t.Fatalf("pushed bans %+v, want %v", pushed, info.BanID)
+	}
+
+	if pushed := pushedBans("eu", 1); len(pushed) != 0 {
+		t.Errorf("pushed bans %+v to a server outside the ban's regions", pushed)
+	}
+
+	req := httptest.NewRequest("DELETE", "/bans?BanID="+info.BanID, nil)
+	w := httptest.NewRecorder()
+	bansHandler(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("unban status %v: %v", w.Code, w.Body.String())
+	}
+
+	if pushed := pushedBans("na", 3); len(pushed) != 0 {
+		t.Errorf("pushed removed bans %+v", pushed)
+	}
+}
+
+// A server without a secret can't heartbeat until it bootstraps
+func TestHeartbeatRequiresSecret(t *testing.T) {
+	setupTestCoordinator(t, nil)
+
+	putTestServer(t, "s", "na", 0)
+
+	if w := heartbeatRequest("s", "", 4, 4, 0, 1); w.Code != 401 {
+		t.Errorf("status %v, want 401", w.Code)
+	}
+
+	if w := heartbeatRequest("s", "secret", 4, 4, 0, 1); w.Code != 401 {
+		t.Errorf("signed status %v, want 401", w.Code)
+	}
+}
+
+// A server can't report the same players twice for one match
+func TestMatchResultRatesJoinsOnce(t *testing.T) {
+	setupTestCoordinator(t, nil)
+	ctx := context.Background()
+
+	server := putTestServer(t, "s", "na", 2)
+	server.HeartbeatSecret = "secret"
+	servers.PutServer(ctx, server)
+
+	joins.PutJoin(ctx, joinRecord{UserID: "test:dev/a", ServerID: "s", Region: "na", JoinToken: "a", CreationTime: time.Now()})
+	joins.PutJoin(ctx, joinRecord{UserID: "test:dev/b", ServerID: "s", Region: "na", JoinToken: "b", CreationTime: time.Now()})
+
+	if w := matchResultRequest("s", "test:dev/a,test:dev/b", "secret", 1); w.Code != 200 {
+		t.Fatalf("first result status %v: %v", w.Code, w.Body.String())
+	}
+
+	if w := matchResultRequest("s", "test:dev/b,test:dev/a", "secret", 2); w.Code != 403 {
+		t.Fatalf("second result status %v, want 403", w.Code)
+	}
+}
+
+// Signed values are joined by newlines, so a value containing one is rejected even when signed
+func TestMatchResultRejectsNewlines(t *testing.T) {
+	setupTestCoordinator(t, nil)
+	ctx := context.Background()
+
+	server := putTestServer(t, "s", "na", 2)
+	server.HeartbeatSecret = "secret"
+	servers.PutServer(ctx, server)
+
+	joins.PutJoin(ctx, joinRecord{UserID: "test:dev/a", ServerID: "s", Region: "na", JoinToken: "a", CreationTime: time.Now()})
+	joins.PutJoin(ctx, joinRecord{UserID: "test:dev/b", ServerID: "s", Region: "na", JoinToken: "b", CreationTime: time.Now()})
+
+	if w := matchResultRequest("s", "test:dev/a,test:dev/b\n1", "secret", 1); w.Code != 400 {
+		t.Fatalf("status %v, want 400", w.Code)
+	}
+
+	if rating, _ := getPlayerRating(ctx, "test:dev/a"); rating.Games != 0 {
+		t.Errorf("player rated %v times", rating.Games)
+	}
+}
+
+// failingRatingStore fails to save ratings while fail is set
+type failingRatingStore struct {
+	*memoryRatingStore
+	fail bool
+}
+
+func (s *failingRatingStore) PutRatings(ctx context.Context, playerRatings []playerRating) error {
+	if s.fail {
+		return errors.New("unavailable")
+	}
+
+	return s.memoryRatingStore.PutRatings(ctx, playerRatings)
+}
+
+// A result whose ratings could not be saved can be sent again, rating its players once
+func TestMatchResultRetriedAfterFailure(t *testing.T) {
+	setupTestCoordinator(t, nil)
+	ctx := context.Background()
+
+	store := &failingRatingStore{memoryRatingStore: newMemoryRatingStore(), fail: true}
+	ratings = store
+
+	server := putTestServer(t, "s", "na", 2)
+	server.HeartbeatSecret = "secret"
+	servers.PutServer(ctx, server)
+
+	joins.PutJoin(ctx, joinRecord{UserID: "test:dev/a", ServerID: "s", Region: "na", JoinToken: "a", CreationTime: time.Now()})
+	joins.PutJoin(ctx, joinRecord{UserID: "test:dev/b", ServerID: "s", Region: "na", JoinToken: "b", CreationTime: time.Now()})
+
+	if w := matchResultRequest("s", "test:dev/a,test:dev/b", "secret", 1); w.Code != 500 {
+		t.Fatalf("failed result status %v, want 500", w.Code)
+	}
+
+	for _, joinToken := range []string{"a", "b"} {
+		if join, _ := getTestJoin(joinToken); join.Rated {
+			t.Errorf("join %v left claimed by a failed result", joinToken)
+		}
+	}
+
+	store.fail = false
+
+	if w := matchResultRequest("s", "test:dev/a,test:dev/b", "secret", 2); w.Code != 200 {
+		t.Fatalf("retried result status %v: %v", w.Code, w.Body.String())
+	}
+
+	for _, userID := range []string{"test:dev/a", "test:dev/b"} {
+		rating, err := getPlayerRating(ctx, userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if rating.Games != 1 {
+			t.Errorf("%v rated %v times, want once", userID, rating.Games)
+		}
+	}
+}
+
+func TestBootstrapHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		serverID string
+		from     string
+		static   bool
+		secret   string // Already issued
+		status   int
+	}{
+		{name: "issues a secret", method: "POST", serverID: "s", from: "10.0.0.1", status: 200},
+		{name: "rejects GET", method: "GET", serverID: "s", from: "10.0.0.1", status: 400},
+		{name: "rejects an unknown server", method: "POST", serverID: "missing", from: "10.0.0.1", status: 404},
+		{name: "rejects another address", method: "POST", serverID: "s", from: "10.0.0.2", status: 403},
+		{name: "rejects a static server", method: "POST", serverID: "s", from: "10.0.0.1", static: true, status: 403},
+		{name: "issues the secret once", method: "POST", serverID: "s", from: "10.0.0.1", secret: "issued", status: 409},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupTestCoordinator(t, nil)
+			ctx := context.Background()
+
+			server := putTestServer(t, "s", "na", 0)
+			server.Static = test.static
+			server.HeartbeatSecret = test.secret
+			servers.PutServer(ctx, server)
+
+			// Sequences accepted meanwhile are kept
+			servers.AdvanceSequence(ctx, "s", sequenceHeartbeat, 3)
+
+			req := httptest.NewRequest(test.method, "/bootstrap", strings.NewReader("ServerID="+test.serverID))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.RemoteAddr = test.from + ":40000"
+
+			w := httptest.NewRecorder()
+			bootstrapHandler(w, req)
+
+			if w.Code != test.status {
+				t.Fatalf("status %v, want %v: %v", w.Code, test.status, w.Body.String())
+			}
+
+			stored, err := servers.GetServer(ctx, "s")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.status != 200 {
+				if stored.HeartbeatSecret != test.secret {
+					t.Errorf("secret changed to %q by a rejected bootstrap", stored.HeartbeatSecret)
+				}
+				return
+			}
+
+			var response bootstrapResponse
+
+			err = json.Unmarshal(w.Body.Bytes(), &response)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if response.HeartbeatSecret == "" || stored.HeartbeatSecret != response.HeartbeatSecret || stored.HeartbeatSequence != 3 {
+				t.Errorf("stored server %+v, want the issued secret and heartbeat sequence 3", stored)
+			}
+		})
+	}
+}
@@ -6,27 +6,27 @@ import (
 	"encoding/csv"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
-
-	"google.golang.org/appengine"
-	"google.golang.org/appengine/datastore"
-	"google.golang.org/appengine/log"
 )
 
 const (
-	userRecordExpiryTime = 1
-	joinRecordExpiryTime = 1
+	userRecordExpiryTime  = 1
+	joinRecordExpiryTime  = 120 // Minutes a join is kept, long enough for its match result to be checked
+	allocRecordExpiryTime = 24
+	banRecordExpiryTime   = 24 // Hours an expired ban is kept
+	partyRecordExpiryTime = 1
+	statsPeriod           = 24 // Hours between /stats runs, see cron.yaml
 )
 
 type matchmakerStats struct {
-	Timestamp    time.Time
-	TotalUsers   int
-	TotalJoinsNA int
-	TotalJoinsEU int
+	Timestamp  time.Time
+	TotalUsers int
+	TotalJoins map[string]int // By region name
 }
 
 func statsHandler(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
+	ctx := newContext(r)
 
 	log.Infof(ctx, "[Stats] Running User Stats Collection...")
 
@@ -36,6 +36,12 @@ func statsHandler(w http.ResponseWriter, r *http.Request) {
 
 	collectServerStats(ctx)
 
+	if config.serverProvider() == "clanforge" {
+		log.Infof(ctx, "[Stats] Running ClanForge Stats Collection...")
+
+		collectClanForgeStats(ctx)
+	}
+
 	log.Infof(ctx, "[Stats] Running User Expiration...")
 
 	expireUsers(ctx)
@@ -43,13 +49,18 @@ func statsHandler(w http.ResponseWriter, r *http.Request) {
 	log.Infof(ctx, "[Stats] Running Join Expiration...")
 
 	expireJoins(ctx)
+
+	log.Infof(ctx, "[Stats] Running Allocation Expiration...")
+
+	expireAllocations(ctx)
+	expireBans(ctx)
+	expireParties(ctx)
 }
 
 func collectMatchmakerStats(ctx context.Context) {
-	stats := matchmakerStats{Timestamp: time.Now()}
+	stats := matchmakerStats{Timestamp: time.Now(), TotalJoins: make(map[string]int)}
 
-	userQuery := datastore.NewQuery("MMUser")
-	userCount, err := userQuery.Count(ctx)
+	userCount, err := users.CountUsers(ctx)
 
 	if err != nil {
 		log.Errorf(ctx, "[Stats] %v", err.Error())
@@ -57,39 +68,30 @@ func collectMatchmakerStats(ctx context.Context) {
 
 	stats.TotalUsers = userCount
 
-	joinsNAQuery := datastore.NewQuery("JoinRecord").Filter("Region =", naRegionName)
-	joinsNACount, err := joinsNAQuery.Count(ctx)
+	// Joins outlive a stats period, so only count those matched since the last run
+	since := time.Now().Add(-statsPeriod * time.Hour)
 
-	if err != nil {
-		log.Errorf(ctx, "[Stats] %v", err.Error())
-	}
+	for _, region := range config.Regions {
+		joinCount, err := joins.CountJoins(ctx, region.Name, since)
 
-	joinsEUQuery := datastore.NewQuery("JoinRecord").Filter("Region =", euRegionName)
-	joinsEUCount, err := joinsEUQuery.Count(ctx)
+		if err != nil {
+			log.Errorf(ctx, "[Stats] %v", err.Error())
+		}
 
-	if err != nil {
-		log.Errorf(ctx, "[Stats] %v", err.Error())
+		stats.TotalJoins[region.Name] = joinCount
 	}
 
-	stats.TotalJoinsNA = joinsNACount
-	stats.TotalJoinsEU = joinsEUCount
-
 	buffer := &bytes.Buffer{}
 	w := csv.NewWriter(buffer)
-	record := make([]string, 4)
-
-	record[0] = "Timestamp"
-	record[1] = "TotalUsers"
-	record[2] = "TotalJoinsNA"
-	record[3] = "TotalJoinsEU"
-
-	w.Write(record)
+	header := []string{"Timestamp", "TotalUsers"}
+	record := []string{fmt.Sprint(stats.Timestamp.Unix()), fmt.Sprint(stats.TotalUsers)}
 
-	record[0] = fmt.Sprint(stats.Timestamp.Unix())
-	record[1] = fmt.Sprint(stats.TotalUsers)
-	record[2] = fmt.Sprint(stats.TotalJoinsNA)
-	record[3] = fmt.Sprint(stats.TotalJoinsEU)
+	for _, region := range config.Regions {
+		header = append(header, "TotalJoins"+strings.ToUpper(region.Name))
+		record = append(record, fmt.Sprint(stats.TotalJoins[region.Name]))
+	}
 
+	w.Write(header)
 	w.Write(record)
 
 	w.Flush()
@@ -104,43 +106,35 @@ func collectMatchmakerStats(ctx context.Context) {
 }
 
 func collectServerStats(ctx context.Context) {
-	var stats serverStats
-	var err error
-
-	q := datastore.NewQuery("ServerStats")
+	cutoff := time.Now()
 
 	buffer := &bytes.Buffer{}
 	w := csv.NewWriter(buffer)
-	keys := []*datastore.Key{}
-	record := make([]string, 5)
+	record := make([]string, 6)
 
 	record[0] = "Region"
 	record[1] = "Timestamp"
 	record[2] = "TotalServers"
 	record[3] = "TotalCurrentPlayers"
 	record[4] = "TotalMaxPlayers"
+	record[5] = "Mode"
 
 	w.Write(record)
 
-	for t := q.Run(ctx); ; {
-		key, err := t.Next(&stats)
-
-		if err != nil {
-			if err == datastore.Done {
-				break
-			} else {
-				log.Errorf(ctx, "[Stats] %v", err.Error())
-				continue
-			}
-		}
+	allStats, err := servers.ListServerStats(ctx, cutoff)
 
-		keys = append(keys, key)
+	if err != nil {
+		log.Errorf(ctx, "[Stats] %v", err.Error())
+		return
+	}
 
+	for _, stats := range allStats {
 		record[0] = stats.Region
 		record[1] = fmt.Sprint(stats.Timestamp.Unix())
 		record[2] = fmt.Sprint(stats.TotalServers)
 		record[3] = fmt.Sprint(stats.TotalCurrentPlayers)
 		record[4] = fmt.Sprint(stats.TotalMaxPlayers)
+		record[5] = recordMode(stats.Mode).Name
 
 		w.Write(record)
 	}
@@ -153,78 +147,146 @@ func collectServerStats(ctx context.Context) {
 
 	if err != nil {
 		log.Errorf(ctx, "[Stats] %v", err.Error())
+		return
 	}
 
-	err = removeFromDatastore(ctx, keys)
+	removed, err := servers.DeleteServerStats(ctx, cutoff)
 
 	if err != nil {
 		log.Errorf(ctx, "[Stats] %v", err.Error())
 		return
 	}
 
-	log.Infof(ctx, "[Stats] Removed %v ServerStats records.", len(keys))
+	log.Infof(ctx, "[Stats] Removed %v ServerStats records.", removed)
 }
 
-func expireUsers(ctx context.Context) {
-	userCheckTime := time.Now().Add(-userRecordExpiryTime * time.Hour)
-	userQuery := datastore.NewQuery("MMUser").Filter("CheckTime <", userCheckTime)
+// collectClanForgeStats reports the ClanForge requests, outcomes by error kind, retries and total
+// latency of each operation since the last collection
+func collectClanForgeStats(ctx context.Context) {
+	buffer := &bytes.Buffer{}
+	w := csv.NewWriter(buffer)
 
-	var mmUser mmUser
+	metrics := []string{clanForgeRequestsMetric, clanForgeSuccessMetric}
+	metrics = append(metrics, clanForgeErrorKinds...)
+	metrics = append(metrics, clanForgeRetriesMetric, clanForgeLatencyMetric)
 
-	userKeys := []*datastore.Key{}
+	w.Write([]string{"Timestamp", "Operation", "Requests", "Success", "AuthErrors", "RateLimited", "CapacityErrors",
+		"ServerErrors", "RequestErrors", "NetworkErrors", "Retries", "LatencyMS"})
 
-	for t := userQuery.Run(ctx); ; {
-		key, err := t.Next(&mmUser)
+	timestamp := fmt.Sprint(time.Now().Unix())
 
-		if err != nil {
-			if err == datastore.Done {
-				break
-			} else {
+	for _, operation := range clanForgeOperations {
+		record := []string{timestamp, operation}
+
+		for _, metric := range metrics {
+			value, err := takeClanForgeMetric(ctx, operation, metric)
+
+			if err != nil {
 				log.Errorf(ctx, "[Stats] %v", err.Error())
-				continue
 			}
+
+			record = append(record, fmt.Sprint(value))
 		}
 
-		userKeys = append(userKeys, key)
+		w.Write(record)
 	}
 
-	err := removeFromDatastore(ctx, userKeys)
+	w.Flush()
+
+	fileName := fmt.Sprintf("stats/clanforge/%v.csv", time.Now().Format("20060102150405"))
+
+	err := storeCSV(ctx, fileName, buffer.Bytes())
+
+	if err != nil {
+		log.Errorf(ctx, "[Stats] %v", err.Error())
+	}
+}
+
+func expireUsers(ctx context.Context) {
+	userCheckTime := time.Now().Add(-userRecordExpiryTime * time.Hour)
+
+	removed, err := users.DeleteUsersCheckedBefore(ctx, userCheckTime)
 
 	if err != nil {
 		log.Errorf(ctx, "[Stats] %v", err.Error())
 	} else {
-		log.Infof(ctx, "[Stats] Removed %v User records.", len(userKeys))
+		log.Infof(ctx, "[Stats] Removed %v User records.", removed)
 	}
 }
 
 func expireJoins(ctx context.Context) {
 	joinCheckTime := time.Now().Add(-joinRecordExpiryTime * time.Minute)
-	joinQuery := datastore.NewQuery("JoinRecord").Filter("CreationTime <", joinCheckTime)
 
-	var joinRecord joinRecord
+	removed, err := joins.DeleteJoinsCreatedBefore(ctx, joinCheckTime)
+
+	if err != nil {
+		log.Errorf(ctx, "[Stats] %v", err.Error())
+	} else {
+		log.Infof(ctx, "[Stats] Removed %v Join records.", removed)
+	}
+}
+
+func expireAllocations(ctx context.Context) {
+	allocUpdateTime := time.Now().Add(-allocRecordExpiryTime * time.Hour)
 
-	joinKeys := []*datastore.Key{}
+	removed, err := allocations.DeleteClosedAllocations(ctx, allocUpdateTime)
 
-	for t := joinQuery.Run(ctx); ; {
-		key, err := t.Next(&joinRecord)
+	if err != nil {
+		log.Errorf(ctx, "[Stats] %v", err.Error())
+	} else {
+		log.Infof(ctx, "[Stats] Removed %v Allocation records.", removed)
+	}
+}
 
-		if err != nil {
-			if err == datastore.Done {
-				break
-			} else {
-				log.Errorf(ctx, "[Stats] %v", err.Error())
+func expireBans(ctx context.Context) {
+	banExpiryTime := time.Now().Add(-banRecordExpiryTime * time.Hour)
+
+	removed, err := bans.DeleteExpiredBans(ctx, banExpiryTime)
+
+	if err != nil {
+		log.Errorf(ctx, "[Stats] %v", err.Error())
+	} else {
+		log.Infof(ctx, "[Stats] Removed %v Ban records.", removed)
+	}
+}
+
+// expireParties removes parties unchanged for an hour, failing members still waiting for them
+func expireParties(ctx context.Context) {
+	partyUpdateTime := time.Now().Add(-partyRecordExpiryTime * time.Hour)
+
+	stale, err := parties.ListPartiesUpdatedBefore(ctx, partyUpdateTime)
+
+	if err != nil {
+		log.Errorf(ctx, "[Stats] %v", err.Error())
+		return
+	}
+
+	var partyIDs []string
+
+	for _, p := range stale {
+		for _, memberID := range p.Members {
+			member, err := users.GetUserByID(ctx, memberID)
+
+			if err != nil || member.PartyID != p.ID || member.MMStatus != mmStatusInQueue {
 				continue
 			}
+
+			member.MMStatus = mmStatusMatchmakingFailed
+
+			err = users.PutUser(ctx, member)
+			if err != nil {
+				log.Errorf(ctx, "[Stats] %v", err.Error())
+			}
 		}
 
-		joinKeys = append(joinKeys, key)
+		partyIDs = append(partyIDs, p.ID)
 	}
 
-	err := removeFromDatastore(ctx, joinKeys)
+	err = parties.DeleteParties(ctx, partyIDs)
 
 	if err != nil {
 		log.Errorf(ctx, "[Stats] %v", err.Error())
 	} else {
-		log.Infof(ctx, "[Stats] Removed %v Join records.", len(joinKeys))
+		log.Infof(ctx, "[Stats] Removed %v Party records.", len(partyIDs))
 	}
 }
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+const (
+	joinTokenAlgorithm = "ES256"
+)
+
+// joinTokenKey is a P-256 key signing join tokens
+type joinTokenKey struct {
+	ID  string
+	Key *ecdsa.PrivateKey
+}
+
+type joinTokenClaims struct {
+	ID        string `json:"jti"`
+	UserID    string `json:"sub"`
+	ServerID  string `json:"srv"`
+	Region    string `json:"rgn"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// Signing keys loaded at startup, the first signs. Join tokens are random UUIDs when there are none.
+var joinTokenKeys []joinTokenKey
+
+// loadJoinTokenKeys reads the configured join token private keys
+func loadJoinTokenKeys() (keys []joinTokenKey, err error) {
+	for _, settings := range config.Matchmaking.JoinTokenKeys {
+		var data []byte
+		data, err = ioutil.ReadFile(settings.PrivateKeyFile)
+		if err != nil {
+			return
+		}
+
+		var key *ecdsa.PrivateKey
+		key, err = parseJoinTokenKey(data)
+		if err != nil {
+			err = fmt.Errorf("%v: %v", settings.PrivateKeyFile, err)
+			return
+		}
+
+		keys = append(keys, joinTokenKey{ID: settings.ID, Key: key})
+	}
+
+	return
+}
+
+func parseJoinTokenKey(data []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM private key found")
+	}
+
+	var parsed interface{}
+	var err error
+
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		parsed, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %v", block.Type)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok || key.Curve.Params().Name != elliptic.P256().Params().Name {
+		return nil, errors.New("join token keys must be ECDSA P-256")
+	}
+
+	return key, nil
+}
+
+// newJoinToken issues the token a player presents to the server. With signing keys configured it is
+// an ES256 JWT the server can verify against the keys published at /jointokenkeys.
+func newJoinToken(userID, serverID, region string) (string, error) {
+	tokenID := uuid.Must(uuid.NewV4()).String()
+
+	if len(joinTokenKeys) == 0 {
+		return tokenID, nil
+	}
+
+	key := joinTokenKeys[0]
+	now := time.Now()
+
+	header, err := json.Marshal(jwtHeader{Algorithm: joinTokenAlgorithm, KeyID: key.ID})
+	if err != nil {
+		return "", err
+	}
+
+	claims, err := json.Marshal(joinTokenClaims{
+		ID:        tokenID,
+		UserID:    userID,
+		ServerID:  serverID,
+		Region:    region,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(time.Minute * time.Duration(config.Matchmaking.JoinTokenTTLMinutes)).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+
+	r, s, err := ecdsa.Sign(rand.Reader, key.Key, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	signature := append(leftPad(r.Bytes(), 32), leftPad(s.Bytes(), 32)...)
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// joinTokenKeysHandler publishes the join token public keys as a JWKS
+func joinTokenKeysHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(r)
+
+	jwks := jwksFile{Keys: []jwk{}}
+
+	for _, key := range joinTokenKeys {
+		jwks.Keys = append(jwks.Keys, jwk{
+			KeyType:   "EC",
+			KeyID:     key.ID,
+			Use:       "sig",
+			Algorithm: joinTokenAlgorithm,
+			Curve:     "P-256",
+			X:         base64.RawURLEncoding.EncodeToString(leftPad(key.Key.X.Bytes(), 32)),
+			Y:         base64.RawURLEncoding.EncodeToString(leftPad(key.Key.Y.Bytes(), 32)),
+		})
+	}
+
+	response, err := json.Marshal(jwks)
+
+	if err != nil {
+		log.Errorf(ctx, "[JoinTokenKeys] %v", err.Error())
+		http.Error(w, "Unexpected error.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Write(response)
+}
+
+// leftPad returns b zero padded to size bytes
+func leftPad(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+
+	return append(make([]byte, size-len(b)), b...)
+}
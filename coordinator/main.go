@@ -1,22 +1,88 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"net/http"
+	"os"
 
 	"google.golang.org/appengine"
 )
 
+type route struct {
+	Path    string
+	Handler http.HandlerFunc
+	Admin   bool
+}
+
+// Admin routes are restricted by app.yaml on App Engine
+var routes = []route{
+	{Path: "/enqueue", Handler: enqueueHandler},
+	{Path: "/dequeue", Handler: dequeueHandler},
+	{Path: "/poll", Handler: pollHandler},
+	{Path: "/regions", Handler: regionsHandler},
+	{Path: "/startparty", Handler: startPartyHandler},
+	{Path: "/joinmatch", Handler: joinMatchHandler, Admin: true},
+	{Path: "/bootstrap", Handler: bootstrapHandler},
+	{Path: "/heartbeat", Handler: heartbeatHandler},
+	{Path: "/verifyjoin", Handler: verifyJoinHandler},
+	{Path: "/matchresult", Handler: matchResultHandler},
+	{Path: "/jointokenkeys", Handler: joinTokenKeysHandler},
+	{Path: "/register", Handler: registerServerHandler},
+	{Path: "/manage", Handler: manageServersHandler, Admin: true},
+	{Path: "/alloc", Handler: allocateServerHandler, Admin: true},
+	{Path: "/allocation", Handler: allocationsServerHandler, Admin: true},
+	{Path: "/dealloc", Handler: deallocateServerHandler, Admin: true},
+	{Path: "/freeallocs", Handler: freeAllocationsHandler, Admin: true},
+	{Path: "/reconcile", Handler: reconcileHandler, Admin: true},
+	{Path: "/stats", Handler: statsHandler, Admin: true},
+	{Path: "/bans", Handler: bansHandler, Admin: true},
+	{Path: "/migratekeys", Handler: migrateKeysHandler, Admin: true},
+}
+
+var configPath = flag.String("config", "", "Configuration file (YAML or JSON), defaults to $"+configPathEnv+" or "+defaultConfigPath)
+var beaconAddress = flag.String("beacon", "", "Only run a UDP ping beacon on this address, e.g. :7780, for hosts in a region")
+
 func main() {
-	http.HandleFunc("/enqueue", enqueueHandler)
-	http.HandleFunc("/dequeue", dequeueHandler)
-	http.HandleFunc("/poll", pollHandler)
-	http.HandleFunc("/joinmatch", joinMatchHandler)
-	http.HandleFunc("/heartbeat", heartbeatHandler)
-	http.HandleFunc("/manage", manageServersHandler)
-	http.HandleFunc("/alloc", allocateServerHandler)
-	http.HandleFunc("/allocation", allocationsServerHandler)
-	http.HandleFunc("/dealloc", deallocateServerHandler)
-	http.HandleFunc("/freeallocs", freeAllocationsHandler)
-	http.HandleFunc("/stats", statsHandler)
+	flag.Parse()
+
+	if *beaconAddress != "" {
+		runStandaloneBeacon(*beaconAddress)
+		return
+	}
+
+	err := loadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	provider, err = newServerProvider(config.serverProvider())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	authProviders, err = newAuthProviders()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	joinTokenKeys, err = loadJoinTokenKeys()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	if standalone {
+		runStandalone()
+		return
+	}
+
+	for _, rt := range routes {
+		http.HandleFunc(rt.Path, rt.Handler)
+	}
+
 	appengine.Main()
 }
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testToken = "tok-dev"
+
+// recordedTask is a task scheduled through recordingTasks
+type recordedTask struct {
+	Path      string
+	Params    url.Values
+	QueueName string
+}
+
+// recordingTasks is a taskDispatcher that keeps tasks for the test to run or inspect
+type recordingTasks struct {
+	added []recordedTask
+}
+
+func (t *recordingTasks) Add(ctx context.Context, path string, params url.Values, delay time.Duration, queueName string) error {
+	t.added = append(t.added, recordedTask{Path: path, Params: params, QueueName: queueName})
+	return nil
+}
+
+// withPath returns the tasks scheduled for path
+func (t *recordingTasks) withPath(path string) (found []recordedTask) {
+	for _, task := range t.added {
+		if task.Path == path {
+			found = append(found, task)
+		}
+	}
+
+	return
+}
+
+// setupTestCoordinator configures a standalone coordinator with memory stores, a test auth
+// platform and the fake provider. configure may adjust the configuration before it is validated.
+func setupTestCoordinator(t *testing.T, configure func(c *coordinatorConfig)) *recordingTasks {
+	standalone = true
+
+	config = defaultConfig()
+	config.Steam.Enabled = false
+	config.Auth.TestTokens = map[string]string{"dev": testToken}
+	config.Auth.SessionKeys = []sessionKeyConfig{{ID: "test", Secret: strings.Repeat("s", minSessionSecretLength)}}
+	config.RateLimits.Enabled = false
+	config.Servers.Provider = "fake"
+
+	if configure != nil {
+		configure(&config)
+	}
+
+	config.applyRegionDefaults()
+	config.applyModeDefaults()
+
+	problems := config.validate()
+	if len(problems) > 0 {
+		t.Fatalf("invalid test configuration: %v", problems.Error())
+	}
+
+	var err error
+
+	authProviders, err = newAuthProviders()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider, err = newServerProvider(config.serverProvider())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	joinTokenKeys = nil
+	cache = newMemoryCacheStore()
+	useMemoryStores()
+
+	recorder := &recordingTasks{}
+	tasks = recorder
+
+	return recorder
+}
+
+// runTask calls handler with the task's params as a task request on its given attempt
+func runTask(handler http.HandlerFunc, task recordedTask, attempt int) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", task.Path, strings.NewReader(task.Params.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set(taskRetryCountHeader, strconv.Itoa(attempt))
+
+	w := httptest.NewRecorder()
+	handler(w, req)
+
+	return w
+}
+
+// putTestServer stores an active server of the default mode with playerCount of 10 players
+func putTestServer(t *testing.T, id, region string, playerCount int) gameServer {
+	server := gameServer{
+		UUID:           id,
+		Address:        "10.0.0.1",
+		Port:           7777,
+		Region:         region,
+		Mode:           defaultModeName,
+		State:          serverStateActive,
+		CreationTime:   time.Now(),
+		CheckTime:      time.Now(),
+		PlayerCount:    playerCount,
+		MaxPlayerCount: 10,
+		Fill:           float32(playerCount) / 10,
+	}
+
+	err := servers.PutServer(context.Background(), server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return server
+}
+
+// getTestJoin returns the join record stored for joinToken in the memory store
+func getTestJoin(joinToken string) (joinRecord, error) {
+	store := joins.(*memoryJoinStore)
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	join, ok := store.joins[joinToken]
+	if !ok {
+		return joinRecord{}, errNotFound
+	}
+
+	return join, nil
+}
+
+// fakeSteamAPI answers the Steam Web API requests the coordinator makes, counting them by path
+type fakeSteamAPI struct {
+	tickets  map[string]steamAuthParams // By ticket, unknown tickets fail to authenticate
+	bans     map[string]steamPlayerBans // By Steam ID
+	requests map[string]int
+}
+
+// useFakeSteamAPI enables Steam auth against a fake Web API, returning it and a function restoring
+// the default transport
+func useFakeSteamAPI() (*fakeSteamAPI, func()) {
+	api := &fakeSteamAPI{tickets: map[string]steamAuthParams{}, bans: map[string]steamPlayerBans{}, requests: map[string]int{}}
+
+	config.Steam.Enabled = true
+	authProviders[steamPlatform] = steamAuthProvider{}
+
+	transport := http.DefaultTransport
+	http.DefaultTransport = api
+
+	return api, func() { http.DefaultTransport = transport }
+}
+
+func (api *fakeSteamAPI) RoundTrip(req *http.Request) (*http.Response, error) {
+	api.requests[req.URL.Path]++
+
+	var body interface{}
+
+	switch req.URL.Path {
+	case "/ISteamUserAuth/AuthenticateUserTicket/v1/":
+		params, ok := api.tickets[req.URL.Query().Get("ticket")]
+		if ok {
+			params.Result = "OK"
+			body = steamAuthMessage{Response: steamAuthResponse{Params: params}}
+		} else {
+			body = steamAuthMessage{Response: steamAuthResponse{Error: steamAuthError{ErrorCode: 101, ErrorDesc: "Invalid ticket"}}}
+		}
+	case "/ISteamUser/GetPlayerBans/v1/":
+		message := steamPlayerBansMessage{}
+		for _, steamID := range strings.Split(req.URL.Query().Get("steamids"), ",") {
+			bans := api.bans[steamID]
+			bans.SteamID = steamID
+			message.Players = append(message.Players, bans)
+		}
+		body = message
+	default:
+		return &http.Response{StatusCode: http.StatusNotFound, Body: ioutil.NopCloser(strings.NewReader("")), Request: req}, nil
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: ioutil.NopCloser(bytes.NewReader(data)), Request: req}, nil
+}
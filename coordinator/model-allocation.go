@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	allocationStateRequested = 0 // Allocate task scheduled
+	allocationStatePending   = 1 // Accepted by the provider, waiting for an address
+	allocationStateFulfilled = 2 // GameServer record created
+	allocationStateFailed    = 3
+	allocationStateReleased  = 4 // Deallocated from the provider
+)
+
+var allocationStateNames = []string{"requested", "pending", "fulfilled", "failed", "released"}
+
+// allocationTransitions lists the states each state may move to
+var allocationTransitions = map[int][]int{
+	allocationStateRequested: {allocationStatePending, allocationStateFailed, allocationStateReleased},
+	allocationStatePending:   {allocationStateFulfilled, allocationStateFailed, allocationStateReleased},
+	allocationStateFulfilled: {allocationStateReleased},
+	allocationStateFailed:    {allocationStateReleased},
+}
+
+// allocation tracks a server requested from the provider, keyed by the server UUID
+type allocation struct {
+	ServerID         string
+	Region           string
+	Mode             string
+	State            int
+	CreationTime     time.Time
+	UpdateTime       time.Time // Time of the last state change
+	AllocateAttempts int
+	CheckAttempts    int
+	Error            string `datastore:",noindex"`
+}
+
+func newAllocation(serverID, region, mode string) allocation {
+	return allocation{
+		ServerID:     serverID,
+		Region:       region,
+		Mode:         mode,
+		State:        allocationStateRequested,
+		CreationTime: time.Now(),
+		UpdateTime:   time.Now(),
+	}
+}
+
+// open reports whether the allocation is still waiting on the provider
+func (a allocation) open() bool {
+	return a.State == allocationStateRequested || a.State == allocationStatePending
+}
+
+// transition moves the allocation to state, failing if the state machine does not allow it
+func (a *allocation) transition(state int) error {
+	for _, allowed := range allocationTransitions[a.State] {
+		if allowed == state {
+			a.State = state
+			a.UpdateTime = time.Now()
+			return nil
+		}
+	}
+
+	return fmt.Errorf("allocation %v cannot move from %v to %v", a.ServerID, allocationStateName(a.State), allocationStateName(state))
+}
+
+func allocationStateName(state int) string {
+	if state < 0 || state >= len(allocationStateNames) {
+		return fmt.Sprint(state)
+	}
+
+	return allocationStateNames[state]
+}
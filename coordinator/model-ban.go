@@ -0,0 +1,39 @@
+package main
+
+import "time"
+
+// ban keeps a user out of matchmaking, keyed by a UUID. UserID is the qualified platform user ID.
+type ban struct {
+	ID           string
+	UserID       string
+	Reason       string   `datastore:",noindex"`
+	Regions      []string `datastore:",noindex"` // Empty for all regions
+	Modes        []string `datastore:",noindex"` // Empty for all game modes
+	CreationTime time.Time
+	ExpiryTime   time.Time
+	Permanent    bool
+}
+
+// active reports whether the ban has not yet expired
+func (b ban) active(now time.Time) bool {
+	return b.Permanent || now.Before(b.ExpiryTime)
+}
+
+// appliesTo reports whether the ban covers the region and game mode
+func (b ban) appliesTo(region, mode string) bool {
+	return scopeContains(b.Regions, region) && scopeContains(b.Modes, mode)
+}
+
+func scopeContains(scope []string, value string) bool {
+	if len(scope) == 0 {
+		return true
+	}
+
+	for _, s := range scope {
+		if s == value {
+			return true
+		}
+	}
+
+	return false
+}
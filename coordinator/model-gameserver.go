@@ -1,11 +1,6 @@
 package main
 
-import (
-	"context"
-	"time"
-
-	"google.golang.org/appengine/datastore"
-)
+import "time"
 
 const (
 	serverStateInitializing = 0
@@ -14,36 +9,141 @@ const (
 	serverStateTerminating  = 3
 )
 
+// Signed server requests keep separate sequence numbers, so a server can send them in parallel
+const (
+	sequenceHeartbeat   = "heartbeat"
+	sequenceVerifyJoin  = "verifyjoin"
+	sequenceMatchResult = "matchresult"
+
+	sequenceWindow = 64 // Sequence numbers below the last accepted one are accepted once within this distance
+)
+
 type gameServer struct {
 	UUID           string
 	Address        string
 	Port           int
 	Region         string
+	Mode           string // Game mode, see recordMode
 	State          int
 	CreationTime   time.Time
 	CheckTime      time.Time
 	PlayerCount    int
 	MaxPlayerCount int
 	Fill           float32
+	Static         bool // Self-registered, not allocated through a provider
+
+	HeartbeatSecret   string `datastore:",noindex"` // Issued by /bootstrap or /register, signs heartbeats
+	HeartbeatSequence int64  `datastore:",noindex"` // Last accepted heartbeat sequence number
+	HeartbeatSeen     int64  `datastore:",noindex"` // Bit n set once HeartbeatSequence-n is accepted
+	RegistrationTime  int64  `datastore:",noindex"` // Timestamp of the last /register, static servers only
+
+	VerifyJoinSequence  int64 `datastore:",noindex"`
+	VerifyJoinSeen      int64 `datastore:",noindex"`
+	MatchResultSequence int64 `datastore:",noindex"`
+	MatchResultSeen     int64 `datastore:",noindex"`
+
+	// Ratings of the players matched onto the server, see addRating
+	RatingTotal  float64 `datastore:",noindex"`
+	RatedPlayers int     `datastore:",noindex"`
+	MinRating    float64 `datastore:",noindex"`
+	MaxRating    float64 `datastore:",noindex"`
+}
+
+// acceptSequence records a signed request's sequence number, reporting false if it was used before
+// or is too far behind the last to tell
+func (s *gameServer) acceptSequence(kind string, sequence int64) bool {
+	last, seen := &s.HeartbeatSequence, &s.HeartbeatSeen
+
+	switch kind {
+	case sequenceVerifyJoin:
+		last, seen = &s.VerifyJoinSequence, &s.VerifyJoinSeen
+	case sequenceMatchResult:
+		last, seen = &s.MatchResultSequence, &s.MatchResultSeen
+	}
+
+	bits := uint64(*seen)
+
+	if sequence > *last {
+		shift := sequence - *last
+
+		if shift >= sequenceWindow {
+			bits = 0
+		} else {
+			bits <<= uint(shift)
+		}
+
+		*last = sequence
+		*seen = int64(bits | 1)
+
+		return true
+	}
+
+	behind := *last - sequence
+
+	if sequence <= 0 || behind == 0 || behind >= sequenceWindow || bits&(1<<uint(behind)) != 0 {
+		return false
+	}
+
+	*seen = int64(bits | 1<<uint(behind))
+
+	return true
 }
 
-func queryServer(ctx context.Context, region string, queryNonEmpty bool) (*datastore.Key, gameServer, error) {
-	var key *datastore.Key
-	var server gameServer
-	var err error
+// resetSequences forgets the accepted sequence numbers when a new heartbeat secret is issued
+func (s *gameServer) resetSequences() {
+	s.HeartbeatSequence, s.HeartbeatSeen = 0, 0
+	s.VerifyJoinSequence, s.VerifyJoinSeen = 0, 0
+	s.MatchResultSequence, s.MatchResultSeen = 0, 0
+}
 
-	var filter string
+// lastSequence returns the highest sequence number accepted on any kind of request
+func (s gameServer) lastSequence() int64 {
+	last := s.HeartbeatSequence
 
-	if queryNonEmpty {
-		filter = "Fill >"
-	} else {
-		filter = "PlayerCount ="
+	if s.VerifyJoinSequence > last {
+		last = s.VerifyJoinSequence
 	}
 
-	q := datastore.NewQuery("GameServer").Filter("Region =", region).Filter("State =", serverStateActive).Filter(filter, 0).Order("Fill").Limit(1).BatchSize(1)
+	if s.MatchResultSequence > last {
+		last = s.MatchResultSequence
+	}
 
-	t := q.Run(ctx)
-	key, err = t.Next(&server)
+	return last
+}
+
+// averageRating returns the mean rating of the server's players, false if it has none
+func (s gameServer) averageRating() (float64, bool) {
+	if s.RatedPlayers == 0 {
+		return 0, false
+	}
 
-	return key, server, err
+	return s.RatingTotal / float64(s.RatedPlayers), true
+}
+
+// addRating records a player matched onto the server
+func (s *gameServer) addRating(rating float64) {
+	if s.RatedPlayers == 0 || rating < s.MinRating {
+		s.MinRating = rating
+	}
+
+	if s.RatedPlayers == 0 || rating > s.MaxRating {
+		s.MaxRating = rating
+	}
+
+	s.RatingTotal += rating
+	s.RatedPlayers++
+}
+
+// trimRatings follows the player count reported in a heartbeat. Which players left is not known, so
+// the average is kept for the remaining players, and the range is reset once the server is empty.
+func (s *gameServer) trimRatings() {
+	if s.PlayerCount <= 0 {
+		s.RatingTotal = 0
+		s.RatedPlayers = 0
+		s.MinRating = 0
+		s.MaxRating = 0
+	} else if s.PlayerCount < s.RatedPlayers {
+		s.RatingTotal = s.RatingTotal / float64(s.RatedPlayers) * float64(s.PlayerCount)
+		s.RatedPlayers = s.PlayerCount
+	}
 }
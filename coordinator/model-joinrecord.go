@@ -7,6 +7,10 @@ type joinRecord struct {
 	ServerID     string
 	Region       string
 	JoinToken    string
+	PartyID      string // Set when the player was matched with their party
 	CreationTime time.Time
-	Checked      bool
+	Checked      bool // Delivered to the server in a heartbeat
+	Consumed     bool // Verified by the server when the player connected
+	ConsumedTime time.Time
+	Rated        bool // Counted in a match result, which ends the player's match on the server
 }
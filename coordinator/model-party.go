@@ -0,0 +1,49 @@
+package main
+
+import "time"
+
+const (
+	partyStateForming   = 0 // Accepting members until the leader starts matchmaking
+	partyStateQueued    = 1 // Join task scheduled for the whole party
+	partyStateMatched   = 2
+	partyStateFailed    = 3
+	partyStateCancelled = 4 // Every member dequeued before a server was found
+)
+
+// party is a group of users matched onto the same server, keyed by a UUID. Members are qualified
+// user IDs, the leader first.
+type party struct {
+	ID           string
+	LeaderID     string
+	Region       string
+	Mode         string
+	State        int
+	Members      []string `datastore:",noindex"`
+	ServerID     string   // Server the party's slots were reserved on
+	Placed       []string `datastore:",noindex"` // Members counted onto ServerID
+	CreationTime time.Time
+	UpdateTime   time.Time
+}
+
+func newParty(partyID, leaderID, region, mode string) party {
+	return party{
+		ID:           partyID,
+		LeaderID:     leaderID,
+		Region:       region,
+		Mode:         mode,
+		State:        partyStateForming,
+		Members:      []string{leaderID},
+		CreationTime: time.Now(),
+		UpdateTime:   time.Now(),
+	}
+}
+
+func (p party) hasMember(userID string) bool {
+	for _, member := range p.Members {
+		if member == userID {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	defaultRating     = 1500
+	defaultDeviation  = 350
+	defaultVolatility = 0.06
+	glicko2Scale      = 173.7178
+	glicko2Epsilon    = 0.000001
+)
+
+// playerRating is a user's Glicko-2 rating, keyed by the qualified user ID. Unlike MMUser records
+// ratings are kept indefinitely.
+type playerRating struct {
+	UserID     string
+	Rating     float64
+	Deviation  float64
+	Volatility float64
+	Games      int
+	UpdateTime time.Time
+}
+
+func newPlayerRating(userID string) playerRating {
+	return playerRating{
+		UserID:     userID,
+		Rating:     defaultRating,
+		Deviation:  defaultDeviation,
+		Volatility: defaultVolatility,
+	}
+}
+
+// ratingOutcome is a result against one opponent: 1 for a win, 0.5 for a draw, 0 for a loss
+type ratingOutcome struct {
+	Opponent playerRating
+	Score    float64
+}
+
+// update applies one Glicko-2 rating period containing the outcomes, using the system constant tau
+func (p *playerRating) update(outcomes []ratingOutcome, tau float64) {
+	mu := (p.Rating - defaultRating) / glicko2Scale
+	phi := p.Deviation / glicko2Scale
+
+	if len(outcomes) == 0 {
+		p.Deviation = math.Sqrt(phi*phi+p.Volatility*p.Volatility) * glicko2Scale
+		return
+	}
+
+	var vInverse, improvement float64
+
+	for _, outcome := range outcomes {
+		muJ := (outcome.Opponent.Rating - defaultRating) / glicko2Scale
+		g := glicko2G(outcome.Opponent.Deviation / glicko2Scale)
+		expected := 1 / (1 + math.Exp(-g*(mu-muJ)))
+
+		vInverse += g * g * expected * (1 - expected)
+		improvement += g * (outcome.Score - expected)
+	}
+
+	v := 1 / vInverse
+	delta := v * improvement
+
+	// Find the new volatility with the Illinois algorithm
+	a := math.Log(p.Volatility * p.Volatility)
+	f := func(x float64) float64 {
+		ex := math.Exp(x)
+		d := phi*phi + v + ex
+
+		return ex*(delta*delta-phi*phi-v-ex)/(2*d*d) - (x-a)/(tau*tau)
+	}
+
+	lower := a
+	var upper float64
+
+	if delta*delta > phi*phi+v {
+		upper = math.Log(delta*delta - phi*phi - v)
+	} else {
+		k := 1.0
+		for f(a-k*tau) < 0 {
+			k++
+		}
+		upper = a - k*tau
+	}
+
+	fLower := f(lower)
+	fUpper := f(upper)
+
+	for math.Abs(upper-lower) > glicko2Epsilon {
+		c := lower + (lower-upper)*fLower/(fUpper-fLower)
+		fC := f(c)
+
+		if fC*fUpper <= 0 {
+			lower = upper
+			fLower = fUpper
+		} else {
+			fLower /= 2
+		}
+
+		upper = c
+		fUpper = fC
+	}
+
+	volatility := math.Exp(lower / 2)
+	phiStar := math.Sqrt(phi*phi + volatility*volatility)
+	newPhi := 1 / math.Sqrt(1/(phiStar*phiStar)+1/v)
+	newMu := mu + newPhi*newPhi*improvement
+
+	p.Rating = newMu*glicko2Scale + defaultRating
+	p.Deviation = newPhi * glicko2Scale
+	p.Volatility = volatility
+}
+
+func glicko2G(phi float64) float64 {
+	return 1 / math.Sqrt(1+3*phi*phi/(math.Pi*math.Pi))
+}
@@ -1,11 +1,6 @@
 package main
 
-import (
-	"context"
-	"time"
-
-	"google.golang.org/appengine/datastore"
-)
+import "time"
 
 const (
 	mmStatusInQueue              = 0
@@ -23,16 +18,9 @@ type mmUser struct {
 	JoinTok      string
 	ServerAddr   string
 	ServerPort   int
-}
-
-func queryUser(ctx context.Context, filterKey string, filterArg string) (*datastore.Key, mmUser, error) {
-	var key *datastore.Key
-	var user mmUser
-	var err error
-
-	q := datastore.NewQuery("MMUser").Filter(filterKey, filterArg).Limit(1).BatchSize(1)
-	t := q.Run(ctx)
-	key, err = t.Next(&user)
-
-	return key, user, err
+	PartyID      string    // Set while queued as a party member
+	QueueTime    time.Time // When the user last entered the queue, widens the rating window
+	Region       string    // Queued in, or placed in after falling back
+	Mode         string    // Game mode queued for
+	Latencies    string    // As passed to /enqueue, limits the regions the user falls back to
 }
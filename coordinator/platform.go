@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	stdlog "log"
+	"net/http"
+	"time"
+
+	"google.golang.org/appengine"
+	aelog "google.golang.org/appengine/log"
+	"google.golang.org/appengine/urlfetch"
+)
+
+const (
+	standaloneHTTPTimeoutSeconds = 30
+)
+
+// standalone is true when running as a plain net/http binary rather than on App Engine
+var standalone = !appengine.IsAppEngine() && !appengine.IsDevAppServer()
+
+// newContext returns the context handlers should use for the given request
+func newContext(r *http.Request) context.Context {
+	if standalone {
+		return r.Context()
+	}
+
+	return appengine.NewContext(r)
+}
+
+// httpClient returns a client for outbound API requests
+func httpClient(ctx context.Context) *http.Client {
+	if standalone {
+		return &http.Client{Timeout: time.Second * standaloneHTTPTimeoutSeconds}
+	}
+
+	return urlfetch.Client(ctx)
+}
+
+// contextLogger mirrors the App Engine log package, writing to stderr when running standalone
+type contextLogger struct{}
+
+var log contextLogger
+
+func (contextLogger) Debugf(ctx context.Context, format string, args ...interface{}) {
+	if standalone {
+		stdlog.Printf("DEBUG: %v", fmt.Sprintf(format, args...))
+		return
+	}
+
+	aelog.Debugf(ctx, format, args...)
+}
+
+func (contextLogger) Infof(ctx context.Context, format string, args ...interface{}) {
+	if standalone {
+		stdlog.Printf("INFO: %v", fmt.Sprintf(format, args...))
+		return
+	}
+
+	aelog.Infof(ctx, format, args...)
+}
+
+func (contextLogger) Warningf(ctx context.Context, format string, args ...interface{}) {
+	if standalone {
+		stdlog.Printf("WARNING: %v", fmt.Sprintf(format, args...))
+		return
+	}
+
+	aelog.Warningf(ctx, format, args...)
+}
+
+func (contextLogger) Errorf(ctx context.Context, format string, args ...interface{}) {
+	if standalone {
+		stdlog.Printf("ERROR: %v", fmt.Sprintf(format, args...))
+		return
+	}
+
+	aelog.Errorf(ctx, format, args...)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"strings"
+)
+
+// clanForgeProvider allocates servers from Multiplay through the ClanForge API
+type clanForgeProvider struct{}
+
+func (clanForgeProvider) Allocate(ctx context.Context, serverID, region, mode string) error {
+	response, err := queryClanForgeAlloc(ctx, serverID, recordMode(mode).ClanForgeProfileID, getRegionID(region))
+
+	if err != nil {
+		return err
+	}
+
+	if !response.Success {
+		return &clanForgeError{Kind: clanForgeErrorCapacity, StatusCode: 200, Message: "allocation failed: " + strings.Join(response.Messages, ",")}
+	}
+
+	return nil
+}
+
+func (clanForgeProvider) GetAllocation(ctx context.Context, serverID string) (info allocationsResponseInfo, err error) {
+	response, err := queryClanForgeAllocations(ctx, serverID)
+
+	if err != nil {
+		return
+	}
+
+	if !response.Success {
+		err = &clanForgeError{Kind: clanForgeErrorRequest, StatusCode: 200, Message: "allocation check failed: " + strings.Join(response.Messages, ",")}
+		return
+	}
+
+	if len(response.Allocations) == 0 {
+		err = errAllocationNotFound
+		return
+	}
+
+	info = response.Allocations[0]
+	return
+}
+
+// Available reports whether the circuit breaker allows allocations
+func (clanForgeProvider) Available(ctx context.Context) bool {
+	return !clanForgeCircuitOpen(ctx)
+}
+
+func (clanForgeProvider) Deallocate(ctx context.Context, serverID string) error {
+	_, err := queryClanForgeDealloc(ctx, serverID)
+
+	return err
+}
+
+// ListAllocations lists the allocations of every mode's profile
+func (clanForgeProvider) ListAllocations(ctx context.Context) (allocations []allocationsResponseInfo, err error) {
+	queried := make(map[string]bool)
+
+	for _, mode := range config.Modes {
+		if queried[mode.ClanForgeProfileID] {
+			continue
+		}
+		queried[mode.ClanForgeProfileID] = true
+
+		response, err := queryClanForgeProfileAllocations(ctx, mode.ClanForgeProfileID)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !response.Success {
+			return nil, &clanForgeError{Kind: clanForgeErrorRequest, StatusCode: 200, Message: "allocations query failed: " + strings.Join(response.Messages, ",")}
+		}
+
+		allocations = append(allocations, response.Allocations...)
+	}
+
+	return
+}
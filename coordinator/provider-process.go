@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	processServerHost               = "127.0.0.1"
+	processServerStopTimeoutSeconds = 10
+)
+
+// processServerProvider launches a game server executable per allocation on a free localhost port
+type processServerProvider struct {
+	path   string
+	args   []string
+	logDir string
+
+	mu        sync.Mutex
+	processes map[string]*serverProcess
+}
+
+type serverProcess struct {
+	info   allocationsResponseInfo
+	cmd    *exec.Cmd
+	exited chan struct{}
+	err    error
+}
+
+// newProcessServerProvider creates a provider running path with args, in which {uuid}, {region},
+// {mode} and {port} are substituted per allocation
+func newProcessServerProvider(path string, args []string, logDir string) (*processServerProvider, error) {
+	if path == "" {
+		return nil, fmt.Errorf("process provider requires a server executable")
+	}
+
+	err := os.MkdirAll(logDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	return &processServerProvider{
+		path:      path,
+		args:      args,
+		logDir:    logDir,
+		processes: make(map[string]*serverProcess),
+	}, nil
+}
+
+func (p *processServerProvider) Allocate(ctx context.Context, serverID, region, mode string) error {
+	port, err := freeLocalPort()
+	if err != nil {
+		return err
+	}
+
+	replacer := strings.NewReplacer("{uuid}", serverID, "{region}", region, "{mode}", mode, "{port}", strconv.Itoa(port))
+
+	args := make([]string, len(p.args))
+	for i, arg := range p.args {
+		args[i] = replacer.Replace(arg)
+	}
+
+	logFile, err := os.Create(filepath.Join(p.logDir, serverID+".log"))
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(p.path, args...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.Env = append(os.Environ(),
+		"COORDINATOR_SERVER_ID="+serverID,
+		"COORDINATOR_SERVER_REGION="+region,
+		"COORDINATOR_SERVER_MODE="+mode,
+		"COORDINATOR_SERVER_PORT="+strconv.Itoa(port),
+	)
+
+	err = cmd.Start()
+	if err != nil {
+		logFile.Close()
+		return err
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	process := &serverProcess{
+		info: allocationsResponseInfo{
+			UUID:      serverID,
+			Regions:   region,
+			Created:   now,
+			Requested: now,
+			Fulfilled: now,
+			ServerID:  cmd.Process.Pid,
+			IP:        processServerHost,
+			GamePort:  port,
+		},
+		cmd:    cmd,
+		exited: make(chan struct{}),
+	}
+
+	go func() {
+		process.err = cmd.Wait()
+		logFile.Close()
+		close(process.exited)
+	}()
+
+	p.mu.Lock()
+	p.processes[serverID] = process
+	p.mu.Unlock()
+
+	log.Infof(ctx, "[Process] Started server %v (pid %v) on port %v", serverID, cmd.Process.Pid, port)
+
+	return nil
+}
+
+func (p *processServerProvider) GetAllocation(ctx context.Context, serverID string) (allocationsResponseInfo, error) {
+	p.mu.Lock()
+	process, ok := p.processes[serverID]
+	p.mu.Unlock()
+
+	if !ok {
+		return allocationsResponseInfo{}, errAllocationNotFound
+	}
+
+	return process.report(), nil
+}
+
+func (p *processServerProvider) Deallocate(ctx context.Context, serverID string) error {
+	p.mu.Lock()
+	process, ok := p.processes[serverID]
+	delete(p.processes, serverID)
+	p.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	process.stop()
+
+	log.Infof(ctx, "[Process] Stopped server %v", serverID)
+
+	return nil
+}
+
+func (p *processServerProvider) ListAllocations(ctx context.Context) ([]allocationsResponseInfo, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	allocations := []allocationsResponseInfo{}
+
+	for _, process := range p.processes {
+		allocations = append(allocations, process.report())
+	}
+
+	return allocations, nil
+}
+
+// Close stops every running server process
+func (p *processServerProvider) Close() error {
+	p.mu.Lock()
+	processes := p.processes
+	p.processes = make(map[string]*serverProcess)
+	p.mu.Unlock()
+
+	for _, process := range processes {
+		process.stop()
+	}
+
+	return nil
+}
+
+// report returns the allocation info, with the address cleared and an error set once the process has exited
+func (s *serverProcess) report() allocationsResponseInfo {
+	info := s.info
+
+	select {
+	case <-s.exited:
+		info.IP = ""
+		info.GamePort = 0
+		info.Error = "server process exited"
+		if s.err != nil {
+			info.Error = fmt.Sprintf("server process exited: %v", s.err)
+		}
+	default:
+	}
+
+	return info
+}
+
+// stop interrupts the process, killing it if it has not exited within the timeout
+func (s *serverProcess) stop() {
+	err := s.cmd.Process.Signal(os.Interrupt)
+	if err != nil {
+		s.cmd.Process.Kill()
+	}
+
+	select {
+	case <-s.exited:
+	case <-time.After(time.Second * processServerStopTimeoutSeconds):
+		s.cmd.Process.Kill()
+		<-s.exited
+	}
+}
+
+// freeLocalPort finds a localhost port free for both TCP and UDP
+func freeLocalPort() (int, error) {
+	for {
+		tcp, err := net.Listen("tcp", processServerHost+":0")
+		if err != nil {
+			return 0, err
+		}
+
+		port := tcp.Addr().(*net.TCPAddr).Port
+
+		udp, err := net.ListenPacket("udp", net.JoinHostPort(processServerHost, strconv.Itoa(port)))
+		tcp.Close()
+
+		if err == nil {
+			udp.Close()
+			return port, nil
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errAllocationNotFound = errors.New("allocation not found")
+
+// serverProvider allocates game servers from a hosting backend. Allocations are identified by the
+// coordinator generated server UUID, and report their address in the shape of a ClanForge allocation.
+// Servers are allocated for a game mode, which picks the server profile to run.
+type serverProvider interface {
+	Allocate(ctx context.Context, serverID, region, mode string) error
+	GetAllocation(ctx context.Context, serverID string) (allocationsResponseInfo, error)
+	Deallocate(ctx context.Context, serverID string) error
+	ListAllocations(ctx context.Context) ([]allocationsResponseInfo, error)
+}
+
+var provider serverProvider = clanForgeProvider{}
+
+// providerHealth is implemented by providers that know when their backend is failing
+type providerHealth interface {
+	Available(ctx context.Context) bool
+}
+
+// providerAvailable reports whether new allocations should be requested from the provider
+func providerAvailable(ctx context.Context) bool {
+	health, ok := provider.(providerHealth)
+
+	return !ok || health.Available(ctx)
+}
+
+// newServerProvider creates the named provider using its configured settings
+func newServerProvider(name string) (serverProvider, error) {
+	switch name {
+	case "clanforge":
+		return clanForgeProvider{}, nil
+	case "fake":
+		fake := config.Servers.Fake
+		return newFakeServerProvider(fake.Address, fake.Port, time.Second*time.Duration(fake.ReadyDelaySeconds)), nil
+	case "process":
+		process := config.Servers.Process
+		return newProcessServerProvider(process.Path, strings.Fields(process.Args), filepath.Join(config.Standalone.DataDir, "servers"))
+	}
+
+	return nil, fmt.Errorf("unknown server provider %q", name)
+}
+
+// fakeServerProvider hands out allocations that all point at a fixed address once readyDelay has passed
+type fakeServerProvider struct {
+	address    string
+	port       int
+	readyDelay time.Duration
+
+	mu          sync.Mutex
+	allocations map[string]allocationsResponseInfo
+}
+
+func newFakeServerProvider(address string, port int, readyDelay time.Duration) *fakeServerProvider {
+	return &fakeServerProvider{
+		address:     address,
+		port:        port,
+		readyDelay:  readyDelay,
+		allocations: make(map[string]allocationsResponseInfo),
+	}
+}
+
+func (p *fakeServerProvider) Allocate(ctx context.Context, serverID, region, mode string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.allocations[serverID] = allocationsResponseInfo{
+		UUID:      serverID,
+		Regions:   region,
+		Created:   time.Now().UTC().Format(time.RFC3339),
+		Requested: time.Now().UTC().Format(time.RFC3339),
+	}
+
+	return nil
+}
+
+func (p *fakeServerProvider) GetAllocation(ctx context.Context, serverID string) (allocationsResponseInfo, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	info, ok := p.allocations[serverID]
+	if !ok {
+		return info, errAllocationNotFound
+	}
+
+	return p.fulfil(info), nil
+}
+
+func (p *fakeServerProvider) Deallocate(ctx context.Context, serverID string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.allocations, serverID)
+
+	return nil
+}
+
+func (p *fakeServerProvider) ListAllocations(ctx context.Context) ([]allocationsResponseInfo, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	allocations := []allocationsResponseInfo{}
+
+	for _, info := range p.allocations {
+		allocations = append(allocations, p.fulfil(info))
+	}
+
+	return allocations, nil
+}
+
+func (p *fakeServerProvider) fulfil(info allocationsResponseInfo) allocationsResponseInfo {
+	requested, err := time.Parse(time.RFC3339, info.Requested)
+
+	if err == nil && time.Now().Sub(requested) >= p.readyDelay {
+		info.IP = p.address
+		info.GamePort = p.port
+		info.Fulfilled = requested.Add(p.readyDelay).Format(time.RFC3339)
+	}
+
+	return info
+}
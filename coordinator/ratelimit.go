@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	rateLimitKey           = "RateLimit-"
+	rateLimitExpiryMinutes = 10 // Idle buckets are dropped from the cache after refilling plus this
+)
+
+// allowRequest takes a token from the bucket for key. Buckets hold limit.Burst tokens and refill at
+// limit.RequestsPerMinute. The bucket is stored in the shared cache as the time, in milliseconds,
+// at which it will next be full (GCRA), so one Increment takes a token atomically across instances.
+func allowRequest(ctx context.Context, key string, limit rateLimitConfig) (allowed bool, retryAfter time.Duration, err error) {
+	if limit.RequestsPerMinute <= 0 {
+		return true, 0, nil
+	}
+
+	interval := int64(math.Ceil(60000 / limit.RequestsPerMinute))
+	capacity := interval * int64(limit.Burst)
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	key = rateLimitKey + key
+
+	full, err := cache.Increment(ctx, key, interval, 0)
+	if err != nil {
+		return
+	}
+
+	// A missing or refilled bucket restarts from now
+	if int64(full)-interval < now {
+		full = uint64(now + interval)
+		expiration := time.Millisecond*time.Duration(capacity) + time.Minute*rateLimitExpiryMinutes
+
+		err = cache.Set(ctx, key, []byte(strconv.FormatUint(full, 10)), expiration)
+		if err != nil {
+			return
+		}
+	}
+
+	wait := int64(full) - now - capacity
+	if wait <= 0 {
+		return true, 0, nil
+	}
+
+	// Return the token, rejected requests don't count against the bucket
+	_, err = cache.Increment(ctx, key, -interval, 0)
+
+	return false, time.Millisecond * time.Duration(wait), err
+}
+
+// limitRequest applies the rate limit for key, responding with 429 and returning false once the
+// bucket is empty. Requests are allowed if the cache fails.
+func limitRequest(ctx context.Context, w http.ResponseWriter, tag, key string, limit rateLimitConfig) bool {
+	if !config.RateLimits.Enabled {
+		return true
+	}
+
+	allowed, retryAfter, err := allowRequest(ctx, key, limit)
+
+	if err != nil {
+		log.Errorf(ctx, "%v %v", tag, err.Error())
+		return true
+	}
+
+	if !allowed {
+		log.Warningf(ctx, "%v Rate limited %v", tag, key)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		http.Error(w, "Too Many Requests.", http.StatusTooManyRequests)
+		return false
+	}
+
+	return true
+}
+
+// limitClientRequest applies the per IP limit for the endpoint
+func limitClientRequest(ctx context.Context, w http.ResponseWriter, r *http.Request, tag, endpoint string, limits endpointRateLimitConfig) bool {
+	return limitRequest(ctx, w, tag, fmt.Sprintf("%v-IP-%v", endpoint, remoteIP(r)), limits.PerIP)
+}
+
+// limitUserRequest applies the per user limit for the endpoint
+func limitUserRequest(ctx context.Context, w http.ResponseWriter, tag, endpoint, userID string, limits endpointRateLimitConfig) bool {
+	return limitRequest(ctx, w, tag, fmt.Sprintf("%v-User-%v", endpoint, userID), limits.PerUser)
+}
+
+// remoteIP returns the host part of the request's remote address
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
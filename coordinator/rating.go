@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// getPlayerRating returns the user's rating, or the initial rating for a new player
+func getPlayerRating(ctx context.Context, userID string) (playerRating, error) {
+	rating, err := ratings.GetRating(ctx, userID)
+
+	if err == errNotFound {
+		return newPlayerRating(userID), nil
+	}
+
+	return rating, err
+}
+
+// ratingWindow returns how far from a ticket's rating a server's average may be after waiting since
+// queued. On the final attempt any server is accepted rather than failing the ticket.
+func ratingWindow(queued time.Time, attempts int) float64 {
+	if attempts >= noServersRetryAttempts {
+		return math.Inf(1)
+	}
+
+	settings := config.Matchmaking.Rating
+	window := settings.InitialWindow + settings.WidenPerSecond*time.Now().Sub(queued).Seconds()
+
+	return math.Min(window, settings.MaxWindow)
+}
+
+// findRatedServer returns the active server of the mode in region with at least slots free places
+// whose average rating is closest to rating, within window. Without one, a server with no rated
+// players is used.
+func findRatedServer(ctx context.Context, region, mode string, slots int, rating, window float64) (found gameServer, err error) {
+	regionServers, err := servers.ListServers(ctx, region)
+
+	if err != nil {
+		return
+	}
+
+	var unrated gameServer
+	foundRated := false
+	foundUnrated := false
+	bestDistance := math.Inf(1)
+
+	for _, server := range regionServers {
+		if server.State != serverStateActive || server.Mode != mode || server.MaxPlayerCount-server.PlayerCount < slots {
+			continue
+		}
+
+		average, rated := server.averageRating()
+
+		if !rated {
+			if !foundUnrated || server.Fill > unrated.Fill {
+				unrated = server
+				foundUnrated = true
+			}
+			continue
+		}
+
+		distance := math.Abs(average - rating)
+
+		if distance <= window && (distance < bestDistance || (distance == bestDistance && server.Fill > found.Fill)) {
+			found = server
+			foundRated = true
+			bestDistance = distance
+		}
+	}
+
+	if foundRated {
+		return
+	}
+
+	if foundUnrated {
+		return unrated, nil
+	}
+
+	return gameServer{}, errNotFound
+}
+
+// rankingOutcomes scores each player against every other player in a ranking, best first
+func rankingOutcomes(ranking []playerRating, position int) (outcomes []ratingOutcome) {
+	for i, opponent := range ranking {
+		if i == position {
+			continue
+		}
+
+		score := 0.0
+		if position < i {
+			score = 1
+		}
+
+		outcomes = append(outcomes, ratingOutcome{Opponent: opponent, Score: score})
+	}
+
+	return
+}
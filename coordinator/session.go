@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var errInvalidSession = errors.New("invalid session token")
+
+// sessionClaims identify the matchmaking session a token was issued for
+type sessionClaims struct {
+	UserID    string `json:"uid"`
+	MMTok     string `json:"mmt"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// issueSessionToken signs a session token for the user's matchmaking token with the first session
+// key. Tokens have the form <key id>.<base64url claims>.<base64url HMAC-SHA256>.
+func issueSessionToken(userID, mmtok string) (token string, expires time.Time, err error) {
+	key := config.Auth.SessionKeys[0]
+	expires = time.Now().Add(time.Minute * time.Duration(config.Auth.SessionTTLMinutes))
+
+	payload, err := json.Marshal(sessionClaims{UserID: userID, MMTok: mmtok, ExpiresAt: expires.Unix()})
+	if err != nil {
+		return
+	}
+
+	signed := key.ID + "." + base64.RawURLEncoding.EncodeToString(payload)
+	token = signed + "." + base64.RawURLEncoding.EncodeToString(signSession(key.Secret, signed))
+
+	return
+}
+
+// verifySessionToken checks the token signature against the session key it names and its expiry
+func verifySessionToken(token string) (claims sessionClaims, err error) {
+	err = errInvalidSession
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return
+	}
+
+	signature, decodeErr := base64.RawURLEncoding.DecodeString(parts[2])
+	if decodeErr != nil {
+		return
+	}
+
+	for _, key := range config.Auth.SessionKeys {
+		if key.ID != parts[0] {
+			continue
+		}
+
+		if !hmac.Equal(signature, signSession(key.Secret, parts[0]+"."+parts[1])) {
+			return
+		}
+
+		payload, decodeErr := base64.RawURLEncoding.DecodeString(parts[1])
+		if decodeErr != nil || json.Unmarshal(payload, &claims) != nil {
+			return
+		}
+
+		if time.Now().Unix() >= claims.ExpiresAt {
+			return
+		}
+
+		err = nil
+		return
+	}
+
+	return
+}
+
+// sessionToken reads the token from the Authorization bearer header or the SessionToken parameter
+func sessionToken(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimPrefix(header, "Bearer ")
+	}
+
+	return r.URL.Query().Get("SessionToken")
+}
+
+func signSession(secret, signed string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+
+	return mac.Sum(nil)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+const (
+	shutdownTimeoutSeconds = 30
+)
+
+type cronJob struct {
+	Path     string
+	Interval time.Duration
+}
+
+// Mirrors cron.yaml
+var standaloneCronJobs = []cronJob{
+	{Path: "/manage", Interval: time.Minute},
+	{Path: "/freeallocs", Interval: time.Hour},
+	{Path: "/reconcile", Interval: time.Minute * 15},
+	{Path: "/stats", Interval: time.Hour * 24},
+}
+
+// runStandalone serves the coordinator with net/http, running tasks and cron jobs in-process
+func runStandalone() {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var journal *storeJournal
+
+	// Tasks act on stored records, so they are only kept across restarts along with the records
+	tasksDir := ""
+
+	if config.Standalone.Store == standaloneStoreMemory {
+		log.Warningf(ctx, "[Standalone] Using in-memory stores, all records and queued tasks are lost on restart")
+		useMemoryStores()
+	} else {
+		tasksDir = filepath.Join(config.Standalone.DataDir, "tasks")
+
+		var err error
+
+		journal, err = useFileStores(ctx, filepath.Join(config.Standalone.DataDir, "store"))
+		if err != nil {
+			log.Errorf(ctx, "[Standalone] Failed to restore stores: %v", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	cache = newMemoryCacheStore()
+
+	// Tasks and cron call handlers directly, admin endpoints are only exposed with a token
+
+	internal := http.NewServeMux()
+	public := http.NewServeMux()
+	adminToken := config.Standalone.AdminToken
+
+	for _, rt := range routes {
+		internal.HandleFunc(rt.Path, rt.Handler)
+
+		if !rt.Admin {
+			public.HandleFunc(rt.Path, rt.Handler)
+		} else if adminToken != "" {
+			public.HandleFunc(rt.Path, requireAdminToken(adminToken, rt.Handler))
+		}
+	}
+
+	queueConfigs, err := loadTaskQueueConfigs(config.Standalone.Queues)
+	if err != nil {
+		log.Errorf(ctx, "[Standalone] Failed to load task queues: %v", err.Error())
+		os.Exit(1)
+	}
+
+	localTasks, err := newLocalTaskDispatcher(ctx, internal, tasksDir, queueConfigs)
+	if err != nil {
+		log.Errorf(ctx, "[Standalone] Failed to restore task queues: %v", err.Error())
+		os.Exit(1)
+	}
+
+	tasks = localTasks
+	localTasks.Start()
+
+	for _, job := range standaloneCronJobs {
+		go runCronJob(ctx, internal, job)
+	}
+
+	if config.Standalone.Beacon != "" {
+		go func() {
+			err := runBeacon(ctx, config.Standalone.Beacon)
+			if err != nil {
+				log.Errorf(ctx, "[Beacon] %v", err.Error())
+			}
+		}()
+	}
+
+	server := &http.Server{Addr: config.Standalone.Address, Handler: public}
+
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+
+		log.Infof(ctx, "[Standalone] Shutting down...")
+
+		cancel()
+
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), time.Second*shutdownTimeoutSeconds)
+		defer shutdownCancel()
+
+		err := server.Shutdown(shutdownCtx)
+		if err != nil {
+			log.Errorf(ctx, "[Standalone] %v", err.Error())
+		}
+	}()
+
+	log.Infof(ctx, "[Standalone] Listening on %v", config.Standalone.Address)
+
+	err = server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		log.Errorf(ctx, "[Standalone] %v", err.Error())
+		os.Exit(1)
+	}
+
+	localTasks.Wait()
+
+	if journal != nil {
+		err = journal.Close()
+		if err != nil {
+			log.Errorf(ctx, "[Standalone] %v", err.Error())
+		}
+	}
+
+	if closer, ok := provider.(io.Closer); ok {
+		closer.Close()
+	}
+
+	log.Infof(ctx, "[Standalone] Stopped")
+}
+
+// runStandaloneBeacon serves only a ping beacon until interrupted
+func runStandaloneBeacon(address string) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+
+		cancel()
+	}()
+
+	err := runBeacon(ctx, address)
+	if err != nil {
+		log.Errorf(ctx, "[Beacon] %v", err.Error())
+		os.Exit(1)
+	}
+}
+
+func runCronJob(ctx context.Context, handler http.Handler, job cronJob) {
+	ticker := time.NewTicker(job.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		header := http.Header{}
+		header.Set("X-Appengine-Cron", "true")
+
+		status := invokeHandler(ctx, handler, "GET", job.Path, url.Values{}, header)
+
+		if status < 200 || status >= 300 {
+			log.Errorf(ctx, "[Cron] %v returned status %v", job.Path, status)
+		}
+	}
+}
+
+func requireAdminToken(token string, handler http.HandlerFunc) http.HandlerFunc {
+	expected := []byte("Bearer " + token)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			http.Error(w, "Forbidden.", http.StatusForbidden)
+			return
+		}
+
+		handler(w, r)
+	}
+}
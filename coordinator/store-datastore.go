@@ -0,0 +1,687 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// Entities are keyed by their natural identifier (GameServer, Allocation, Ban and Party by UUID, MMUser by
+// UserID, PlayerRating by UserID, JoinRecord by JoinToken) so lookups and updates do not need a query first.
+// Earlier versions saved GameServer, MMUser and JoinRecord entities with auto-allocated IDs. Lookups by
+// key fall back to finding those by property and re-keying them, and /migratekeys re-keys the rest.
+
+type legacyKeyedKind struct {
+	Kind         string
+	NameProperty string // Holds the natural identifier the entity is now keyed by
+}
+
+var (
+	legacyServers = legacyKeyedKind{Kind: "GameServer", NameProperty: "UUID"}
+	legacyUsers   = legacyKeyedKind{Kind: "MMUser", NameProperty: "UserID"}
+	legacyJoins   = legacyKeyedKind{Kind: "JoinRecord", NameProperty: "JoinToken"}
+
+	legacyKeyedKinds = []legacyKeyedKind{legacyServers, legacyUsers, legacyJoins}
+)
+
+type datastoreServerStore struct{}
+
+func (datastoreServerStore) GetServer(ctx context.Context, serverID string) (server gameServer, err error) {
+	err = withLegacyFallback(ctx, legacyServers, serverID, func() error {
+		err := datastore.Get(ctx, datastore.NewKey(ctx, "GameServer", serverID, 0, nil), &server)
+
+		if err == datastore.ErrNoSuchEntity {
+			err = errNotFound
+		}
+
+		return err
+	})
+
+	return
+}
+
+func (datastoreServerStore) FindServer(ctx context.Context, region, mode string, queryNonEmpty bool) (server gameServer, err error) {
+	var filter string
+
+	if queryNonEmpty {
+		filter = "Fill >"
+	} else {
+		filter = "PlayerCount ="
+	}
+
+	q := datastore.NewQuery("GameServer").Filter("Region =", region).Filter("State =", serverStateActive).Filter("Mode =", mode).Filter(filter, 0).Order("Fill").Limit(1).BatchSize(1)
+
+	t := q.Run(ctx)
+	_, err = t.Next(&server)
+
+	if err == datastore.Done {
+		err = errNotFound
+	}
+
+	return
+}
+
+func (datastoreServerStore) ListServers(ctx context.Context, region string) (servers []gameServer, err error) {
+	q := datastore.NewQuery("GameServer").Filter("Region =", region)
+
+	_, err = q.GetAll(ctx, &servers)
+
+	return
+}
+
+func (datastoreServerStore) PutServer(ctx context.Context, server gameServer) (err error) {
+	_, err = datastore.Put(ctx, datastore.NewKey(ctx, "GameServer", server.UUID, 0, nil), &server)
+
+	return
+}
+
+func (datastoreServerStore) UpdateServer(ctx context.Context, serverID string, update func(server *gameServer) error) error {
+	return withLegacyFallback(ctx, legacyServers, serverID, func() error {
+		return updateServer(ctx, serverID, update)
+	})
+}
+
+func updateServer(ctx context.Context, serverID string, update func(server *gameServer) error) error {
+	return datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		key := datastore.NewKey(tc, "GameServer", serverID, 0, nil)
+
+		var server gameServer
+		err := datastore.Get(tc, key, &server)
+
+		if err == datastore.ErrNoSuchEntity {
+			return errNotFound
+		} else if err != nil {
+			return err
+		}
+
+		err = update(&server)
+		if err != nil {
+			return err
+		}
+
+		_, err = datastore.Put(tc, key, &server)
+		return err
+	}, nil)
+}
+
+func (s datastoreServerStore) AdvanceSequence(ctx context.Context, serverID, kind string, sequence int64) error {
+	return s.UpdateServer(ctx, serverID, func(server *gameServer) error {
+		if !server.acceptSequence(kind, sequence) {
+			return errReplayedRequest
+		}
+
+		return nil
+	})
+}
+
+func (datastoreServerStore) DeleteServers(ctx context.Context, serverIDs []string) (err error) {
+	keys := make([]*datastore.Key, len(serverIDs))
+
+	for i, serverID := range serverIDs {
+		keys[i] = datastore.NewKey(ctx, "GameServer", serverID, 0, nil)
+
+		legacyKeys, err := findLegacyKeys(ctx, legacyServers, serverID)
+		if err != nil {
+			return err
+		}
+
+		keys = append(keys, legacyKeys...)
+	}
+
+	err = removeFromDatastore(ctx, keys)
+
+	return
+}
+
+func (datastoreServerStore) PutServerStats(ctx context.Context, stats serverStats) (err error) {
+	_, err = datastore.Put(ctx, datastore.NewIncompleteKey(ctx, "ServerStats", nil), &stats)
+
+	return
+}
+
+func (datastoreServerStore) ListServerStats(ctx context.Context, before time.Time) (stats []serverStats, err error) {
+	q := datastore.NewQuery("ServerStats").Filter("Timestamp <", before)
+
+	_, err = q.GetAll(ctx, &stats)
+
+	return
+}
+
+func (datastoreServerStore) DeleteServerStats(ctx context.Context, before time.Time) (count int, err error) {
+	q := datastore.NewQuery("ServerStats").Filter("Timestamp <", before)
+
+	count, err = deleteQuery(ctx, q)
+
+	return
+}
+
+type datastoreUserStore struct{}
+
+func (datastoreUserStore) GetUserByID(ctx context.Context, userID string) (user mmUser, err error) {
+	err = withLegacyFallback(ctx, legacyUsers, userID, func() error {
+		err := datastore.Get(ctx, datastore.NewKey(ctx, "MMUser", userID, 0, nil), &user)
+
+		if err == datastore.ErrNoSuchEntity {
+			err = errNotFound
+		}
+
+		return err
+	})
+
+	return
+}
+
+func (s datastoreUserStore) GetUserByToken(ctx context.Context, mmtok string) (user mmUser, err error) {
+	var found []mmUser
+
+	keys, err := datastore.NewQuery("MMUser").Filter("MMTok =", mmtok).GetAll(ctx, &found)
+
+	if err != nil {
+		return
+	} else if len(keys) == 0 {
+		err = errNotFound
+		return
+	}
+
+	for i, key := range keys {
+		if key.IntID() == 0 {
+			return found[i], nil
+		}
+	}
+
+	// Only an auto-ID entity has the token. Re-key it, unless the user has been saved since.
+
+	user, err = s.GetUserByID(ctx, found[0].UserID)
+
+	if err == nil && user.MMTok != mmtok {
+		err = errNotFound
+	}
+
+	return
+}
+
+func (datastoreUserStore) PutUser(ctx context.Context, user mmUser) (err error) {
+	_, err = datastore.Put(ctx, datastore.NewKey(ctx, "MMUser", user.UserID, 0, nil), &user)
+
+	return
+}
+
+func (datastoreUserStore) CountUsers(ctx context.Context) (int, error) {
+	return datastore.NewQuery("MMUser").Count(ctx)
+}
+
+func (datastoreUserStore) DeleteUsersCheckedBefore(ctx context.Context, before time.Time) (count int, err error) {
+	q := datastore.NewQuery("MMUser").Filter("CheckTime <", before)
+
+	count, err = deleteQuery(ctx, q)
+
+	return
+}
+
+type datastoreJoinStore struct{}
+
+func (datastoreJoinStore) PutJoin(ctx context.Context, join joinRecord) (err error) {
+	_, err = datastore.Put(ctx, datastore.NewKey(ctx, "JoinRecord", join.JoinToken, 0, nil), &join)
+
+	return
+}
+
+func (datastoreJoinStore) TakeUncheckedJoins(ctx context.Context, serverID string) (joins []joinRecord, err error) {
+	q := datastore.NewQuery("JoinRecord").Filter("ServerID =", serverID).Filter("Checked =", false)
+
+	keys, err := q.GetAll(ctx, &joins)
+
+	if err != nil || len(joins) == 0 {
+		return
+	}
+
+	for i := range joins {
+		joins[i].Checked = true
+	}
+
+	_, err = datastore.PutMulti(ctx, keys, joins)
+
+	return
+}
+
+func (datastoreJoinStore) UpdateJoin(ctx context.Context, joinToken string, update func(join *joinRecord) error) error {
+	return withLegacyFallback(ctx, legacyJoins, joinToken, func() error {
+		return updateJoin(ctx, joinToken, update)
+	})
+}
+
+func updateJoin(ctx context.Context, joinToken string, update func(join *joinRecord) error) error {
+	return datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		key := datastore.NewKey(tc, "JoinRecord", joinToken, 0, nil)
+
+		var join joinRecord
+		err := datastore.Get(tc, key, &join)
+
+		if err == datastore.ErrNoSuchEntity {
+			return errNotFound
+		} else if err != nil {
+			return err
+		}
+
+		err = update(&join)
+		if err != nil {
+			return err
+		}
+
+		_, err = datastore.Put(tc, key, &join)
+		return err
+	}, nil)
+}
+
+func (datastoreJoinStore) ClaimJoins(ctx context.Context, joinTokens []string) error {
+	err := claimJoins(ctx, joinTokens)
+
+	if err != errNotFound {
+		return err
+	}
+
+	// Re-key any auto-ID joins and claim again
+	for _, joinToken := range joinTokens {
+		legacyKeys, err := findLegacyKeys(ctx, legacyJoins, joinToken)
+		if err != nil {
+			return err
+		}
+
+		for _, key := range legacyKeys {
+			err = rekeyLegacyEntity(ctx, legacyJoins, key)
+
+			if err != nil && err != errNotFound {
+				return err
+			}
+		}
+	}
+
+	return claimJoins(ctx, joinTokens)
+}
+
+// claimJoins marks the joins rated in one cross-group transaction, which spans up to 25 joins
+func claimJoins(ctx context.Context, joinTokens []string) error {
+	return datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		keys := joinKeys(tc, joinTokens)
+		joins := make([]joinRecord, len(keys))
+
+		err := datastore.GetMulti(tc, keys, joins)
+
+		if multiErr, ok := err.(appengine.MultiError); ok {
+			for _, err := range multiErr {
+				if err == datastore.ErrNoSuchEntity {
+					return errNotFound
+				}
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+
+		for i := range joins {
+			if joins[i].Rated {
+				return errJoinRated
+			}
+
+			joins[i].Rated = true
+		}
+
+		_, err = datastore.PutMulti(tc, keys, joins)
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+}
+
+func (datastoreJoinStore) ReleaseJoins(ctx context.Context, joinTokens []string) error {
+	return datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		keys := joinKeys(tc, joinTokens)
+		joins := make([]joinRecord, len(keys))
+
+		err := datastore.GetMulti(tc, keys, joins)
+		if err != nil {
+			return err
+		}
+
+		for i := range joins {
+			joins[i].Rated = false
+		}
+
+		_, err = datastore.PutMulti(tc, keys, joins)
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+}
+
+func joinKeys(ctx context.Context, joinTokens []string) (keys []*datastore.Key) {
+	for _, joinToken := range joinTokens {
+		keys = append(keys, datastore.NewKey(ctx, "JoinRecord", joinToken, 0, nil))
+	}
+
+	return
+}
+
+func (datastoreJoinStore) ListServerJoins(ctx context.Context, serverID string) (joins []joinRecord, err error) {
+	since := time.Now().Add(-joinRecordExpiryTime * time.Minute)
+
+	_, err = datastore.NewQuery("JoinRecord").Filter("ServerID =", serverID).Filter("CreationTime >=", since).GetAll(ctx, &joins)
+
+	return
+}
+
+func (datastoreJoinStore) CountJoins(ctx context.Context, region string, since time.Time) (int, error) {
+	return datastore.NewQuery("JoinRecord").Filter("Region =", region).Filter("CreationTime >=", since).Count(ctx)
+}
+
+func (datastoreJoinStore) DeleteJoinsCreatedBefore(ctx context.Context, before time.Time) (count int, err error) {
+	q := datastore.NewQuery("JoinRecord").Filter("CreationTime <", before)
+
+	count, err = deleteQuery(ctx, q)
+
+	return
+}
+
+type datastoreAllocationStore struct{}
+
+func (datastoreAllocationStore) GetAllocation(ctx context.Context, serverID string) (alloc allocation, err error) {
+	err = datastore.Get(ctx, datastore.NewKey(ctx, "Allocation", serverID, 0, nil), &alloc)
+
+	if err == datastore.ErrNoSuchEntity {
+		err = errNotFound
+	}
+
+	return
+}
+
+func (datastoreAllocationStore) PutAllocation(ctx context.Context, alloc allocation) (err error) {
+	_, err = datastore.Put(ctx, datastore.NewKey(ctx, "Allocation", alloc.ServerID, 0, nil), &alloc)
+
+	return
+}
+
+func (datastoreAllocationStore) ListOpenAllocations(ctx context.Context, region string) (allocs []allocation, err error) {
+	for _, state := range []int{allocationStateRequested, allocationStatePending} {
+		q := datastore.NewQuery("Allocation").Filter("Region =", region).Filter("State =", state)
+
+		_, err = q.GetAll(ctx, &allocs)
+
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (datastoreAllocationStore) DeleteClosedAllocations(ctx context.Context, before time.Time) (count int, err error) {
+	for _, state := range []int{allocationStateFulfilled, allocationStateFailed, allocationStateReleased} {
+		q := datastore.NewQuery("Allocation").Filter("State =", state).Filter("UpdateTime <", before)
+
+		var deleted int
+		deleted, err = deleteQuery(ctx, q)
+		count += deleted
+
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+type datastoreBanStore struct{}
+
+func (datastoreBanStore) GetBan(ctx context.Context, banID string) (b ban, err error) {
+	err = datastore.Get(ctx, datastore.NewKey(ctx, "Ban", banID, 0, nil), &b)
+
+	if err == datastore.ErrNoSuchEntity {
+		err = errNotFound
+	}
+
+	return
+}
+
+func (datastoreBanStore) ListBans(ctx context.Context, userID string) (userBans []ban, err error) {
+	q := datastore.NewQuery("Ban")
+
+	if userID != "" {
+		q = q.Filter("UserID =", userID)
+	}
+
+	_, err = q.GetAll(ctx, &userBans)
+
+	return
+}
+
+func (datastoreBanStore) PutBan(ctx context.Context, b ban) (err error) {
+	_, err = datastore.Put(ctx, datastore.NewKey(ctx, "Ban", b.ID, 0, nil), &b)
+
+	return
+}
+
+func (datastoreBanStore) DeleteBan(ctx context.Context, banID string) error {
+	return datastore.Delete(ctx, datastore.NewKey(ctx, "Ban", banID, 0, nil))
+}
+
+func (datastoreBanStore) DeleteExpiredBans(ctx context.Context, before time.Time) (int, error) {
+	q := datastore.NewQuery("Ban").Filter("Permanent =", false).Filter("ExpiryTime <", before)
+
+	return deleteQuery(ctx, q)
+}
+
+type datastorePartyStore struct{}
+
+func (datastorePartyStore) GetParty(ctx context.Context, partyID string) (p party, err error) {
+	err = datastore.Get(ctx, datastore.NewKey(ctx, "Party", partyID, 0, nil), &p)
+
+	if err == datastore.ErrNoSuchEntity {
+		err = errNotFound
+	}
+
+	return
+}
+
+func (datastorePartyStore) PutParty(ctx context.Context, p party) (err error) {
+	_, err = datastore.Put(ctx, datastore.NewKey(ctx, "Party", p.ID, 0, nil), &p)
+
+	return
+}
+
+func (datastorePartyStore) UpdateParty(ctx context.Context, partyID string, update func(p *party) error) error {
+	return datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		key := datastore.NewKey(tc, "Party", partyID, 0, nil)
+
+		var p party
+		err := datastore.Get(tc, key, &p)
+
+		if err == datastore.ErrNoSuchEntity {
+			return errNotFound
+		} else if err != nil {
+			return err
+		}
+
+		err = update(&p)
+		if err != nil {
+			return err
+		}
+
+		_, err = datastore.Put(tc, key, &p)
+		return err
+	}, nil)
+}
+
+func (datastorePartyStore) ListPartiesUpdatedBefore(ctx context.Context, before time.Time) (stale []party, err error) {
+	_, err = datastore.NewQuery("Party").Filter("UpdateTime <", before).GetAll(ctx, &stale)
+
+	return
+}
+
+func (datastorePartyStore) DeleteParties(ctx context.Context, partyIDs []string) error {
+	var keys []*datastore.Key
+
+	for _, partyID := range partyIDs {
+		keys = append(keys, datastore.NewKey(ctx, "Party", partyID, 0, nil))
+	}
+
+	return removeFromDatastore(ctx, keys)
+}
+
+type datastoreRatingStore struct{}
+
+func (datastoreRatingStore) GetRating(ctx context.Context, userID string) (rating playerRating, err error) {
+	err = datastore.Get(ctx, datastore.NewKey(ctx, "PlayerRating", userID, 0, nil), &rating)
+
+	if err == datastore.ErrNoSuchEntity {
+		err = errNotFound
+	}
+
+	return
+}
+
+func (datastoreRatingStore) PutRatings(ctx context.Context, playerRatings []playerRating) error {
+	return datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		var keys []*datastore.Key
+
+		for _, rating := range playerRatings {
+			keys = append(keys, datastore.NewKey(tc, "PlayerRating", rating.UserID, 0, nil))
+		}
+
+		_, err := datastore.PutMulti(tc, keys, playerRatings)
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+}
+
+func deleteQuery(ctx context.Context, q *datastore.Query) (count int, err error) {
+	keys, err := q.KeysOnly().GetAll(ctx, nil)
+
+	if err != nil {
+		return
+	}
+
+	err = removeFromDatastore(ctx, keys)
+
+	if err != nil {
+		return
+	}
+
+	count = len(keys)
+	return
+}
+
+// withLegacyFallback runs op, and if it finds nothing re-keys any auto-ID entity of the kind named
+// name and runs it again
+func withLegacyFallback(ctx context.Context, kind legacyKeyedKind, name string, op func() error) error {
+	err := op()
+
+	if err != errNotFound {
+		return err
+	}
+
+	legacyKeys, err := findLegacyKeys(ctx, kind, name)
+
+	if err != nil {
+		return err
+	} else if len(legacyKeys) == 0 {
+		return errNotFound
+	}
+
+	for _, key := range legacyKeys {
+		err = rekeyLegacyEntity(ctx, kind, key)
+
+		if err != nil && err != errNotFound {
+			return err
+		}
+	}
+
+	return op()
+}
+
+// findLegacyKeys returns the keys of auto-ID entities of the kind named name
+func findLegacyKeys(ctx context.Context, kind legacyKeyedKind, name string) (legacyKeys []*datastore.Key, err error) {
+	keys, err := datastore.NewQuery(kind.Kind).Filter(kind.NameProperty+" =", name).KeysOnly().GetAll(ctx, nil)
+
+	for _, key := range keys {
+		if key.IntID() != 0 {
+			legacyKeys = append(legacyKeys, key)
+		}
+	}
+
+	return
+}
+
+// rekeyLegacyEntity moves an auto-ID entity to the key named by its name property. An entity already
+// saved under that key is newer, and is kept.
+func rekeyLegacyEntity(ctx context.Context, kind legacyKeyedKind, legacyKey *datastore.Key) error {
+	return datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		var props datastore.PropertyList
+
+		err := datastore.Get(tc, legacyKey, &props)
+
+		if err == datastore.ErrNoSuchEntity {
+			return errNotFound // Re-keyed by another request
+		} else if err != nil {
+			return err
+		}
+
+		name := ""
+
+		for _, prop := range props {
+			if prop.Name == kind.NameProperty {
+				name, _ = prop.Value.(string)
+			}
+		}
+
+		if name != "" {
+			key := datastore.NewKey(tc, kind.Kind, name, 0, nil)
+
+			var existing datastore.PropertyList
+			err = datastore.Get(tc, key, &existing)
+
+			if err == datastore.ErrNoSuchEntity {
+				_, err = datastore.Put(tc, key, &props)
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return datastore.Delete(tc, legacyKey)
+	}, &datastore.TransactionOptions{XG: true})
+}
+
+// migrateLegacyKeys re-keys up to batchSize auto-ID entities of each kind, reporting whether any are
+// left. Keys with IDs sort before named keys, so each batch starts with the remaining auto-ID entities.
+func migrateLegacyKeys(ctx context.Context, batchSize int) (migrated int, remaining bool, err error) {
+	for _, kind := range legacyKeyedKinds {
+		var keys []*datastore.Key
+
+		keys, err = datastore.NewQuery(kind.Kind).KeysOnly().Limit(batchSize).GetAll(ctx, nil)
+
+		if err != nil {
+			return
+		}
+
+		legacy := 0
+
+		for _, key := range keys {
+			if key.IntID() == 0 {
+				break
+			}
+
+			err = rekeyLegacyEntity(ctx, kind, key)
+
+			if err != nil && err != errNotFound {
+				return
+			}
+
+			legacy++
+		}
+
+		err = nil
+		migrated += legacy
+		remaining = remaining || legacy == batchSize
+	}
+
+	return
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	journalServers     = "servers"
+	journalStats       = "stats" // Keyed by the cutoff time on deletion, appended otherwise
+	journalUsers       = "users"
+	journalJoins       = "joins"
+	journalAllocations = "allocations"
+	journalBans        = "bans"
+	journalParties     = "parties"
+	journalRatings     = "ratings"
+
+	storeJournalFile       = "journal.log"
+	storeSnapshotFile      = "snapshot.json"
+	storeCompactionEntries = 10000 // Journal entries written before the snapshot is rewritten
+)
+
+// journalEntry records one change to a store. Value holds the saved record, and is omitted when
+// the record was deleted.
+type journalEntry struct {
+	Sequence int64
+	Kind     string
+	Key      string
+	Value    json.RawMessage `json:",omitempty"`
+}
+
+// storeSnapshot holds the contents of every store as of the journal entry Sequence
+type storeSnapshot struct {
+	Sequence    int64
+	Servers     map[string]gameServer
+	Stats       []serverStats
+	Users       map[string]mmUser
+	Joins       map[string]joinRecord
+	Allocations map[string]allocation
+	Bans        map[string]ban
+	Parties     map[string]party
+	Ratings     map[string]playerRating
+}
+
+// storeJournal makes the in-memory stores durable for standalone deployments. Each change is
+// appended to the journal before it is applied, and at startup the journal is replayed over the
+// last snapshot. Writes reach the operating system before the change is applied, so they survive
+// the coordinator crashing but not the host losing power. Store locks are always taken before the
+// journal's.
+type storeJournal struct {
+	mu       sync.Mutex
+	dir      string
+	file     *os.File
+	sequence int64
+	entries  int // Written since the last snapshot
+	compact  chan struct{}
+
+	servers     *memoryServerStore
+	users       *memoryUserStore
+	joins       *memoryJoinStore
+	allocations *memoryAllocationStore
+	bans        *memoryBanStore
+	parties     *memoryPartyStore
+	ratings     *memoryRatingStore
+}
+
+// useFileStores replaces the stores with in-memory stores restored from and journaled to dir
+func useFileStores(ctx context.Context, dir string) (*storeJournal, error) {
+	j := &storeJournal{
+		dir:         dir,
+		compact:     make(chan struct{}, 1),
+		servers:     newMemoryServerStore(),
+		users:       newMemoryUserStore(),
+		joins:       newMemoryJoinStore(),
+		allocations: newMemoryAllocationStore(),
+		bans:        newMemoryBanStore(),
+		parties:     newMemoryPartyStore(),
+		ratings:     newMemoryRatingStore(),
+	}
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	err = j.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	j.file, err = os.OpenFile(filepath.Join(dir, storeJournalFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	// Start from a fresh snapshot, dropping any partly written entry at the end of the journal
+	err = j.writeSnapshot()
+	if err != nil {
+		j.file.Close()
+		return nil, err
+	}
+
+	j.servers.journal = j
+	j.users.journal = j
+	j.joins.journal = j
+	j.allocations.journal = j
+	j.bans.journal = j
+	j.parties.journal = j
+	j.ratings.journal = j
+
+	servers = j.servers
+	users = j.users
+	joins = j.joins
+	allocations = j.allocations
+	bans = j.bans
+	parties = j.parties
+	ratings = j.ratings
+
+	go j.run(ctx)
+
+	return j, nil
+}
+
+// record appends a change to the journal, a nil value deleting key. It does nothing for stores
+// that are not backed by files.
+func (j *storeJournal) record(kind, key string, value interface{}) error {
+	if j == nil {
+		return nil
+	}
+
+	entry := journalEntry{Kind: kind, Key: key}
+
+	if value != nil {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+
+		entry.Value = data
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	entry.Sequence = j.sequence + 1
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	_, err = j.file.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+
+	j.sequence = entry.Sequence
+	j.entries++
+
+	if j.entries >= storeCompactionEntries {
+		select {
+		case j.compact <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// run rewrites the snapshot whenever the journal grows too long, until ctx is cancelled
+func (j *storeJournal) run(ctx context.Context) {
+	for {
+		select {
+		case <-j.compact:
+		case <-ctx.Done():
+			return
+		}
+
+		err := j.compactJournal()
+		if err != nil {
+			log.Errorf(ctx, "[Store] %v", err.Error())
+		}
+	}
+}
+
+// compactJournal writes a snapshot of every store and empties the journal
+func (j *storeJournal) compactJournal() error {
+	locks := []sync.Locker{&j.servers.mu, &j.users.mu, &j.joins.mu, &j.allocations.mu, &j.bans.mu, &j.parties.mu, &j.ratings.mu, &j.mu}
+
+	for _, l := range locks {
+		l.Lock()
+	}
+
+	defer func() {
+		for _, l := range locks {
+			l.Unlock()
+		}
+	}()
+
+	return j.writeSnapshot()
+}
+
+// Close snapshots the stores and closes the journal. Stores must not be written afterwards.
+func (j *storeJournal) Close() error {
+	err := j.compactJournal()
+
+	j.file.Close()
+
+	return err
+}
+
+// writeSnapshot replaces the snapshot and truncates the journal, with every lock held
+func (j *storeJournal) writeSnapshot() error {
+	snapshot := storeSnapshot{
+		Sequence:    j.sequence,
+		Servers:     j.servers.servers,
+		Stats:       j.servers.stats,
+		Users:       j.users.users,
+		Joins:       j.joins.joins,
+		Allocations: j.allocations.allocations,
+		Bans:        j.bans.bans,
+		Parties:     j.parties.parties,
+		Ratings:     j.ratings.ratings,
+	}
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(j.dir, storeSnapshotFile)
+
+	tmp, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	tmp.Close()
+
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		return err
+	}
+
+	// Entries left behind by a crash here are skipped on load, as the snapshot's Sequence covers them
+	err = j.file.Truncate(0)
+	if err != nil {
+		return err
+	}
+
+	j.entries = 0
+
+	return nil
+}
+
+// load restores the stores from the snapshot and the journal entries written after it
+func (j *storeJournal) load(ctx context.Context) error {
+	data, err := ioutil.ReadFile(filepath.Join(j.dir, storeSnapshotFile))
+
+	if err == nil {
+		var snapshot storeSnapshot
+
+		err = json.Unmarshal(data, &snapshot)
+		if err != nil {
+			return err
+		}
+
+		j.restore(snapshot)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	file, err := os.Open(filepath.Join(j.dir, storeJournalFile))
+
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	replayed := 0
+
+	for {
+		line, err := reader.ReadBytes('\n')
+
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Warningf(ctx, "[Store] Discarding partly written journal entry")
+			}
+			break
+		} else if err != nil {
+			return err
+		}
+
+		var entry journalEntry
+
+		err = json.Unmarshal(line, &entry)
+		if err != nil {
+			log.Warningf(ctx, "[Store] Discarding unreadable journal entry: %v", err.Error())
+			break
+		}
+
+		if entry.Sequence <= j.sequence {
+			continue
+		}
+
+		err = j.apply(entry)
+		if err != nil {
+			return err
+		}
+
+		j.sequence = entry.Sequence
+		replayed++
+	}
+
+	log.Infof(ctx, "[Store] Restored %v servers, %v users, %v allocations and %v bans, replaying %v journal entries",
+		len(j.servers.servers), len(j.users.users), len(j.allocations.allocations), len(j.bans.bans), replayed)
+
+	return nil
+}
+
+func (j *storeJournal) restore(snapshot storeSnapshot) {
+	j.sequence = snapshot.Sequence
+	j.servers.stats = snapshot.Stats
+
+	for key, value := range snapshot.Servers {
+		j.servers.servers[key] = value
+	}
+
+	for key, value := range snapshot.Users {
+		j.users.users[key] = value
+	}
+
+	for key, value := range snapshot.Joins {
+		j.joins.joins[key] = value
+	}
+
+	for key, value := range snapshot.Allocations {
+		j.allocations.allocations[key] = value
+	}
+
+	for key, value := range snapshot.Bans {
+		j.bans.bans[key] = value
+	}
+
+	for key, value := range snapshot.Parties {
+		j.parties.parties[key] = value
+	}
+
+	for key, value := range snapshot.Ratings {
+		j.ratings.ratings[key] = value
+	}
+}
+
+// apply replays a journal entry onto the stores
+func (j *storeJournal) apply(entry journalEntry) (err error) {
+	deleted := len(entry.Value) == 0
+
+	switch entry.Kind {
+	case journalServers:
+		var server gameServer
+		if deleted {
+			delete(j.servers.servers, entry.Key)
+		} else if err = json.Unmarshal(entry.Value, &server); err == nil {
+			j.servers.servers[entry.Key] = server
+		}
+	case journalStats:
+		var stats serverStats
+		if deleted {
+			var before time.Time
+			if before, err = time.Parse(time.RFC3339Nano, entry.Key); err == nil {
+				remaining := j.servers.stats[:0]
+				for _, stat := range j.servers.stats {
+					if !stat.Timestamp.Before(before) {
+						remaining = append(remaining, stat)
+					}
+				}
+				j.servers.stats = remaining
+			}
+		} else if err = json.Unmarshal(entry.Value, &stats); err == nil {
+			j.servers.stats = append(j.servers.stats, stats)
+		}
+	case journalUsers:
+		var user mmUser
+		if deleted {
+			delete(j.users.users, entry.Key)
+		} else if err = json.Unmarshal(entry.Value, &user); err == nil {
+			j.users.users[entry.Key] = user
+		}
+	case journalJoins:
+		var join joinRecord
+		if deleted {
+			delete(j.joins.joins, entry.Key)
+		} else if err = json.Unmarshal(entry.Value, &join); err == nil {
+			j.joins.joins[entry.Key] = join
+		}
+	case journalAllocations:
+		var alloc allocation
+		if deleted {
+			delete(j.allocations.allocations, entry.Key)
+		} else if err = json.Unmarshal(entry.Value, &alloc); err == nil {
+			j.allocations.allocations[entry.Key] = alloc
+		}
+	case journalBans:
+		var b ban
+		if deleted {
+			delete(j.bans.bans, entry.Key)
+		} else if err = json.Unmarshal(entry.Value, &b); err == nil {
+			j.bans.bans[entry.Key] = b
+		}
+	case journalParties:
+		var p party
+		if deleted {
+			delete(j.parties.parties, entry.Key)
+		} else if err = json.Unmarshal(entry.Value, &p); err == nil {
+			j.parties.parties[entry.Key] = p
+		}
+	case journalRatings:
+		var rating playerRating
+		if deleted {
+			delete(j.ratings.ratings, entry.Key)
+		} else if err = json.Unmarshal(entry.Value, &rating); err == nil {
+			j.ratings.ratings[entry.Key] = rating
+		}
+	}
+
+	return
+}
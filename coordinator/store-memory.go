@@ -0,0 +1,730 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type memoryServerStore struct {
+	mu      sync.Mutex
+	servers map[string]gameServer
+	stats   []serverStats
+	journal *storeJournal // Set when backed by files, see store-file.go
+}
+
+func newMemoryServerStore() *memoryServerStore {
+	return &memoryServerStore{servers: make(map[string]gameServer)}
+}
+
+func (s *memoryServerStore) GetServer(ctx context.Context, serverID string) (gameServer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	server, ok := s.servers[serverID]
+	if !ok {
+		return gameServer{}, errNotFound
+	}
+
+	return server, nil
+}
+
+func (s *memoryServerStore) FindServer(ctx context.Context, region, mode string, queryNonEmpty bool) (gameServer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var found gameServer
+	foundAny := false
+
+	for _, server := range s.servers {
+		if server.Region != region || server.State != serverStateActive || server.Mode != mode {
+			continue
+		}
+
+		if queryNonEmpty && server.Fill <= 0 {
+			continue
+		} else if !queryNonEmpty && server.PlayerCount != 0 {
+			continue
+		}
+
+		if !foundAny || server.Fill < found.Fill || (server.Fill == found.Fill && server.UUID < found.UUID) {
+			found = server
+			foundAny = true
+		}
+	}
+
+	if !foundAny {
+		return gameServer{}, errNotFound
+	}
+
+	return found, nil
+}
+
+func (s *memoryServerStore) ListServers(ctx context.Context, region string) ([]gameServer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var servers []gameServer
+
+	for _, server := range s.servers {
+		if server.Region == region {
+			servers = append(servers, server)
+		}
+	}
+
+	return servers, nil
+}
+
+func (s *memoryServerStore) PutServer(ctx context.Context, server gameServer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.journal.record(journalServers, server.UUID, server)
+	if err != nil {
+		return err
+	}
+
+	s.servers[server.UUID] = server
+
+	return nil
+}
+
+func (s *memoryServerStore) UpdateServer(ctx context.Context, serverID string, update func(server *gameServer) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	server, ok := s.servers[serverID]
+	if !ok {
+		return errNotFound
+	}
+
+	err := update(&server)
+	if err != nil {
+		return err
+	}
+
+	err = s.journal.record(journalServers, serverID, server)
+	if err != nil {
+		return err
+	}
+
+	s.servers[serverID] = server
+
+	return nil
+}
+
+func (s *memoryServerStore) AdvanceSequence(ctx context.Context, serverID, kind string, sequence int64) error {
+	return s.UpdateServer(ctx, serverID, func(server *gameServer) error {
+		if !server.acceptSequence(kind, sequence) {
+			return errReplayedRequest
+		}
+
+		return nil
+	})
+}
+
+func (s *memoryServerStore) DeleteServers(ctx context.Context, serverIDs []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, serverID := range serverIDs {
+		err := s.journal.record(journalServers, serverID, nil)
+		if err != nil {
+			return err
+		}
+
+		delete(s.servers, serverID)
+	}
+
+	return nil
+}
+
+func (s *memoryServerStore) PutServerStats(ctx context.Context, stats serverStats) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.journal.record(journalStats, "", stats)
+	if err != nil {
+		return err
+	}
+
+	s.stats = append(s.stats, stats)
+
+	return nil
+}
+
+func (s *memoryServerStore) ListServerStats(ctx context.Context, before time.Time) ([]serverStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var stats []serverStats
+
+	for _, stat := range s.stats {
+		if stat.Timestamp.Before(before) {
+			stats = append(stats, stat)
+		}
+	}
+
+	return stats, nil
+}
+
+func (s *memoryServerStore) DeleteServerStats(ctx context.Context, before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.journal.record(journalStats, before.Format(time.RFC3339Nano), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	remaining := s.stats[:0]
+
+	for _, stat := range s.stats {
+		if !stat.Timestamp.Before(before) {
+			remaining = append(remaining, stat)
+		}
+	}
+
+	count := len(s.stats) - len(remaining)
+	s.stats = remaining
+
+	return count, nil
+}
+
+type memoryUserStore struct {
+	mu      sync.Mutex
+	users   map[string]mmUser
+	journal *storeJournal
+}
+
+func newMemoryUserStore() *memoryUserStore {
+	return &memoryUserStore{users: make(map[string]mmUser)}
+}
+
+func (s *memoryUserStore) GetUserByID(ctx context.Context, userID string) (mmUser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userID]
+	if !ok {
+		return mmUser{}, errNotFound
+	}
+
+	return user, nil
+}
+
+func (s *memoryUserStore) GetUserByToken(ctx context.Context, mmtok string) (mmUser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, user := range s.users {
+		if user.MMTok == mmtok {
+			return user, nil
+		}
+	}
+
+	return mmUser{}, errNotFound
+}
+
+func (s *memoryUserStore) PutUser(ctx context.Context, user mmUser) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.journal.record(journalUsers, user.UserID, user)
+	if err != nil {
+		return err
+	}
+
+	s.users[user.UserID] = user
+
+	return nil
+}
+
+func (s *memoryUserStore) CountUsers(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.users), nil
+}
+
+func (s *memoryUserStore) DeleteUsersCheckedBefore(ctx context.Context, before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := 0
+
+	for userID, user := range s.users {
+		if user.CheckTime.Before(before) {
+			err := s.journal.record(journalUsers, userID, nil)
+			if err != nil {
+				return count, err
+			}
+
+			delete(s.users, userID)
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+type memoryJoinStore struct {
+	mu      sync.Mutex
+	joins   map[string]joinRecord
+	journal *storeJournal
+}
+
+func newMemoryJoinStore() *memoryJoinStore {
+	return &memoryJoinStore{joins: make(map[string]joinRecord)}
+}
+
+func (s *memoryJoinStore) PutJoin(ctx context.Context, join joinRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.journal.record(journalJoins, join.JoinToken, join)
+	if err != nil {
+		return err
+	}
+
+	s.joins[join.JoinToken] = join
+
+	return nil
+}
+
+func (s *memoryJoinStore) TakeUncheckedJoins(ctx context.Context, serverID string) ([]joinRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var joins []joinRecord
+
+	for joinToken, join := range s.joins {
+		if join.ServerID != serverID || join.Checked {
+			continue
+		}
+
+		join.Checked = true
+
+		err := s.journal.record(journalJoins, joinToken, join)
+		if err != nil {
+			return joins, err
+		}
+
+		s.joins[joinToken] = join
+
+		joins = append(joins, join)
+	}
+
+	return joins, nil
+}
+
+func (s *memoryJoinStore) UpdateJoin(ctx context.Context, joinToken string, update func(join *joinRecord) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	join, ok := s.joins[joinToken]
+	if !ok {
+		return errNotFound
+	}
+
+	err := update(&join)
+	if err != nil {
+		return err
+	}
+
+	err = s.journal.record(journalJoins, joinToken, join)
+	if err != nil {
+		return err
+	}
+
+	s.joins[joinToken] = join
+
+	return nil
+}
+
+func (s *memoryJoinStore) ClaimJoins(ctx context.Context, joinTokens []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, joinToken := range joinTokens {
+		join, ok := s.joins[joinToken]
+		if !ok {
+			return errNotFound
+		} else if join.Rated {
+			return errJoinRated
+		}
+	}
+
+	return s.setRated(joinTokens, true)
+}
+
+func (s *memoryJoinStore) ReleaseJoins(ctx context.Context, joinTokens []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.setRated(joinTokens, false)
+}
+
+// setRated marks the stored joins rated or unrated, skipping missing joins. s.mu must be held.
+func (s *memoryJoinStore) setRated(joinTokens []string, rated bool) error {
+	for _, joinToken := range joinTokens {
+		join, ok := s.joins[joinToken]
+		if !ok {
+			continue
+		}
+
+		join.Rated = rated
+
+		err := s.journal.record(journalJoins, joinToken, join)
+		if err != nil {
+			return err
+		}
+
+		s.joins[joinToken] = join
+	}
+
+	return nil
+}
+
+func (s *memoryJoinStore) ListServerJoins(ctx context.Context, serverID string) ([]joinRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var joins []joinRecord
+	since := time.Now().Add(-joinRecordExpiryTime * time.Minute)
+
+	for _, join := range s.joins {
+		if join.ServerID == serverID && !join.CreationTime.Before(since) {
+			joins = append(joins, join)
+		}
+	}
+
+	return joins, nil
+}
+
+func (s *memoryJoinStore) CountJoins(ctx context.Context, region string, since time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := 0
+
+	for _, join := range s.joins {
+		if join.Region == region && !join.CreationTime.Before(since) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func (s *memoryJoinStore) DeleteJoinsCreatedBefore(ctx context.Context, before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := 0
+
+	for joinToken, join := range s.joins {
+		if join.CreationTime.Before(before) {
+			err := s.journal.record(journalJoins, joinToken, nil)
+			if err != nil {
+				return count, err
+			}
+
+			delete(s.joins, joinToken)
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+type memoryAllocationStore struct {
+	mu          sync.Mutex
+	allocations map[string]allocation
+	journal     *storeJournal
+}
+
+func newMemoryAllocationStore() *memoryAllocationStore {
+	return &memoryAllocationStore{allocations: make(map[string]allocation)}
+}
+
+func (s *memoryAllocationStore) GetAllocation(ctx context.Context, serverID string) (allocation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	alloc, ok := s.allocations[serverID]
+	if !ok {
+		return allocation{}, errNotFound
+	}
+
+	return alloc, nil
+}
+
+func (s *memoryAllocationStore) PutAllocation(ctx context.Context, alloc allocation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.journal.record(journalAllocations, alloc.ServerID, alloc)
+	if err != nil {
+		return err
+	}
+
+	s.allocations[alloc.ServerID] = alloc
+
+	return nil
+}
+
+func (s *memoryAllocationStore) ListOpenAllocations(ctx context.Context, region string) ([]allocation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var allocs []allocation
+
+	for _, alloc := range s.allocations {
+		if alloc.Region == region && alloc.open() {
+			allocs = append(allocs, alloc)
+		}
+	}
+
+	return allocs, nil
+}
+
+func (s *memoryAllocationStore) DeleteClosedAllocations(ctx context.Context, before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := 0
+
+	for serverID, alloc := range s.allocations {
+		if !alloc.open() && alloc.UpdateTime.Before(before) {
+			err := s.journal.record(journalAllocations, serverID, nil)
+			if err != nil {
+				return count, err
+			}
+
+			delete(s.allocations, serverID)
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+type memoryBanStore struct {
+	mu      sync.Mutex
+	bans    map[string]ban
+	journal *storeJournal
+}
+
+func newMemoryBanStore() *memoryBanStore {
+	return &memoryBanStore{bans: make(map[string]ban)}
+}
+
+func (s *memoryBanStore) GetBan(ctx context.Context, banID string) (ban, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.bans[banID]
+	if !ok {
+		return ban{}, errNotFound
+	}
+
+	return b, nil
+}
+
+func (s *memoryBanStore) ListBans(ctx context.Context, userID string) ([]ban, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var userBans []ban
+
+	for _, b := range s.bans {
+		if userID == "" || b.UserID == userID {
+			userBans = append(userBans, b)
+		}
+	}
+
+	return userBans, nil
+}
+
+func (s *memoryBanStore) PutBan(ctx context.Context, b ban) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.journal.record(journalBans, b.ID, b)
+	if err != nil {
+		return err
+	}
+
+	s.bans[b.ID] = b
+
+	return nil
+}
+
+func (s *memoryBanStore) DeleteBan(ctx context.Context, banID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.journal.record(journalBans, banID, nil)
+	if err != nil {
+		return err
+	}
+
+	delete(s.bans, banID)
+
+	return nil
+}
+
+func (s *memoryBanStore) DeleteExpiredBans(ctx context.Context, before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := 0
+
+	for banID, b := range s.bans {
+		if !b.Permanent && b.ExpiryTime.Before(before) {
+			err := s.journal.record(journalBans, banID, nil)
+			if err != nil {
+				return count, err
+			}
+
+			delete(s.bans, banID)
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+type memoryPartyStore struct {
+	mu      sync.Mutex
+	parties map[string]party
+	journal *storeJournal
+}
+
+func newMemoryPartyStore() *memoryPartyStore {
+	return &memoryPartyStore{parties: make(map[string]party)}
+}
+
+func (s *memoryPartyStore) GetParty(ctx context.Context, partyID string) (party, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.parties[partyID]
+	if !ok {
+		return party{}, errNotFound
+	}
+
+	return p, nil
+}
+
+func (s *memoryPartyStore) PutParty(ctx context.Context, p party) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p.Members = append([]string(nil), p.Members...)
+
+	err := s.journal.record(journalParties, p.ID, p)
+	if err != nil {
+		return err
+	}
+
+	s.parties[p.ID] = p
+
+	return nil
+}
+
+func (s *memoryPartyStore) UpdateParty(ctx context.Context, partyID string, update func(p *party) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.parties[partyID]
+	if !ok {
+		return errNotFound
+	}
+
+	p.Members = append([]string(nil), p.Members...)
+
+	err := update(&p)
+	if err != nil {
+		return err
+	}
+
+	err = s.journal.record(journalParties, partyID, p)
+	if err != nil {
+		return err
+	}
+
+	s.parties[partyID] = p
+
+	return nil
+}
+
+func (s *memoryPartyStore) ListPartiesUpdatedBefore(ctx context.Context, before time.Time) ([]party, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var stale []party
+
+	for _, p := range s.parties {
+		if p.UpdateTime.Before(before) {
+			stale = append(stale, p)
+		}
+	}
+
+	return stale, nil
+}
+
+func (s *memoryPartyStore) DeleteParties(ctx context.Context, partyIDs []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, partyID := range partyIDs {
+		err := s.journal.record(journalParties, partyID, nil)
+		if err != nil {
+			return err
+		}
+
+		delete(s.parties, partyID)
+	}
+
+	return nil
+}
+
+type memoryRatingStore struct {
+	mu      sync.Mutex
+	ratings map[string]playerRating
+	journal *storeJournal
+}
+
+func newMemoryRatingStore() *memoryRatingStore {
+	return &memoryRatingStore{ratings: make(map[string]playerRating)}
+}
+
+func (s *memoryRatingStore) GetRating(ctx context.Context, userID string) (playerRating, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rating, ok := s.ratings[userID]
+	if !ok {
+		return playerRating{}, errNotFound
+	}
+
+	return rating, nil
+}
+
+func (s *memoryRatingStore) PutRatings(ctx context.Context, playerRatings []playerRating) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, rating := range playerRatings {
+		err := s.journal.record(journalRatings, rating.UserID, rating)
+		if err != nil {
+			return err
+		}
+
+		s.ratings[rating.UserID] = rating
+	}
+
+	return nil
+}
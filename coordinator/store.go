@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var errNotFound = errors.New("entity not found")
+
+// serverStore persists GameServer records and the ServerStats snapshots taken by the server manager
+type serverStore interface {
+	GetServer(ctx context.Context, serverID string) (gameServer, error)
+	FindServer(ctx context.Context, region, mode string, queryNonEmpty bool) (gameServer, error)
+	ListServers(ctx context.Context, region string) ([]gameServer, error)
+	PutServer(ctx context.Context, server gameServer) error
+	// UpdateServer atomically applies update to the server, saving it unless update returns an error
+	UpdateServer(ctx context.Context, serverID string, update func(server *gameServer) error) error
+	// AdvanceSequence atomically accepts the sequence number of a signed server request of the
+	// kind, returning errReplayedRequest if it was used before
+	AdvanceSequence(ctx context.Context, serverID, kind string, sequence int64) error
+	DeleteServers(ctx context.Context, serverIDs []string) error
+	PutServerStats(ctx context.Context, stats serverStats) error
+	ListServerStats(ctx context.Context, before time.Time) ([]serverStats, error)
+	DeleteServerStats(ctx context.Context, before time.Time) (int, error)
+}
+
+// userStore persists MMUser records
+type userStore interface {
+	GetUserByID(ctx context.Context, userID string) (mmUser, error)
+	GetUserByToken(ctx context.Context, mmtok string) (mmUser, error)
+	PutUser(ctx context.Context, user mmUser) error
+	CountUsers(ctx context.Context) (int, error)
+	DeleteUsersCheckedBefore(ctx context.Context, before time.Time) (int, error)
+}
+
+// joinStore persists JoinRecord entries until they are delivered to their server
+type joinStore interface {
+	PutJoin(ctx context.Context, join joinRecord) error
+	TakeUncheckedJoins(ctx context.Context, serverID string) ([]joinRecord, error)
+	// UpdateJoin atomically applies update to the join, saving it unless update returns an error
+	UpdateJoin(ctx context.Context, joinToken string, update func(join *joinRecord) error) error
+	// ClaimJoins atomically marks the joins rated, changing none of them and returning errJoinRated
+	// if one was already rated or errNotFound if one is missing
+	ClaimJoins(ctx context.Context, joinTokens []string) error
+	// ReleaseJoins marks claimed joins unrated again, for results that could not be saved
+	ReleaseJoins(ctx context.Context, joinTokens []string) error
+	// ListServerJoins returns the joins matched onto the server that have not expired, those created
+	// within the last joinRecordExpiryTime minutes
+	ListServerJoins(ctx context.Context, serverID string) ([]joinRecord, error)
+	// CountJoins counts the joins matched in region since the given time
+	CountJoins(ctx context.Context, region string, since time.Time) (int, error)
+	DeleteJoinsCreatedBefore(ctx context.Context, before time.Time) (int, error)
+}
+
+// allocationStore persists Allocation records for servers requested from the provider
+type allocationStore interface {
+	GetAllocation(ctx context.Context, serverID string) (allocation, error)
+	PutAllocation(ctx context.Context, alloc allocation) error
+	ListOpenAllocations(ctx context.Context, region string) ([]allocation, error)
+	DeleteClosedAllocations(ctx context.Context, before time.Time) (int, error)
+}
+
+// banStore persists Ban records from the coordinator ban list
+type banStore interface {
+	GetBan(ctx context.Context, banID string) (ban, error)
+	// ListBans returns the user's bans, or all bans when userID is empty, including expired ones
+	ListBans(ctx context.Context, userID string) ([]ban, error)
+	PutBan(ctx context.Context, b ban) error
+	DeleteBan(ctx context.Context, banID string) error
+	DeleteExpiredBans(ctx context.Context, before time.Time) (int, error)
+}
+
+// partyStore persists Party records
+type partyStore interface {
+	GetParty(ctx context.Context, partyID string) (party, error)
+	PutParty(ctx context.Context, p party) error
+	// UpdateParty atomically applies update to the party, saving it unless update returns an error
+	UpdateParty(ctx context.Context, partyID string, update func(p *party) error) error
+	ListPartiesUpdatedBefore(ctx context.Context, before time.Time) ([]party, error)
+	DeleteParties(ctx context.Context, partyIDs []string) error
+}
+
+// ratingStore persists PlayerRating records
+type ratingStore interface {
+	GetRating(ctx context.Context, userID string) (playerRating, error)
+	// PutRatings atomically saves the ratings of a match's players
+	PutRatings(ctx context.Context, playerRatings []playerRating) error
+}
+
+// Stores used by all handlers, swapped for the in-memory implementations in tests
+var servers serverStore = datastoreServerStore{}
+var users userStore = datastoreUserStore{}
+var joins joinStore = datastoreJoinStore{}
+var allocations allocationStore = datastoreAllocationStore{}
+var bans banStore = datastoreBanStore{}
+var parties partyStore = datastorePartyStore{}
+var ratings ratingStore = datastoreRatingStore{}
+
+// useMemoryStores replaces the Datastore backed stores with fresh in-memory stores
+func useMemoryStores() {
+	servers = newMemoryServerStore()
+	users = newMemoryUserStore()
+	joins = newMemoryJoinStore()
+	allocations = newMemoryAllocationStore()
+	bans = newMemoryBanStore()
+	parties = newMemoryPartyStore()
+	ratings = newMemoryRatingStore()
+}
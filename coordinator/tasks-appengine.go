@@ -0,0 +1,20 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"time"
+
+	"google.golang.org/appengine/taskqueue"
+)
+
+// appengineTaskDispatcher adds tasks to the App Engine push queues defined in queue.yaml
+type appengineTaskDispatcher struct{}
+
+func (appengineTaskDispatcher) Add(ctx context.Context, path string, params url.Values, delay time.Duration, queueName string) (err error) {
+	t := taskqueue.NewPOSTTask(path, params)
+	t.Delay = delay
+	_, err = taskqueue.Add(ctx, t, queueName)
+
+	return
+}
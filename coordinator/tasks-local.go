@@ -0,0 +1,508 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	defaultQueueName     = "default"
+	localTaskIdleSeconds = 60
+)
+
+// taskQueueConfig holds the settings of a queue.yaml entry
+type taskQueueConfig struct {
+	Name          string
+	Rate          float64 // Tasks per second
+	BucketSize    int
+	MaxConcurrent int
+	RetryLimit    int
+	AgeLimit      time.Duration
+	MinBackoff    time.Duration
+	MaxBackoff    time.Duration
+	MaxDoublings  int
+}
+
+type queueYAML struct {
+	Queue []struct {
+		Name                  string `yaml:"name"`
+		Rate                  string `yaml:"rate"`
+		BucketSize            int    `yaml:"bucket_size"`
+		MaxConcurrentRequests int    `yaml:"max_concurrent_requests"`
+		RetryParameters       struct {
+			TaskRetryLimit    int     `yaml:"task_retry_limit"`
+			TaskAgeLimit      string  `yaml:"task_age_limit"`
+			MinBackoffSeconds float64 `yaml:"min_backoff_seconds"`
+			MaxBackoffSeconds float64 `yaml:"max_backoff_seconds"`
+			MaxDoublings      int     `yaml:"max_doublings"`
+		} `yaml:"retry_parameters"`
+	} `yaml:"queue"`
+}
+
+// Defaults App Engine applies to the default queue and to unset retry parameters
+var defaultTaskQueueConfig = taskQueueConfig{
+	Name:          defaultQueueName,
+	Rate:          5,
+	BucketSize:    5,
+	MaxConcurrent: 0,
+	RetryLimit:    0,
+	AgeLimit:      0,
+	MinBackoff:    time.Millisecond * 100,
+	MaxBackoff:    time.Hour,
+	MaxDoublings:  16,
+}
+
+// loadTaskQueueConfigs reads queue definitions from a queue.yaml file
+func loadTaskQueueConfigs(path string) (configs map[string]taskQueueConfig, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	var parsed queueYAML
+
+	err = yaml.Unmarshal(data, &parsed)
+	if err != nil {
+		return
+	}
+
+	configs = map[string]taskQueueConfig{defaultQueueName: defaultTaskQueueConfig}
+
+	for _, q := range parsed.Queue {
+		config := defaultTaskQueueConfig
+		config.Name = q.Name
+		config.MaxConcurrent = q.MaxConcurrentRequests
+		config.RetryLimit = q.RetryParameters.TaskRetryLimit
+
+		if q.Rate != "" {
+			config.Rate, err = parseQueueRate(q.Rate)
+			if err != nil {
+				return nil, fmt.Errorf("queue %v: %v", q.Name, err)
+			}
+		}
+
+		if q.BucketSize > 0 {
+			config.BucketSize = q.BucketSize
+		}
+
+		if q.RetryParameters.TaskAgeLimit != "" {
+			config.AgeLimit, err = parseQueueDuration(q.RetryParameters.TaskAgeLimit)
+			if err != nil {
+				return nil, fmt.Errorf("queue %v: %v", q.Name, err)
+			}
+		}
+
+		if q.RetryParameters.MinBackoffSeconds > 0 {
+			config.MinBackoff = time.Duration(q.RetryParameters.MinBackoffSeconds * float64(time.Second))
+		}
+
+		if q.RetryParameters.MaxBackoffSeconds > 0 {
+			config.MaxBackoff = time.Duration(q.RetryParameters.MaxBackoffSeconds * float64(time.Second))
+		}
+
+		if q.RetryParameters.MaxDoublings > 0 {
+			config.MaxDoublings = q.RetryParameters.MaxDoublings
+		}
+
+		configs[q.Name] = config
+	}
+
+	return
+}
+
+var queueTimeUnits = map[string]time.Duration{
+	"s": time.Second,
+	"m": time.Minute,
+	"h": time.Hour,
+	"d": time.Hour * 24,
+}
+
+// parseQueueRate parses a queue.yaml rate such as "5/s" into tasks per second
+func parseQueueRate(rate string) (float64, error) {
+	parts := strings.Split(rate, "/")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid rate %q", rate)
+	}
+
+	count, err := strconv.ParseFloat(parts[0], 64)
+	unit, ok := queueTimeUnits[parts[1]]
+
+	if err != nil || !ok {
+		return 0, fmt.Errorf("invalid rate %q", rate)
+	}
+
+	return count / unit.Seconds(), nil
+}
+
+// parseQueueDuration parses a queue.yaml duration such as "5m"
+func parseQueueDuration(duration string) (time.Duration, error) {
+	if len(duration) < 2 {
+		return 0, fmt.Errorf("invalid duration %q", duration)
+	}
+
+	count, err := strconv.ParseFloat(duration[:len(duration)-1], 64)
+	unit, ok := queueTimeUnits[duration[len(duration)-1:]]
+
+	if err != nil || !ok {
+		return 0, fmt.Errorf("invalid duration %q", duration)
+	}
+
+	return time.Duration(count * float64(unit)), nil
+}
+
+// localTask is the on-disk record of a queued task
+type localTask struct {
+	Name       string
+	Path       string
+	Params     url.Values
+	Queue      string
+	Created    time.Time
+	ETA        time.Time
+	RetryCount int
+
+	running bool
+}
+
+// localTaskDispatcher persists tasks as JSON files so they survive a restart, and runs them
+// in-process against handler once due. Without a directory tasks are only kept in memory.
+type localTaskDispatcher struct {
+	ctx     context.Context
+	handler http.Handler
+	dir     string
+	queues  map[string]*localTaskQueue
+	wg      sync.WaitGroup
+}
+
+type localTaskQueue struct {
+	dispatcher *localTaskDispatcher
+	config     taskQueueConfig
+	dir        string
+
+	mu         sync.Mutex
+	tasks      map[string]*localTask
+	running    int
+	tokens     float64
+	lastRefill time.Time
+	wake       chan struct{}
+}
+
+func newLocalTaskDispatcher(ctx context.Context, handler http.Handler, dir string, configs map[string]taskQueueConfig) (*localTaskDispatcher, error) {
+	d := &localTaskDispatcher{
+		ctx:     ctx,
+		handler: handler,
+		dir:     dir,
+		queues:  make(map[string]*localTaskQueue),
+	}
+
+	for name, config := range configs {
+		queueDir := ""
+		if dir != "" {
+			queueDir = filepath.Join(dir, name)
+		}
+
+		q := &localTaskQueue{
+			dispatcher: d,
+			config:     config,
+			dir:        queueDir,
+			tasks:      make(map[string]*localTask),
+			tokens:     float64(config.BucketSize),
+			lastRefill: time.Now(),
+			wake:       make(chan struct{}, 1),
+		}
+
+		err := q.load()
+		if err != nil {
+			return nil, err
+		}
+
+		d.queues[name] = q
+	}
+
+	return d, nil
+}
+
+// Start runs the queues until the dispatcher context is cancelled
+func (d *localTaskDispatcher) Start() {
+	for _, q := range d.queues {
+		go q.process()
+	}
+}
+
+// Wait blocks until all running tasks have returned
+func (d *localTaskDispatcher) Wait() {
+	d.wg.Wait()
+}
+
+func (d *localTaskDispatcher) Add(ctx context.Context, path string, params url.Values, delay time.Duration, queueName string) error {
+	q, ok := d.queues[queueName]
+	if !ok {
+		return fmt.Errorf("unknown task queue %v", queueName)
+	}
+
+	now := time.Now()
+
+	task := &localTask{
+		Name:    uuid.Must(uuid.NewV4()).String(),
+		Path:    path,
+		Params:  params,
+		Queue:   queueName,
+		Created: now,
+		ETA:     now.Add(delay),
+	}
+
+	return q.add(task)
+}
+
+func (q *localTaskQueue) load() error {
+	if q.dir == "" {
+		return nil
+	}
+
+	err := os.MkdirAll(q.dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	files, err := filepath.Glob(filepath.Join(q.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+
+		task := new(localTask)
+
+		err = json.Unmarshal(data, task)
+		if err != nil {
+			log.Errorf(q.dispatcher.ctx, "[Tasks] Discarding unreadable task %v: %v", file, err.Error())
+			os.Remove(file)
+			continue
+		}
+
+		q.tasks[task.Name] = task
+	}
+
+	if len(q.tasks) > 0 {
+		log.Infof(q.dispatcher.ctx, "[Tasks] Restored %v tasks on queue %v", len(q.tasks), q.config.Name)
+	}
+
+	return nil
+}
+
+func (q *localTaskQueue) add(task *localTask) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	err := q.persist(task)
+	if err != nil {
+		return err
+	}
+
+	q.tasks[task.Name] = task
+	q.signal()
+
+	return nil
+}
+
+func (q *localTaskQueue) taskFile(task *localTask) string {
+	return filepath.Join(q.dir, task.Name+".json")
+}
+
+// persist writes the task to disk, replacing any previous version atomically
+func (q *localTaskQueue) persist(task *localTask) error {
+	if q.dir == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+
+	tmp := q.taskFile(task) + ".tmp"
+
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, q.taskFile(task))
+}
+
+func (q *localTaskQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *localTaskQueue) process() {
+	for {
+		task, wait := q.next()
+
+		if task != nil {
+			q.dispatcher.wg.Add(1)
+			go q.run(task)
+			continue
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-q.wake:
+		case <-q.dispatcher.ctx.Done():
+			return
+		}
+	}
+}
+
+// next returns the next due task if the queue's rate and concurrency limits allow it, otherwise
+// how long to wait before checking again
+func (q *localTaskQueue) next() (*localTask, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	idle := time.Second * localTaskIdleSeconds
+
+	if q.dispatcher.ctx.Err() != nil {
+		return nil, idle
+	}
+
+	if q.config.MaxConcurrent > 0 && q.running >= q.config.MaxConcurrent {
+		return nil, idle // Woken when a running task completes
+	}
+
+	now := time.Now()
+
+	q.tokens = math.Min(float64(q.config.BucketSize), q.tokens+now.Sub(q.lastRefill).Seconds()*q.config.Rate)
+	q.lastRefill = now
+
+	var due []*localTask
+
+	for _, task := range q.tasks {
+		if !task.running {
+			due = append(due, task)
+		}
+	}
+
+	if len(due) == 0 {
+		return nil, idle
+	}
+
+	sort.Slice(due, func(i, j int) bool { return due[i].ETA.Before(due[j].ETA) })
+
+	task := due[0]
+
+	if task.ETA.After(now) {
+		return nil, task.ETA.Sub(now)
+	}
+
+	if q.tokens < 1 {
+		return nil, time.Duration((1 - q.tokens) / q.config.Rate * float64(time.Second))
+	}
+
+	q.tokens--
+	q.running++
+	task.running = true
+
+	return task, 0
+}
+
+func (q *localTaskQueue) run(task *localTask) {
+	defer q.dispatcher.wg.Done()
+
+	header := http.Header{}
+	header.Set(taskQueueNameHeader, task.Queue)
+	header.Set(taskNameHeader, task.Name)
+	header.Set(taskRetryCountHeader, strconv.Itoa(task.RetryCount))
+
+	// Running tasks are allowed to finish during shutdown
+	ctx := context.Background()
+
+	status := invokeHandler(ctx, q.dispatcher.handler, "POST", task.Path, task.Params, header)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.running--
+	task.running = false
+	q.signal()
+
+	if status >= 200 && status < 300 {
+		q.remove(task)
+		return
+	}
+
+	task.RetryCount++
+
+	if q.exhausted(task) {
+		log.Errorf(ctx, "[Tasks] Task %v (%v) on queue %v failed after %v attempts, discarding", task.Name, task.Path, task.Queue, task.RetryCount)
+		q.remove(task)
+		return
+	}
+
+	task.ETA = time.Now().Add(q.backoff(task.RetryCount))
+
+	err := q.persist(task)
+	if err != nil {
+		log.Errorf(ctx, "[Tasks] %v", err.Error())
+	}
+}
+
+func (q *localTaskQueue) remove(task *localTask) {
+	delete(q.tasks, task.Name)
+
+	if q.dir == "" {
+		return
+	}
+
+	err := os.Remove(q.taskFile(task))
+	if err != nil && !os.IsNotExist(err) {
+		log.Errorf(q.dispatcher.ctx, "[Tasks] %v", err.Error())
+	}
+}
+
+// exhausted applies App Engine's rule that when both limits are set, both must be reached
+func (q *localTaskQueue) exhausted(task *localTask) bool {
+	retriesReached := q.config.RetryLimit > 0 && task.RetryCount > q.config.RetryLimit
+	ageReached := q.config.AgeLimit > 0 && time.Now().Sub(task.Created) > q.config.AgeLimit
+
+	if q.config.RetryLimit > 0 && q.config.AgeLimit > 0 {
+		return retriesReached && ageReached
+	}
+
+	return retriesReached || ageReached
+}
+
+func (q *localTaskQueue) backoff(retryCount int) time.Duration {
+	doublings := retryCount - 1
+	if doublings > q.config.MaxDoublings {
+		doublings = q.config.MaxDoublings
+	}
+
+	backoff := q.config.MinBackoff * time.Duration(1<<uint(doublings))
+
+	if backoff > q.config.MaxBackoff || backoff <= 0 {
+		backoff = q.config.MaxBackoff
+	}
+
+	return backoff
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	taskQueueNameHeader  = "X-AppEngine-QueueName"
+	taskNameHeader       = "X-AppEngine-TaskName"
+	taskRetryCountHeader = "X-AppEngine-TaskRetryCount"
+)
+
+// taskDispatcher schedules POST requests to handlers on named queues, which apply the
+// rate limits and retry parameters configured in queue.yaml
+type taskDispatcher interface {
+	Add(ctx context.Context, path string, params url.Values, delay time.Duration, queueName string) error
+}
+
+var tasks taskDispatcher = appengineTaskDispatcher{}
+
+// addTask schedules a POST of params to path on the named queue after delay
+func addTask(ctx context.Context, path string, params url.Values, delay time.Duration, queueName string) error {
+	return tasks.Add(ctx, path, params, delay, queueName)
+}
+
+// invokeHandler calls handler in-process and returns the response status code
+func invokeHandler(ctx context.Context, handler http.Handler, method, path string, params url.Values, header http.Header) int {
+	req, err := http.NewRequest(method, path, strings.NewReader(params.Encode()))
+
+	if err != nil {
+		log.Errorf(ctx, "[Tasks] %v", err.Error())
+		return http.StatusInternalServerError
+	}
+
+	req = req.WithContext(ctx)
+	req.Header = header
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	recorder := &statusRecorder{header: http.Header{}, status: http.StatusOK}
+	handler.ServeHTTP(recorder, req)
+
+	return recorder.status
+}
+
+// statusRecorder is a ResponseWriter that discards the body and keeps the status code
+type statusRecorder struct {
+	header      http.Header
+	status      int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	return len(b), nil
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+}